@@ -0,0 +1,90 @@
+package caddyauth
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// errNotTailnetAddr is returned for client addresses outside Tailscale's address ranges
+var errNotTailnetAddr = errors.New("not a Tailscale address")
+
+// tailnetPrefixes are the address ranges Tailscale assigns to devices
+var tailnetPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+}
+
+// via4via6Prefix holds Tailscale's 4via6 addresses, which embed a site ID and
+// an IPv4 address behind a site-to-site subnet router:
+// fd7a:115c:a1e0:b1a:0:<site id>:<ipv4>
+var via4via6Prefix = netip.MustParsePrefix("fd7a:115c:a1e0:b1a::/64")
+
+// serviceAddrs are tailscaled's own service addresses (MagicDNS and the local
+// API), which never belong to a device in the tailnet
+var serviceAddrs = []netip.Addr{
+	netip.MustParseAddr("100.100.100.100"),
+	netip.MustParseAddr("fd7a:115c:a1e0::53"),
+}
+
+// parseClientAddr parses ip in any of the forms clients and proxies send it
+// (bracketed, with a port or zone identifier, non-canonical IPv6, IPv4-mapped
+// IPv6) into the canonical address the API reports
+func parseClientAddr(ip string) (netip.Addr, bool) {
+	ip = strings.TrimSpace(ip)
+
+	var addr netip.Addr
+	if addrPort, err := netip.ParseAddrPort(ip); err == nil {
+		addr = addrPort.Addr()
+	} else {
+		parsed, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]"))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = parsed
+	}
+
+	return addr.WithZone("").Unmap(), true
+}
+
+// canonicalIP returns the canonical string form of ip for use as a cache key,
+// or ip unchanged if it is not an IP address
+func canonicalIP(ip string) string {
+	addr, ok := parseClientAddr(ip)
+	if !ok {
+		return ip
+	}
+	return addr.String()
+}
+
+// decode4via6 returns the site ID and IPv4 address embedded in a 4via6 address
+func decode4via6(addr netip.Addr) (uint32, netip.Addr, bool) {
+	if !via4via6Prefix.Contains(addr) {
+		return 0, netip.Addr{}, false
+	}
+
+	b := addr.As16()
+	site := binary.BigEndian.Uint32(b[8:12])
+	return site, netip.AddrFrom4([4]byte(b[12:16])), true
+}
+
+// isTailnetAddr reports whether addr is in one of Tailscale's address ranges
+func isTailnetAddr(addr netip.Addr) bool {
+	for _, prefix := range tailnetPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isServiceAddr reports whether addr is one of tailscaled's service addresses
+func isServiceAddr(addr netip.Addr) bool {
+	for _, s := range serviceAddrs {
+		if addr == s {
+			return true
+		}
+	}
+	return false
+}
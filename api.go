@@ -0,0 +1,280 @@
+package caddyauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned by an APIClient for devices that do not exist
+var ErrNotFound = client.ErrNotFound
+
+// refreshTimeout bounds refreshes made for a request or a webhook
+const refreshTimeout = 30 * time.Second
+
+// refresh fetches the latest device list from Tailscale API
+func (c *tailnetCache) refresh(ctx context.Context) error {
+	devices, date, err := c.client.Devices(ctx, c.tailnet, c.subnetRoutes)
+	if err != nil {
+		c.apiErr.record(err)
+		return err
+	}
+
+	for i := range devices {
+		protectKeys(&devices[i], c.keyMaterial)
+	}
+
+	if c.fetchPosture {
+		for i := range devices {
+			c.fetchPostureAttributes(ctx, &devices[i])
+		}
+	}
+
+	var users []User
+	if c.fetchUsers {
+		fetched, err := c.client.Users(ctx, c.tailnet)
+		if err != nil {
+			c.apiErr.record(err)
+			c.logger.Warn("failed to fetch users, keeping previous user roles", zap.Error(err))
+		} else {
+			users = fetched
+		}
+	}
+
+	var policyFile *PolicyFile
+	if c.fetchGroups {
+		fetched, err := c.client.PolicyFile(ctx, c.tailnet)
+		if err != nil {
+			c.apiErr.record(err)
+			c.logger.Warn("failed to fetch policy file, keeping previous groups and grants", zap.Error(err))
+		} else {
+			policyFile = fetched
+		}
+	}
+
+	// Update cache with new device data
+	c.replace(devices, users, policyFile, date)
+	c.lastRefresh.Store(time.Now().UnixNano())
+
+	return nil
+}
+
+// refreshOnce refreshes the cache unless a refresh that started after the
+// call finished while it waited, returning that one's result instead. A
+// burst of concurrent misses, webhooks and polls thus makes at most two API
+// calls: the one in flight and one for everything that arrived during it.
+// Waiting for the refresh in flight ends with ctx
+func (c *tailnetCache) refreshOnce(ctx context.Context) error {
+	requested := time.Now().UnixNano()
+
+	select {
+	case c.refreshSlot <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for the refresh in flight: %w", ctx.Err())
+	}
+	defer func() { <-c.refreshSlot }()
+
+	if c.refreshStart >= requested {
+		return c.refreshErr
+	}
+	c.refreshStart = time.Now().UnixNano()
+	c.lastAttempt.Store(c.refreshStart)
+	c.refreshErr = c.refresh(ctx)
+	c.attemptErr.Store(c.refreshErr != nil)
+	if c.refreshErr != nil {
+		c.errStreak.Add(1)
+	} else {
+		c.errStreak.Store(0)
+	}
+	return c.refreshErr
+}
+
+// coolingDown reports whether the last refresh started within miss_refresh_cooldown
+func (c *tailnetCache) coolingDown() bool {
+	if c.missCooldown == 0 {
+		return false
+	}
+	last := c.lastAttempt.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) < c.missCooldown
+}
+
+// reloadDue reports whether a cache miss may reload a shared store, which
+// it does at most once per miss_refresh_cooldown
+func (c *tailnetCache) reloadDue() bool {
+	if c.missCooldown == 0 {
+		return true
+	}
+	now := time.Now().UnixNano()
+	last := c.lastReload.Load()
+	if last != 0 && time.Duration(now-last) < c.missCooldown {
+		return false
+	}
+	return c.lastReload.CompareAndSwap(last, now)
+}
+
+// warmUp fetches the device list before the first request, giving up after timeout
+func (c *tailnetCache) warmUp(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := c.refreshOnce(ctx); err != nil {
+		c.logger.Warn("failed to warm up device cache, the first miss will refresh it", zap.Error(err))
+		return
+	}
+	c.logger.Info("warmed up device cache", zap.Duration("duration", time.Since(start)))
+}
+
+// pollLoop refreshes the cache about every interval until Destruct. The
+// first poll comes after a random part of the interval and every later wait
+// is jittered by up to a tenth of it, so caches and Caddy instances started
+// together do not poll the API together
+func (c *tailnetCache) pollLoop(interval time.Duration) {
+	defer close(c.pollDone)
+
+	timer := time.NewTimer(rand.N(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			c.poll(interval)
+			timer.Reset(interval - interval/10 + rand.N(interval/5+1))
+		case <-c.pollStop:
+			return
+		}
+	}
+}
+
+// poll refreshes the cache unless it, or a shared store another instance
+// writes, was refreshed within half the interval
+func (c *tailnetCache) poll(interval time.Duration) {
+	if c.fresh(interval / 2) {
+		return
+	}
+
+	if c.store != nil && c.store.Shared() {
+		if err := c.reload(); err != nil {
+			c.logger.Warn("failed to reload shared device cache", zap.Error(err))
+		} else if updated, err := http.ParseTime(c.lastUpdate()); err == nil && time.Since(updated) < interval/2 {
+			c.logger.Debug("shared device cache is recent, skipping poll")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+	if err := c.refreshOnce(ctx); err != nil {
+		c.logger.Warn("failed to refresh device cache in the background", zap.Error(err))
+	}
+}
+
+// fetchPostureAttributes fetches the posture attributes of device. Failures
+// are logged and leave the device without attributes, which fails any posture requirement
+func (c *tailnetCache) fetchPostureAttributes(ctx context.Context, device *Device) {
+	attrs, err := c.client.PostureAttributes(ctx, device.ID)
+	if err != nil {
+		c.apiErr.record(err)
+		c.logger.Warn("failed to fetch device posture attributes",
+			zap.String("device", device.Name),
+			zap.Error(err))
+		return
+	}
+	device.PostureAttributes = attrs
+}
+
+// refreshDevice fetches a single device and updates only its IP mappings,
+// removing it from the cache if it no longer exists
+func (c *tailnetCache) refreshDevice(ctx context.Context, id string) error {
+	device, err := c.client.Device(ctx, id, c.subnetRoutes)
+	if errors.Is(err, ErrNotFound) {
+		c.remove(id)
+		return nil
+	}
+	if err != nil {
+		c.apiErr.record(err)
+		return err
+	}
+
+	protectKeys(device, c.keyMaterial)
+
+	if c.fetchPosture {
+		c.fetchPostureAttributes(ctx, device)
+	}
+
+	c.upsert(device)
+
+	return nil
+}
+
+// get returns the device for the given IP address, refreshing the cache if it
+// does not know the address or, with a non-zero maxAge, is older than that
+func (c *tailnetCache) get(ctx context.Context, clientIP string, maxAge time.Duration) (*deviceMatch, error) {
+	c.lookups.Add(1)
+	defer c.lookups.Add(-1)
+
+	// First, check if device exists in cache
+	if match, ok := c.match(clientIP); ok && c.fresh(maxAge) {
+		c.hits.record(true)
+		return match, nil
+	}
+
+	if err := c.checkResolvable(clientIP); err != nil {
+		return nil, err
+	}
+
+	// Another instance may already have refreshed a shared store
+	if c.store != nil && c.store.Shared() && c.reloadDue() {
+		if err := c.reload(); err != nil {
+			c.logger.Warn("failed to reload shared device cache", zap.Error(err))
+		}
+
+		if match, ok := c.match(clientIP); ok && c.fresh(maxAge) {
+			c.hits.record(true)
+			return match, nil
+		}
+	}
+	c.hits.record(false)
+
+	if c.coolingDown() {
+		if match, ok := c.match(clientIP); ok {
+			match.stale = !c.fresh(maxAge) && c.attemptErr.Load()
+			return match, nil
+		}
+		if c.attemptErr.Load() {
+			return nil, fmt.Errorf("%w: the last refresh failed less than miss_refresh_cooldown ago", errRefresh)
+		}
+		return nil, fmt.Errorf("%w for IP %s, and the cache was refreshed less than miss_refresh_cooldown ago", errDeviceNotFound, clientIP)
+	}
+
+	// Device not found in cache, refresh and try again
+	c.logger.Info("unknown device IP, refreshing cache", zap.String("client_ip", clientIP))
+
+	if err := c.refreshOnce(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w", errRefresh, err)
+	}
+
+	// Check cache again after refresh
+	match, ok := c.match(clientIP)
+	if !ok {
+		return nil, fmt.Errorf("%w for IP %s even after cache refresh", errDeviceNotFound, clientIP)
+	}
+
+	return match, nil
+}
+
+// fresh reports whether the whole cache was refreshed within maxAge. Zero
+// does not limit the age
+func (c *tailnetCache) fresh(maxAge time.Duration) bool {
+	if maxAge == 0 {
+		return true
+	}
+	refreshed := c.lastRefresh.Load()
+	return refreshed != 0 && time.Since(time.Unix(0, refreshed)) < maxAge
+}
@@ -0,0 +1,19 @@
+package caddyauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRefreshOnceWaitEndsWithContext(t *testing.T) {
+	c := &tailnetCache{refreshSlot: make(chan struct{}, 1)}
+	c.refreshSlot <- struct{}{} // a refresh in flight
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.refreshOnce(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("refreshOnce = %v, want the context's deadline", err)
+	}
+}
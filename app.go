@@ -0,0 +1,556 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule((*App)(nil))
+	httpcaddyfile.RegisterGlobalOption("tailscale_auth", parseAppCaddyfile)
+}
+
+// App is the top-level tailscale_auth app. It defines tailnet credentials and
+// cache settings once so that handlers in any number of sites can reference
+// them by name and share a single device cache.
+type App struct {
+	// Defaults holds tailnet and cache settings inherited by every named
+	// tailnet and by handlers that do not reference one with use. Handlers
+	// only need to set the options that differ
+	Defaults *TailnetConfig `json:"defaults,omitempty"`
+
+	// Tailnets holds the shared tailnet configurations, keyed by name
+	Tailnets map[string]*TailnetConfig `json:"tailnets,omitempty"`
+
+	// Nodes holds embedded tsnet nodes, keyed by name. Sites listen on them
+	// with addresses like tsnet/<name>:443 and handlers identify clients
+	// through them with node
+	Nodes map[string]*NodeConfig `json:"nodes,omitempty"`
+
+	// Policies holds reusable sets of access rules, keyed by name, that
+	// handlers apply with policy
+	Policies map[string]*policy.Policy `json:"policies,omitempty"`
+
+	// HandlerDefaults holds handler options inherited by every handler that
+	// does not set them itself, whether or not it uses a named tailnet
+	HandlerDefaults *HandlerDefaults `json:"handler_defaults,omitempty"`
+
+	// KeyMaterial controls the machine, node and Tailnet Lock keys of devices
+	// in every cache and everything derived from them: "keep" stores them as
+	// the API returns them, "hash" replaces them with a truncated SHA-256
+	// hash and "omit" drops them (default: "keep")
+	KeyMaterial string `json:"key_material,omitempty"`
+
+	logger    *zap.Logger
+	cacheKeys []string
+}
+
+// CaddyModule returns the Caddy module information.
+func (*App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tailscale_auth",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+
+	for name, cfg := range a.Nodes {
+		if cfg == nil {
+			return fmt.Errorf("node %q: configuration is empty", name)
+		}
+		if err := expandPlaceholders(
+			configField{"auth_key", &cfg.AuthKey},
+			configField{"hostname", &cfg.Hostname},
+			configField{"state_dir", &cfg.StateDir},
+			configField{"control_url", &cfg.ControlURL},
+		); err != nil {
+			return fmt.Errorf("node %q: %w", name, err)
+		}
+	}
+	setTsnetNodeConfigs(a.Nodes)
+
+	if err := validateKeyMaterial(a.KeyMaterial); err != nil {
+		return err
+	}
+
+	for name, p := range a.Policies {
+		if p == nil {
+			return fmt.Errorf("policy %q: configuration is empty", name)
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("policy %q: %w", name, err)
+		}
+	}
+
+	if a.HandlerDefaults != nil {
+		for _, name := range a.HandlerDefaults.Policies {
+			if _, err := a.policy(name); err != nil {
+				return fmt.Errorf("handler_defaults: %w", err)
+			}
+		}
+	}
+
+	if a.Defaults != nil {
+		if err := a.Defaults.expandPlaceholders(); err != nil {
+			return fmt.Errorf("defaults: %w", err)
+		}
+	}
+
+	for name, cfg := range a.Tailnets {
+		if cfg == nil {
+			return fmt.Errorf("tailnet %q: configuration is empty", name)
+		}
+		if err := cfg.expandPlaceholders(); err != nil {
+			return fmt.Errorf("tailnet %q: %w", name, err)
+		}
+		cfg.inherit(a.Defaults)
+		cfg.setDefaults()
+		cfg.keyMaterial = a.KeyMaterial
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("tailnet %q: %w", name, err)
+		}
+
+		// Hold a reference to each cache so it lives as long as the app,
+		// independent of how many handlers currently use it
+		_, key, err := cfg.loadCache(ctx, a.logger.With(zap.String("tailnet", name)))
+		if err != nil {
+			return fmt.Errorf("tailnet %q: %w", name, err)
+		}
+		a.cacheKeys = append(a.cacheKeys, key)
+	}
+
+	return nil
+}
+
+// Start implements caddy.App.
+func (a *App) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App.
+func (a *App) Stop() error {
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (a *App) Cleanup() error {
+	for _, key := range a.cacheKeys {
+		if _, err := cachePool.Delete(key); err != nil {
+			return err
+		}
+	}
+	a.cacheKeys = nil
+	return nil
+}
+
+// tailnet returns the named tailnet configuration
+func (a *App) tailnet(name string) (*TailnetConfig, error) {
+	cfg, ok := a.Tailnets[name]
+	if !ok {
+		return nil, fmt.Errorf("tailnet %q is not defined in the tailscale_auth app", name)
+	}
+	return cfg, nil
+}
+
+// HandlerDefaults are handler options that can be set once in the app. Each
+// one applies to handlers that leave it unset
+type HandlerDefaults struct {
+	// HeaderPrefix is the prefix of the identity headers
+	HeaderPrefix string `json:"header_prefix,omitempty"`
+
+	// Policies names the app's policies that requests must satisfy. A
+	// handler's own policy list replaces it rather than adding to it
+	Policies []string `json:"policies,omitempty"`
+
+	// FailMode is what happens when a client cannot be looked up: "open" or "closed"
+	FailMode string `json:"fail_mode,omitempty"`
+
+	// NonTailnetAction controls requests from outside Tailscale's ranges: "skip" or "deny"
+	NonTailnetAction string `json:"non_tailnet_action,omitempty"`
+
+	// ClientIPSource selects where the client IP is taken from: "headers" or "connection"
+	ClientIPSource string `json:"client_ip_source,omitempty"`
+
+	// MaxCacheAge is how long identities are trusted after the last successful refresh
+	MaxCacheAge caddy.Duration `json:"max_cache_age,omitempty"`
+
+	// DenyStatus is the status code of denied requests: 401, 403 or 404
+	DenyStatus int `json:"deny_status,omitempty"`
+
+	// DenyFormat selects how denials are answered: "error" or "negotiate"
+	DenyFormat string `json:"deny_format,omitempty"`
+}
+
+// inheritHandlerDefaults fills the handler options t leaves unset from the
+// app's handler defaults, if the app is configured
+func (t *TailscaleAuth) inheritHandlerDefaults(ctx caddy.Context) error {
+	appIface, err := ctx.AppIfConfigured("tailscale_auth")
+	if errors.Is(err, caddy.ErrNotConfigured) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defaults := appIface.(*App).HandlerDefaults
+	if defaults == nil {
+		return nil
+	}
+
+	if t.HeaderPrefix == "" {
+		t.HeaderPrefix = defaults.HeaderPrefix
+	}
+	if len(t.Policies) == 0 {
+		t.Policies = defaults.Policies
+	}
+	if t.FailMode == "" {
+		t.FailMode = defaults.FailMode
+	}
+	if t.NonTailnetAction == "" {
+		t.NonTailnetAction = defaults.NonTailnetAction
+	}
+	if t.ClientIPSource == "" {
+		t.ClientIPSource = defaults.ClientIPSource
+	}
+	if t.MaxCacheAge == 0 {
+		t.MaxCacheAge = defaults.MaxCacheAge
+	}
+	if t.DenyStatus == 0 {
+		t.DenyStatus = defaults.DenyStatus
+	}
+	if t.DenyFormat == "" {
+		t.DenyFormat = defaults.DenyFormat
+	}
+	return nil
+}
+
+// policy returns the named policy
+func (a *App) policy(name string) (*policy.Policy, error) {
+	p, ok := a.Policies[name]
+	if !ok {
+		return nil, fmt.Errorf("policy %q is not defined in the tailscale_auth app", name)
+	}
+	return p, nil
+}
+
+// resolveAppConfig completes a handler's tailnet configuration from the app.
+// With use, cfg is replaced by the named tailnet; otherwise its unset options
+// are inherited from the app's defaults, if the app is configured
+func resolveAppConfig(ctx caddy.Context, use string, cfg *TailnetConfig) error {
+	if use == "" {
+		appIface, err := ctx.AppIfConfigured("tailscale_auth")
+		if errors.Is(err, caddy.ErrNotConfigured) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		cfg.inherit(appIface.(*App).Defaults)
+		return nil
+	}
+
+	if *cfg != (TailnetConfig{}) {
+		return fmt.Errorf("use %q: api_key, tailnet and cache options must be set in the tailscale_auth app, not the handler", use)
+	}
+
+	appIface, err := ctx.AppIfConfigured("tailscale_auth")
+	if err != nil {
+		return fmt.Errorf("use %q: %w", use, err)
+	}
+
+	named, err := appIface.(*App).tailnet(use)
+	if err != nil {
+		return err
+	}
+	*cfg = *named
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the app from Caddyfile tokens. Syntax:
+//
+//	tailscale_auth {
+//	    api_key <key>
+//	    tailnet <tailnet>
+//	    ...
+//	    <name> {
+//	        api_key <key>
+//	        tailnet <tailnet>
+//	        ...
+//	    }
+//	    node <name> {
+//	        auth_key <key>
+//	        hostname <hostname>
+//	        state_dir <dir>
+//	        ephemeral
+//	        control_url <url>
+//	    }
+//	    policy <name> {
+//	        require_role <roles...>
+//	        ...
+//	    }
+//	    handler_defaults {
+//	        header_prefix <prefix>
+//	        policy <names...>
+//	        fail_mode open|closed
+//	        non_tailnet_action skip|deny
+//	        deny_status <status>
+//	        deny_format error|negotiate
+//	    }
+//	}
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if a.Defaults == nil {
+		a.Defaults = new(TailnetConfig)
+	}
+
+	for d.Next() {
+		for d.NextBlock(0) {
+			ok, err := a.Defaults.unmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+
+			if d.Val() == "node" {
+				if err := a.unmarshalNode(d); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if d.Val() == "policy" {
+				if err := a.unmarshalPolicy(d); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if d.Val() == "key_material" {
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.KeyMaterial = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				continue
+			}
+
+			if d.Val() == "handler_defaults" {
+				if err := a.unmarshalHandlerDefaults(d); err != nil {
+					return err
+				}
+				continue
+			}
+
+			name := d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if _, ok := a.Tailnets[name]; ok {
+				return d.Errf("tailnet %q is already defined", name)
+			}
+
+			cfg := new(TailnetConfig)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				ok, err := cfg.unmarshalCaddyfileOption(d)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return d.Errf("unrecognized subdirective: %s", d.Val())
+				}
+			}
+
+			if a.Tailnets == nil {
+				a.Tailnets = make(map[string]*TailnetConfig)
+			}
+			a.Tailnets[name] = cfg
+		}
+	}
+
+	if *a.Defaults == (TailnetConfig{}) {
+		a.Defaults = nil
+	}
+	return nil
+}
+
+// unmarshalPolicy parses a policy block
+func (a *App) unmarshalPolicy(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if _, ok := a.Policies[name]; ok {
+		return d.Errf("policy %q is already defined", name)
+	}
+
+	p := new(policy.Policy)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		ok, err := unmarshalPolicyOption(p, d)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return d.Errf("unrecognized policy rule: %s", d.Val())
+		}
+	}
+
+	if a.Policies == nil {
+		a.Policies = make(map[string]*policy.Policy)
+	}
+	a.Policies[name] = p
+	return nil
+}
+
+// unmarshalHandlerDefaults parses a handler_defaults block
+func (a *App) unmarshalHandlerDefaults(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if a.HandlerDefaults == nil {
+		a.HandlerDefaults = new(HandlerDefaults)
+	}
+	defaults := a.HandlerDefaults
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		option := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 || (option != "policy" && len(args) > 1) {
+			return d.ArgErr()
+		}
+
+		switch option {
+		case "header_prefix":
+			defaults.HeaderPrefix = args[0]
+		case "policy":
+			defaults.Policies = append(defaults.Policies, args...)
+		case "fail_mode":
+			defaults.FailMode = args[0]
+		case "non_tailnet_action":
+			defaults.NonTailnetAction = args[0]
+		case "client_ip_source":
+			defaults.ClientIPSource = args[0]
+		case "max_cache_age":
+			maxAge, err := caddy.ParseDuration(args[0])
+			if err != nil {
+				return d.Errf("invalid max_cache_age %q: %v", args[0], err)
+			}
+			defaults.MaxCacheAge = caddy.Duration(maxAge)
+		case "deny_status":
+			status, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid deny_status %q: %v", args[0], err)
+			}
+			defaults.DenyStatus = status
+		case "deny_format":
+			defaults.DenyFormat = args[0]
+		default:
+			return d.Errf("unrecognized handler default: %s", option)
+		}
+	}
+	return nil
+}
+
+// unmarshalNode parses a node block
+func (a *App) unmarshalNode(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if _, ok := a.Nodes[name]; ok {
+		return d.Errf("node %q is already defined", name)
+	}
+
+	cfg := new(NodeConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "auth_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.AuthKey = d.Val()
+		case "hostname":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.Hostname = d.Val()
+		case "state_dir":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.StateDir = d.Val()
+		case "ephemeral":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.Ephemeral = true
+		case "control_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.ControlURL = d.Val()
+		default:
+			return d.Errf("unrecognized node subdirective: %s", d.Val())
+		}
+	}
+
+	if a.Nodes == nil {
+		a.Nodes = make(map[string]*NodeConfig)
+	}
+	a.Nodes[name] = cfg
+	return nil
+}
+
+// parseAppCaddyfile parses the tailscale_auth global option, merging repeated
+// blocks into one app
+func parseAppCaddyfile(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	app := new(App)
+	if existingVal != nil {
+		existing, ok := existingVal.(httpcaddyfile.App)
+		if !ok {
+			return nil, d.Errf("unexpected existing value for tailscale_auth: %T", existingVal)
+		}
+		if err := json.Unmarshal(existing.Value, app); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+
+	return httpcaddyfile.App{
+		Name:  "tailscale_auth",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// Interface guards
+var (
+	_ caddy.App             = (*App)(nil)
+	_ caddy.Provisioner     = (*App)(nil)
+	_ caddy.CleanerUpper    = (*App)(nil)
+	_ caddyfile.Unmarshaler = (*App)(nil)
+)
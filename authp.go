@@ -0,0 +1,105 @@
+package caddyauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// authpHeader is the JWT header of tokens for caddy-security
+var authpHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// authpClaims are the user claims caddy-security's authorize handler reads
+// from a token
+type authpClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Roles     []string `json:"roles"`
+	Origin    string   `json:"origin"`
+	Address   string   `json:"addr,omitempty"`
+	Identity  string   `json:"identity_uri,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	Expires   int64    `json:"exp"`
+}
+
+// provisionAuthp sets up the key that signs tokens for caddy-security
+func (t *TailscaleAuth) provisionAuthp() error {
+	secret := caddy.NewReplacer().ReplaceAll(t.AuthpSecret, "")
+	if secret == "" {
+		return fmt.Errorf("authp_secret is empty after expanding placeholders")
+	}
+	t.authpKey = []byte(secret)
+
+	if len(t.AuthpRoles) == 0 {
+		t.AuthpRoles = []string{"authp/user"}
+	}
+	if t.AuthpTokenLifetime == 0 {
+		t.AuthpTokenLifetime = caddy.Duration(5 * time.Minute)
+	}
+	return nil
+}
+
+// addAuthpToken passes the identity on to caddy-security as a signed bearer
+// token, replacing any Authorization header the client sent. With vars_only
+// output the token is only set as a var
+func (t *TailscaleAuth) addAuthpToken(r *http.Request, match *deviceMatch) {
+	token, err := t.authpToken(r, match, time.Now())
+	if err != nil {
+		t.logger.Error("failed to issue authp token", zap.Error(err))
+		return
+	}
+	if t.Output != "vars_only" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.authp_token", token)
+}
+
+// authpToken signs the claims of the identity. Roles are the configured
+// authp_roles followed by the user's groups and the device's tags
+func (t *TailscaleAuth) authpToken(r *http.Request, match *deviceMatch, now time.Time) (string, error) {
+	device := match.device
+	claims := authpClaims{
+		Issuer:    "tailscale_auth",
+		Subject:   t.localUsername(device.User),
+		Roles:     slices.Concat(t.AuthpRoles, t.userGroups(match), device.Tags),
+		Origin:    "tailscale",
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   now.Add(time.Duration(t.AuthpTokenLifetime)).Unix(),
+	}
+	if t.pseudonymKey == nil && !t.Privacy {
+		if device.IdentityType() == "user" && strings.Contains(device.User, "@") {
+			claims.Email = device.User
+		}
+		if match.user != nil {
+			claims.Name = match.user.DisplayName
+		}
+		claims.Address = t.clientIP(r)
+	}
+	if !t.Privacy {
+		claims.Identity = t.identityURI(match)
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := authpHeader + "." + base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, t.authpKey)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
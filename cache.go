@@ -0,0 +1,677 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+// DeviceCache represents the cached device information
+type DeviceCache = cache.DeviceCache
+
+// cachePool shares live device caches between handler instances so config
+// reloads keep the warm cache instead of starting empty and refreshing again
+var cachePool = caddy.NewUsagePool()
+
+// tailnetCache is the in-memory device cache for one tailnet together with its persistent store
+type tailnetCache struct {
+	tailnet      string
+	client       APIClient
+	subnetRoutes bool
+	fetchUsers   bool
+	fetchPosture bool
+	fetchGroups  bool
+	fetchGrants  bool
+	keyMaterial  string
+	missCooldown time.Duration
+	logger       *zap.Logger
+	mu           sync.RWMutex
+	devices      *DeviceCache
+	routes       []subnetRoute
+	dirty        bool
+	changes      uint64
+	store        cache.Store
+	writeMu      sync.Mutex
+	written      uint64
+	codec        cache.Codec
+	flushStop    chan struct{}
+	flushDone    chan struct{}
+	pollStop     chan struct{}
+	pollDone     chan struct{}
+	refreshSlot  chan struct{}
+	refreshStart int64
+	refreshErr   error
+	lastAttempt  atomic.Int64
+	lastReload   atomic.Int64
+	attemptErr   atomic.Bool
+	keys         apiKeySource
+	hits         hitWindow
+	lastRefresh  atomic.Int64
+	lookups      atomic.Int64
+	apiErr       lastError
+	errStreak    atomic.Int64
+	migrate      atomic.Bool
+	readOnly     atomic.Bool
+}
+
+// Destruct implements caddy.Destructor. It runs once the last handler using the cache is cleaned up.
+func (c *tailnetCache) Destruct() error {
+	if c.pollStop != nil {
+		close(c.pollStop)
+		<-c.pollDone
+	}
+
+	if c.flushStop != nil {
+		close(c.flushStop)
+		<-c.flushDone
+	}
+
+	if c.keys != nil {
+		c.keys.Close()
+	}
+
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// subnetRoute is an enabled route of a subnet router device
+type subnetRoute struct {
+	prefix netip.Prefix
+	device *Device
+}
+
+// deviceMatch is the device a client IP resolved to
+type deviceMatch struct {
+	device          *Device
+	tailnet         string
+	viaSubnetRouter bool
+
+	// cache is the tailnet cache the device was found in
+	cache *tailnetCache
+
+	// user is the device's user, if users are fetched and it has one
+	user *User
+
+	// groups are the policy file groups the device's user belongs to, if groups are fetched
+	groups []string
+
+	// grants are the policy file grants of the device's tailnet, if grants are fetched
+	grants []Grant
+
+	// apps are the application capabilities the grants give the identity, once evaluated
+	apps map[string][]json.RawMessage
+
+	// siteID and siteAddr are decoded from 4via6 client addresses
+	siteID   uint32
+	siteAddr netip.Addr
+
+	// stale is set when the match is older than its source would trust,
+	// because the cache could not be refreshed
+	stale bool
+}
+
+// lastUpdate returns the API date of the cached device list
+func (c *tailnetCache) lastUpdate() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.devices.LastUpdate
+}
+
+// refreshedAt returns when the device list was fetched: by the last refresh,
+// or else the API date of a list loaded from the store. It is zero if unknown
+func (c *tailnetCache) refreshedAt() time.Time {
+	if refreshed := c.lastRefresh.Load(); refreshed != 0 {
+		return time.Unix(0, refreshed)
+	}
+	if updated, err := http.ParseTime(c.lastUpdate()); err == nil {
+		return updated
+	}
+	return time.Time{}
+}
+
+// lookup returns the cached device for ip
+func (c *tailnetCache) lookup(ip string) (*Device, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	device, exists := c.devices.IPToDevice[ip]
+	return device, exists && device != nil
+}
+
+// lookupRoute returns the subnet router whose most specific enabled route contains addr
+func (c *tailnetCache) lookupRoute(addr netip.Addr) (*Device, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, route := range c.routes {
+		if route.prefix.Contains(addr) {
+			return route.device, true
+		}
+	}
+	return nil, false
+}
+
+// match resolves ip to a device by its own address or, with subnet routes
+// enabled, to the subnet router the traffic arrived through
+func (c *tailnetCache) match(ip string) (*deviceMatch, bool) {
+	addr, ok := parseClientAddr(ip)
+	if !ok {
+		return nil, false
+	}
+
+	var m *deviceMatch
+	if device, ok := c.lookup(addr.String()); ok {
+		m = &deviceMatch{device: device, tailnet: c.tailnet}
+	} else if device, ok := c.lookupRoute(addr); ok {
+		m = &deviceMatch{device: device, tailnet: c.tailnet, viaSubnetRouter: true}
+		if site, v4, ok := decode4via6(addr); ok {
+			m.siteID = site
+			m.siteAddr = v4
+		}
+	} else {
+		return nil, false
+	}
+
+	m.cache = c
+	// Tagged devices belong to their tags, not to the user who tagged them
+	if m.device.IdentityType() == "user" {
+		m.user = c.lookupUser(m.device.User)
+		m.groups = c.lookupGroups(m.device.User)
+	}
+	if c.fetchGrants {
+		m.grants = c.lookupGrants()
+	}
+	return m, true
+}
+
+// lookupGrants returns the cached policy file grants. The slice is replaced,
+// never modified, on refresh, so callers may keep it
+func (c *tailnetCache) lookupGrants() []Grant {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.devices.Grants
+}
+
+// lookupGroups returns the cached policy file groups loginName is a member of
+func (c *tailnetCache) lookupGroups(loginName string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var groups []string
+	for group, members := range c.devices.Groups {
+		if policy.ContainsFold(members, loginName) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// lookupUser returns the cached user with the given login name, or nil
+func (c *tailnetCache) lookupUser(loginName string) *User {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.devices.Users[loginName]
+}
+
+// checkResolvable returns an error for client IPs that no refresh of the
+// device list can ever resolve, so they do not trigger API calls
+func (c *tailnetCache) checkResolvable(ip string) error {
+	addr, ok := parseClientAddr(ip)
+	if !ok {
+		return fmt.Errorf("invalid client IP %q", ip)
+	}
+
+	if !isTailnetAddr(addr) {
+		return fmt.Errorf("%s: %w", addr, errNotTailnetAddr)
+	}
+
+	if isServiceAddr(addr) {
+		return fmt.Errorf("%s is a Tailscale service address, not a device", addr)
+	}
+
+	if site, v4, ok := decode4via6(addr); ok && !c.subnetRoutes {
+		return fmt.Errorf("4via6 address %s (site %d, %s) can only be resolved with subnet_routes", addr, site, v4)
+	}
+
+	return nil
+}
+
+// indexRoutes rebuilds the subnet route table from the cached devices, most
+// specific route first. Exit node default routes are ignored. Callers must hold the write lock
+func (c *tailnetCache) indexRoutes() {
+	c.routes = nil
+	if !c.subnetRoutes {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, device := range c.devices.IPToDevice {
+		if device == nil || seen[device.ID] {
+			continue
+		}
+		seen[device.ID] = true
+
+		for _, r := range device.EnabledRoutes {
+			prefix, err := netip.ParsePrefix(r)
+			if err != nil || prefix.Bits() == 0 {
+				continue
+			}
+			c.routes = append(c.routes, subnetRoute{prefix: prefix.Masked(), device: device})
+		}
+	}
+
+	sort.Slice(c.routes, func(i, j int) bool {
+		return c.routes[i].prefix.Bits() > c.routes[j].prefix.Bits()
+	})
+}
+
+// replace swaps in a freshly fetched device list and persists it
+func (c *tailnetCache) replace(devices []Device, users []User, policyFile *PolicyFile, lastUpdate string) {
+	c.mu.Lock()
+
+	// Keep the previous groups and grants if the policy file could not be fetched
+	if policyFile != nil {
+		c.devices.Groups = policyFile.Groups
+		if c.devices.Groups == nil {
+			c.devices.Groups = make(map[string][]string)
+		}
+		if c.fetchGrants {
+			c.devices.Grants = policyFile.Grants
+		}
+	}
+
+	// Keep the previous users if they could not be fetched
+	if users != nil {
+		c.devices.Users = make(map[string]*User, len(users))
+		for i := range users {
+			c.devices.Users[users[i].LoginName] = &users[i]
+		}
+	}
+
+	// Clear existing cache
+	c.devices.IPToDevice = make(map[string]*Device)
+	now := time.Now()
+	entries := make(map[string]*cache.EntryTimes, len(devices))
+
+	// Populate cache with new devices
+	for i := range devices {
+		device := &devices[i]
+		for _, addr := range device.Addresses {
+			c.devices.IPToDevice[canonicalIP(addr)] = device
+		}
+		entries[device.ID] = c.verifiedEntry(device.ID, now)
+	}
+	c.devices.Entries = entries
+
+	c.devices.LastUpdate = lastUpdate
+	c.indexRoutes()
+
+	c.logger.Info("refreshed device cache",
+		zap.Int("device_count", len(devices)),
+		zap.Int("ip_mappings", len(c.devices.IPToDevice)))
+
+	s := c.persist()
+	c.mu.Unlock()
+	c.commit(s)
+}
+
+// upsert replaces the IP mappings of a single device, leaving every other device untouched
+func (c *tailnetCache) upsert(device *Device) {
+	c.mu.Lock()
+
+	entry := c.verifiedEntry(device.ID, time.Now())
+	c.removeMappings(device.ID, device.NodeID)
+	for _, addr := range device.Addresses {
+		c.devices.IPToDevice[canonicalIP(addr)] = device
+	}
+	if c.devices.Entries == nil {
+		c.devices.Entries = make(map[string]*cache.EntryTimes)
+	}
+	c.devices.Entries[device.ID] = entry
+	c.indexRoutes()
+
+	c.logger.Info("updated device in cache",
+		zap.String("device", device.Name),
+		zap.Strings("addresses", device.Addresses))
+
+	s := c.persist()
+	c.mu.Unlock()
+	c.commit(s)
+}
+
+// remove drops the IP mappings of the device with the given ID or node ID
+func (c *tailnetCache) remove(id string) {
+	c.mu.Lock()
+	if c.removeMappings(id, id) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.indexRoutes()
+
+	c.logger.Info("removed device from cache", zap.String("device_id", id))
+
+	s := c.persist()
+	c.mu.Unlock()
+	c.commit(s)
+}
+
+// removeMappings deletes every IP mapping of the device matching id or nodeID
+// and returns how many were removed. Callers must hold the write lock
+func (c *tailnetCache) removeMappings(id, nodeID string) int {
+	removed := 0
+	for ip, device := range c.devices.IPToDevice {
+		if device == nil {
+			continue
+		}
+		if (id != "" && device.ID == id) || (nodeID != "" && device.NodeID == nodeID) {
+			delete(c.devices.IPToDevice, ip)
+			delete(c.devices.Entries, device.ID)
+			removed++
+		}
+	}
+	return removed
+}
+
+// verifiedEntry returns the entry times of a device the API returned at now,
+// keeping when it was first seen. Callers must hold the write lock
+func (c *tailnetCache) verifiedEntry(id string, now time.Time) *cache.EntryTimes {
+	entry := &cache.EntryTimes{FirstSeen: now, LastVerified: now}
+	if prev, ok := c.devices.Entries[id]; ok && prev != nil && !prev.FirstSeen.IsZero() {
+		entry.FirstSeen = prev.FirstSeen
+	}
+	return entry
+}
+
+// persist records a change to the cache and snapshots it for its persistent
+// store, or leaves it to the flusher. Callers must hold the write lock, and
+// pass the snapshot to commit once they have released it
+func (c *tailnetCache) persist() *cacheSnapshot {
+	c.changes++
+	if c.store == nil || c.readOnly.Load() {
+		return nil
+	}
+	if c.flushStop != nil {
+		c.dirty = true
+		return nil
+	}
+
+	s, err := c.snapshot()
+	if err != nil {
+		c.logger.Error("failed to save device cache", zap.Error(err))
+		return nil
+	}
+	return s
+}
+
+// commit saves a snapshot taken by persist, if any
+func (c *tailnetCache) commit(s *cacheSnapshot) {
+	if s == nil {
+		return
+	}
+	if err := c.save(s); err != nil {
+		c.logger.Error("failed to save device cache", zap.Error(err))
+	}
+}
+
+// load loads the device cache from the persistent store
+func (c *tailnetCache) load() error {
+	return c.loadStored(false)
+}
+
+// reload loads a shared store another instance writes, unless it is no newer
+// than the cache in memory, which may hold changes not yet flushed
+func (c *tailnetCache) reload() error {
+	return c.loadStored(true)
+}
+
+// loadStored loads the device cache from the persistent store, with newerOnly
+// only if the stored device list was fetched later than the one in memory
+func (c *tailnetCache) loadStored(newerOnly bool) error {
+	data, err := c.store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to read cache from %s: %w", c.store, err)
+	}
+	if data == nil {
+		return nil // Nothing stored yet, start with empty cache
+	}
+
+	// cache_encryption_migrate lets a plaintext cache in once, which is
+	// encrypted right after it is loaded
+	codec := c.codec
+	codec.AllowPlaintext = c.migrate.Swap(false)
+	migrate := codec.AllowPlaintext && !cache.Encrypted(data)
+	data, err = codec.Decode(data)
+	if err != nil {
+		c.discardCorrupt(err)
+		return nil
+	}
+	if migrate {
+		c.logger.Warn("encrypting plaintext device cache, remove cache_encryption_migrate",
+			zap.String("store", c.store.String()))
+	}
+
+	data, err = cache.Migrate(data)
+	if errors.Is(err, cache.ErrUnsupportedVersion) {
+		// Leave the cache in place for the newer build that wrote it, which
+		// saving the older schema over it would break
+		if c.readOnly.CompareAndSwap(false, true) {
+			c.logger.Warn("device cache was written by a newer release, no longer saving to it",
+				zap.String("store", c.store.String()))
+		}
+		return err
+	}
+	if err != nil {
+		c.discardCorrupt(err)
+		return nil
+	}
+
+	var devices DeviceCache
+	if err := json.Unmarshal(data, &devices); err != nil {
+		c.discardCorrupt(err)
+		return nil
+	}
+	// Caches written by older releases may hold non-canonical keys
+	ipToDevice := make(map[string]*Device, len(devices.IPToDevice))
+	for ip, device := range devices.IPToDevice {
+		ipToDevice[canonicalIP(ip)] = device
+	}
+	devices.IPToDevice = ipToDevice
+
+	// Caches written before key_material was set may hold plaintext keys
+	protected := false
+	for _, device := range ipToDevice {
+		if protectKeys(device, c.keyMaterial) {
+			protected = true
+		}
+	}
+
+	c.mu.Lock()
+	if newerOnly && !newerUpdate(devices.LastUpdate, c.devices.LastUpdate) {
+		c.mu.Unlock()
+		c.logger.Debug("stored device cache is not newer, keeping the one in memory",
+			zap.String("store", c.store.String()))
+		return nil
+	}
+	c.devices = &devices
+	c.changes++
+	c.indexRoutes()
+
+	var s *cacheSnapshot
+	if migrate {
+		s, err = c.snapshot()
+	} else if protected {
+		s = c.persist()
+	}
+
+	c.logger.Info("loaded device cache",
+		zap.String("store", c.store.String()),
+		zap.Int("device_count", len(devices.IPToDevice)),
+		zap.String("last_update", devices.LastUpdate))
+	c.mu.Unlock()
+
+	if migrate {
+		if err == nil {
+			err = c.save(s)
+		}
+		if err != nil {
+			c.logger.Error("failed to encrypt device cache", zap.Error(err))
+		}
+	} else {
+		c.commit(s)
+	}
+
+	return nil
+}
+
+// newerUpdate reports whether the API date stored is later than current
+func newerUpdate(stored, current string) bool {
+	storedAt, err := http.ParseTime(stored)
+	if err != nil {
+		return false
+	}
+	currentAt, err := http.ParseTime(current)
+	return err != nil || storedAt.After(currentAt)
+}
+
+// discardCorrupt moves an unreadable cache out of the way so later startups don't trip over it
+func (c *tailnetCache) discardCorrupt(cause error) {
+	c.logger.Warn("device cache is corrupt, discarding it",
+		zap.String("store", c.store.String()),
+		zap.Error(cause))
+
+	if d, ok := c.store.(interface{ Discard() error }); ok {
+		if err := d.Discard(); err != nil {
+			c.logger.Error("failed to discard corrupt device cache", zap.Error(err))
+		}
+	}
+}
+
+// cacheSnapshot is the device cache as of one change, encoded for the store
+type cacheSnapshot struct {
+	seq     uint64
+	devices *DeviceCache
+	data    []byte
+}
+
+// snapshot encodes the device cache for its store. Callers must hold the
+// write lock; the snapshot stays valid after they release it
+func (c *tailnetCache) snapshot() (*cacheSnapshot, error) {
+	c.devices.Version = cache.CurrentVersion
+	data, err := json.Marshal(c.devices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cache: %w", err)
+	}
+
+	c.logger.Debug("cache data marshaled", zap.Int("data_size", len(data)))
+
+	data, err = c.codec.Encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cache: %w", err)
+	}
+
+	// upsert and remove modify these maps in place
+	devices := *c.devices
+	devices.IPToDevice = maps.Clone(c.devices.IPToDevice)
+	devices.Entries = maps.Clone(c.devices.Entries)
+
+	return &cacheSnapshot{seq: c.changes, devices: &devices, data: data}, nil
+}
+
+// save writes a snapshot to the persistent store. It runs without the cache
+// lock, so slow stores don't hold up lookups, and skips snapshots older than
+// the last one written
+func (c *tailnetCache) save(s *cacheSnapshot) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if s.seq < c.written {
+		return nil
+	}
+
+	if err := c.store.Save(s.data); err != nil {
+		return err
+	}
+	c.written = s.seq
+
+	if h, ok := c.store.(interface{ RecordHistory(*DeviceCache) error }); ok {
+		if err := h.RecordHistory(s.devices); err != nil {
+			c.logger.Error("failed to record device history", zap.Error(err))
+		}
+	}
+
+	c.logger.Info("device cache saved successfully",
+		zap.String("store", c.store.String()),
+		zap.Int("data_size", len(s.data)))
+
+	return nil
+}
+
+// flushLoop periodically writes the cache to its store when it has changed, and once more on shutdown
+func (c *tailnetCache) flushLoop(interval time.Duration) {
+	defer close(c.flushDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.flushStop:
+			c.flush()
+			return
+		}
+	}
+}
+
+// flush saves the cache if it changed since the last save. The store is
+// written without the lock, and the cache stays dirty if it changed meanwhile
+func (c *tailnetCache) flush() {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	s, err := c.snapshot()
+	c.mu.Unlock()
+
+	if err == nil {
+		err = c.save(s)
+	}
+	if err != nil {
+		c.logger.Error("failed to flush device cache", zap.Error(err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == s.seq {
+		c.dirty = false
+	}
+}
+
+// resolveDataPath resolves relative paths against Caddy's data directory
+// rather than whatever working directory Caddy was started from
+func resolveDataPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(caddy.AppDataDir(), p)
+}
@@ -0,0 +1,84 @@
+// Package cache persists tailnet device caches: the serialized document
+// and its schema migrations, the storage backends, and the optional
+// compression and encryption applied before data is stored.
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+// CurrentVersion is the schema version written by this build.
+// Bump it and add an entry to migrations whenever the persisted format changes.
+const CurrentVersion = 1
+
+// DeviceCache represents the cached device information
+type DeviceCache struct {
+	Version    int                       `json:"version"`
+	IPToDevice map[string]*client.Device `json:"ip_to_device"`
+	Users      map[string]*client.User   `json:"users,omitempty"`
+	Groups     map[string][]string       `json:"groups,omitempty"`
+	Grants     []client.Grant            `json:"grants,omitempty"`
+	LastUpdate string                    `json:"last_update"`
+
+	// Entries maps device IDs to when the API returned them. It is optional,
+	// so caches without it keep the schema version and load as before
+	Entries map[string]*EntryTimes `json:"entries,omitempty"`
+}
+
+// EntryTimes records when a cached device was first and last returned by the API
+type EntryTimes struct {
+	FirstSeen    time.Time `json:"first_seen"`
+	LastVerified time.Time `json:"last_verified"`
+}
+
+// migration upgrades a raw cache document by exactly one schema version
+type migration func(doc map[string]json.RawMessage) error
+
+// migrations maps a schema version to the migration that upgrades it to the next version
+var migrations = map[int]migration{
+	// Version 0 caches predate schema versioning and share the version 1 layout
+	0: func(doc map[string]json.RawMessage) error { return nil },
+}
+
+// ErrUnsupportedVersion is returned for caches written with an unknown schema version
+var ErrUnsupportedVersion = errors.New("unsupported cache version")
+
+// Migrate upgrades serialized cache data to CurrentVersion
+func Migrate(data []byte) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("invalid cache version: %w", err)
+		}
+	}
+
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("%w: cache version %d is newer than supported version %d", ErrUnsupportedVersion, version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return data, nil
+	}
+
+	for ; version < CurrentVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from cache version %d", ErrUnsupportedVersion, version)
+		}
+		if err := migrate(doc); err != nil {
+			return nil, fmt.Errorf("failed to migrate cache from version %d: %w", version, err)
+		}
+	}
+
+	doc["version"] = json.RawMessage(fmt.Sprint(CurrentVersion))
+	return json.Marshal(doc)
+}
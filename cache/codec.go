@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedMagic prefixes encrypted cache data so it can be told apart from
+// plaintext JSON. The scrypt salt and the AES-GCM nonce follow it
+var encryptedMagic = []byte("TSAUTH-AESGCM2\n")
+
+// legacyMagic prefixes cache data encrypted by older releases, whose key was
+// the SHA-256 of the passphrase. It is still read, and rewritten on the next save
+var legacyMagic = []byte("TSAUTH-AESGCM1\n")
+
+// saltSize is the length of the scrypt salt stored with encrypted data
+const saltSize = 16
+
+// EncryptionKeyEnv is the environment variable consulted when no encryption key is configured
+const EncryptionKeyEnv = "TAILSCALE_AUTH_CACHE_KEY"
+
+// ErrPlaintext is returned by Decode for plaintext data while a cipher is
+// set, since anyone able to write the store could have planted it
+var ErrPlaintext = errors.New("device cache is not encrypted although cache_encryption_key is set; set cache_encryption_migrate once to encrypt it")
+
+// Cipher encrypts cache data with AES-256-GCM under a key derived from a
+// passphrase with scrypt. Data is written with the salt of the Cipher and
+// read with the salt it was written with
+type Cipher struct {
+	passphrase []byte
+	salt       []byte
+	aead       cipher.AEAD
+
+	mu   sync.Mutex
+	keys map[string]cipher.AEAD
+}
+
+// NewCipher derives a Cipher from passphrase, falling back to
+// EncryptionKeyEnv, or returns nil if neither is set
+func NewCipher(passphrase string) (*Cipher, error) {
+	if passphrase == "" {
+		passphrase = os.Getenv(EncryptionKeyEnv)
+	}
+	if passphrase == "" {
+		return nil, nil
+	}
+
+	c := &Cipher{passphrase: []byte(passphrase), salt: make([]byte, saltSize), keys: make(map[string]cipher.AEAD)}
+	if _, err := rand.Read(c.salt); err != nil {
+		return nil, fmt.Errorf("failed to generate cache salt: %w", err)
+	}
+	aead, err := c.forSalt(c.salt)
+	if err != nil {
+		return nil, err
+	}
+	c.aead = aead
+	return c, nil
+}
+
+// forSalt returns the AEAD for data written with salt, deriving its key once
+func (c *Cipher) forSalt(salt []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aead, ok := c.keys[string(salt)]; ok {
+		return aead, nil
+	}
+	key, err := scrypt.Key(c.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive cache key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[string(salt)] = aead
+	return aead, nil
+}
+
+// legacy returns the AEAD of data encrypted by older releases
+func (c *Cipher) legacy() (cipher.AEAD, error) {
+	key := sha256.Sum256(c.passphrase)
+	return newGCM(key[:])
+}
+
+// newGCM returns an AES-256-GCM AEAD for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Magic numbers identifying compressed cache data
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Codec compresses and encrypts serialized cache data for storage
+type Codec struct {
+	// Cipher encrypts the data, or nil to store it in plaintext
+	Cipher *Cipher
+
+	// AllowPlaintext accepts plaintext data despite a Cipher, so that an
+	// existing cache can be encrypted
+	AllowPlaintext bool
+
+	// Compression is "gzip", "zstd", or empty or "off" for none
+	Compression string
+}
+
+// Encrypted reports whether data read from storage is encrypted
+func Encrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic) || bytes.HasPrefix(data, legacyMagic)
+}
+
+// Encode prepares serialized cache data for storage
+func (c Codec) Encode(data []byte) ([]byte, error) {
+	data, err := compress(c.Compression, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress cache: %w", err)
+	}
+
+	if c.Cipher == nil {
+		return data, nil
+	}
+
+	aead := c.Cipher.aead
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(encryptedMagic)+saltSize+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, c.Cipher.salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, encryptedMagic), nil
+}
+
+// Decode reverses Encode on data read from storage. Plaintext data is
+// rejected while a cipher is set, unless AllowPlaintext is set
+func (c Codec) Decode(data []byte) ([]byte, error) {
+	if !Encrypted(data) {
+		if c.Cipher != nil && !c.AllowPlaintext {
+			return nil, ErrPlaintext
+		}
+		return decompress(data)
+	}
+
+	if c.Cipher == nil {
+		return nil, errors.New("device cache is encrypted but no cache_encryption_key is configured")
+	}
+
+	var aead cipher.AEAD
+	var err error
+	magic := encryptedMagic
+	if bytes.HasPrefix(data, legacyMagic) {
+		magic = legacyMagic
+		data = data[len(legacyMagic):]
+		aead, err = c.Cipher.legacy()
+	} else {
+		data = data[len(encryptedMagic):]
+		if len(data) < saltSize {
+			return nil, errors.New("encrypted device cache is truncated")
+		}
+		aead, err = c.Cipher.forSalt(data[:saltSize])
+		data = data[saltSize:]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted device cache is truncated")
+	}
+
+	plain, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], magic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt device cache (wrong key?): %w", err)
+	}
+	return decompress(plain)
+}
+
+// compress compresses data with the configured algorithm
+func compress(algorithm string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch algorithm {
+	case "", "off":
+		return data, nil
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown cache compression %q", algorithm)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress detects and reverses any compression applied to data
+func decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case bytes.HasPrefix(data, zstdMagic):
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return data, nil
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestCodecEncryption(t *testing.T) {
+	cipher, err := NewCipher("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := Codec{Cipher: cipher, Compression: "gzip"}
+	plain := []byte(`{"version":1,"ip_to_device":{}}`)
+
+	encoded, err := codec.Encode(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Encrypted(encoded) {
+		t.Fatal("encoded data is not marked as encrypted")
+	}
+
+	// Another instance derives its own salt, but reads the stored one
+	other, err := NewCipher("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Codec{Cipher: other}.Decode(encoded)
+	if err != nil || string(decoded) != string(plain) {
+		t.Fatalf("Decode = %q, %v, want %q", decoded, err, plain)
+	}
+
+	wrong, err := NewCipher("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (Codec{Cipher: wrong}).Decode(encoded); err == nil {
+		t.Error("decoded with the wrong passphrase")
+	}
+}
+
+func TestCodecRejectsPlaintext(t *testing.T) {
+	cipher, err := NewCipher("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"version":1}`)
+
+	if _, err := (Codec{Cipher: cipher}).Decode(plain); !errors.Is(err, ErrPlaintext) {
+		t.Errorf("Decode of plaintext = %v, want ErrPlaintext", err)
+	}
+	if decoded, err := (Codec{Cipher: cipher, AllowPlaintext: true}).Decode(plain); err != nil || string(decoded) != string(plain) {
+		t.Errorf("Decode with AllowPlaintext = %q, %v", decoded, err)
+	}
+	if decoded, err := (Codec{}).Decode(plain); err != nil || string(decoded) != string(plain) {
+		t.Errorf("Decode without a cipher = %q, %v", decoded, err)
+	}
+}
+
+func TestCodecLegacyEncryption(t *testing.T) {
+	cipher, err := NewCipher("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.legacy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"version":1}`)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	legacy := aead.Seal(append(append([]byte{}, legacyMagic...), nonce...), nonce, plain, legacyMagic)
+
+	decoded, err := Codec{Cipher: cipher}.Decode(legacy)
+	if err != nil || string(decoded) != string(plain) {
+		t.Errorf("Decode of legacy data = %q, %v, want %q", decoded, err, plain)
+	}
+}
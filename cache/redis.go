@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisStore persists the cache in Redis so multiple instances can share it
+type RedisStore struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisStore connects to Redis with opts and stores the cache under key
+func NewRedisStore(opts *redis.Options, key string) *RedisStore {
+	return &RedisStore{client: redis.NewClient(opts), key: key}
+}
+
+func (s *RedisStore) Load() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *RedisStore) Save(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.client.Set(ctx, s.key, data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to store cache key %s in redis: %w", s.key, err)
+	}
+	return nil
+}
+
+func (s *RedisStore) Shared() bool { return true }
+
+func (s *RedisStore) Close() error { return s.client.Close() }
+
+func (s *RedisStore) String() string { return "redis:" + s.key }
@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables used by the SQLite cache backend
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS device_cache (
+	id         INTEGER PRIMARY KEY CHECK (id = 1),
+	data       BLOB NOT NULL,
+	updated_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS devices (
+	device_id  TEXT PRIMARY KEY,
+	first_seen TEXT NOT NULL,
+	last_seen  TEXT NOT NULL
+);
+` + ipHistorySchema
+
+// ipHistorySchema creates the IP history table. Each row is one period of
+// ownership, so an address that goes from A to B and back to A has three
+const ipHistorySchema = `
+CREATE TABLE IF NOT EXISTS ip_history (
+	ip         TEXT NOT NULL,
+	device_id  TEXT NOT NULL,
+	user       TEXT NOT NULL,
+	hostname   TEXT NOT NULL,
+	first_seen TEXT NOT NULL,
+	last_seen  TEXT NOT NULL,
+	PRIMARY KEY (ip, first_seen)
+);
+`
+
+// IPHistoryEntry records a period during which an IP address belonged to a device and user
+type IPHistoryEntry struct {
+	IP        string    `json:"ip"`
+	DeviceID  string    `json:"device_id"`
+	User      string    `json:"user"`
+	Hostname  string    `json:"hostname"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// SQLiteStore persists the cache in a SQLite database and keeps a
+// history of which device and user each IP address belonged to
+type SQLiteStore struct {
+	db   *sql.DB
+	path string
+}
+
+// NewSQLiteStore opens (and creates if needed) the SQLite database at path
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := migrateIPHistory(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate ip history: %w", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize sqlite schema: %w", err)
+	}
+
+	return &SQLiteStore{db: db, path: path}, nil
+}
+
+func (s *SQLiteStore) Load() ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM device_cache WHERE id = 1`).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *SQLiteStore) Save(data []byte) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := s.db.Exec(`INSERT INTO device_cache (id, data, updated_at) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		data, now); err != nil {
+		return fmt.Errorf("failed to store device cache: %w", err)
+	}
+	return nil
+}
+
+// migrateIPHistory rekeys an ip_history table created by older releases,
+// which kept a single row per IP, device and user, on (ip, first_seen). The
+// periods those rows merged cannot be told apart anymore and are kept as they are
+func migrateIPHistory(db *sql.DB) error {
+	var schema string
+	err := db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'ip_history'`).Scan(&schema)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !strings.Contains(schema, "PRIMARY KEY (ip, device_id, user)") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`ALTER TABLE ip_history RENAME TO ip_history_old`,
+		ipHistorySchema,
+		`INSERT INTO ip_history (ip, device_id, user, hostname, first_seen, last_seen)
+			SELECT ip, device_id, user, hostname, first_seen, last_seen FROM ip_history_old
+			ORDER BY first_seen ON CONFLICT (ip, first_seen) DO NOTHING`,
+		`DROP TABLE ip_history_old`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordHistory updates first/last seen timestamps for every device and IP
+// mapping in cache. An IP starts a new history entry whenever its device or
+// user differs from the latest one
+func (s *SQLiteStore) RecordHistory(devices *DeviceCache) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for ip, device := range devices.IPToDevice {
+		if device == nil {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO devices (device_id, first_seen, last_seen) VALUES (?, ?, ?)
+			ON CONFLICT (device_id) DO UPDATE SET last_seen = excluded.last_seen`,
+			device.ID, now, now); err != nil {
+			return fmt.Errorf("failed to record device history: %w", err)
+		}
+		if err := recordIP(tx, ip, device, now); err != nil {
+			return fmt.Errorf("failed to record ip history: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordIP extends the latest history entry of ip if it has the same owner,
+// and otherwise starts a new one
+func recordIP(tx *sql.Tx, ip string, device *client.Device, now string) error {
+	var deviceID, user, firstSeen string
+	err := tx.QueryRow(`SELECT device_id, user, first_seen FROM ip_history
+		WHERE ip = ? ORDER BY first_seen DESC LIMIT 1`, ip).Scan(&deviceID, &user, &firstSeen)
+	if err == nil && deviceID == device.ID && user == device.User {
+		_, err = tx.Exec(`UPDATE ip_history SET hostname = ?, last_seen = ? WHERE ip = ? AND first_seen = ?`,
+			device.Hostname, now, ip, firstSeen)
+		return err
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO ip_history (ip, device_id, user, hostname, first_seen, last_seen) VALUES (?, ?, ?, ?, ?, ?)`,
+		ip, device.ID, device.User, device.Hostname, now, now)
+	return err
+}
+
+// IPHistory returns every recorded owner of ip, oldest first
+func (s *SQLiteStore) IPHistory(ip string) ([]IPHistoryEntry, error) {
+	rows, err := s.db.Query(`SELECT ip, device_id, user, hostname, first_seen, last_seen
+		FROM ip_history WHERE ip = ? ORDER BY first_seen`, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []IPHistoryEntry
+	for rows.Next() {
+		var e IPHistoryEntry
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&e.IP, &e.DeviceID, &e.User, &e.Hostname, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		e.FirstSeen, _ = time.Parse(time.RFC3339Nano, firstSeen)
+		e.LastSeen, _ = time.Parse(time.RFC3339Nano, lastSeen)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// OwnerAt returns the history entries for ip that cover the given time
+func (s *SQLiteStore) OwnerAt(ip string, at time.Time) ([]IPHistoryEntry, error) {
+	entries, err := s.IPHistory(ip)
+	if err != nil {
+		return nil, err
+	}
+	var owners []IPHistoryEntry
+	for _, e := range entries {
+		if !at.Before(e.FirstSeen) && !at.After(e.LastSeen) {
+			owners = append(owners, e)
+		}
+	}
+	return owners, nil
+}
+
+func (s *SQLiteStore) Shared() bool { return false }
+
+func (s *SQLiteStore) Close() error { return s.db.Close() }
+
+func (s *SQLiteStore) String() string { return "sqlite:" + s.path }
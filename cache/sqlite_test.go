@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+func TestIPHistoryPeriods(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	a := &client.Device{ID: "a", User: "alice@example.com", Hostname: "laptop"}
+	b := &client.Device{ID: "b", User: "bob@example.com", Hostname: "desktop"}
+	for _, owner := range []*client.Device{a, a, b, a} {
+		if err := store.RecordHistory(&DeviceCache{IPToDevice: map[string]*client.Device{"100.64.0.1": owner}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.IPHistory("100.64.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners []string
+	for _, e := range entries {
+		owners = append(owners, e.DeviceID)
+	}
+	if len(owners) != 3 || owners[0] != "a" || owners[1] != "b" || owners[2] != "a" {
+		t.Fatalf("owners = %v, want [a b a]", owners)
+	}
+
+	at, err := store.OwnerAt("100.64.0.1", entries[1].FirstSeen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(at) != 1 || at[0].DeviceID != "b" {
+		t.Errorf("OwnerAt = %v, want b", at)
+	}
+}
+
+func TestIPHistoryMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE ip_history (
+		ip TEXT NOT NULL, device_id TEXT NOT NULL, user TEXT NOT NULL, hostname TEXT NOT NULL,
+		first_seen TEXT NOT NULL, last_seen TEXT NOT NULL,
+		PRIMARY KEY (ip, device_id, user));
+		CREATE INDEX ip_history_ip ON ip_history (ip, first_seen);
+		INSERT INTO ip_history VALUES ('100.64.0.1', 'a', 'alice@example.com', 'laptop',
+			'2025-01-01T00:00:00Z', '2025-01-02T00:00:00Z')`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	entries, err := store.IPHistory("100.64.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DeviceID != "a" {
+		t.Fatalf("entries after migration = %v, want the old entry", entries)
+	}
+
+	b := &client.Device{ID: "b", User: "bob@example.com"}
+	a := &client.Device{ID: "a", User: "alice@example.com"}
+	for _, owner := range []*client.Device{b, a} {
+		if err := store.RecordHistory(&DeviceCache{IPToDevice: map[string]*client.Device{"100.64.0.1": owner}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err = store.IPHistory("100.64.0.1"); err != nil || len(entries) != 3 {
+		t.Errorf("entries = %v, %v, want 3 periods", entries, err)
+	}
+}
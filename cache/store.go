@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Store persists the serialized device cache between restarts
+type Store interface {
+	// Load returns the stored cache data, or nil if nothing has been stored yet
+	Load() ([]byte, error)
+	// Save replaces the stored cache data
+	Save(data []byte) error
+	// Shared reports whether other instances may write to the same store
+	Shared() bool
+	// String describes the store location for logging
+	String() string
+}
+
+// FileStore persists the cache to a local file
+type FileStore struct {
+	Path string
+}
+
+func (s *FileStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *FileStore) Save(data []byte) error {
+	cacheDir := filepath.Dir(s.Path)
+
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory %s: %w", cacheDir, err)
+	}
+
+	// Write to a temp file in the same directory and rename it over the cache
+	// file so a crash mid-write never leaves a truncated cache behind
+	tmp, err := os.CreateTemp(cacheDir, filepath.Base(s.Path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp cache file in %s: %w", cacheDir, err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp cache file %s: %w", tmpName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp cache file %s: %w", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp cache file %s: %w", tmpName, err)
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", tmpName, err)
+	}
+
+	if err := os.Rename(tmpName, s.Path); err != nil {
+		return fmt.Errorf("failed to write cache file %s: %w", s.Path, err)
+	}
+	return nil
+}
+
+// Discard moves a corrupt cache file aside so it can be inspected but is no longer loaded
+func (s *FileStore) Discard() error {
+	return os.Rename(s.Path, s.Path+".corrupt")
+}
+
+func (s *FileStore) Shared() bool { return false }
+
+func (s *FileStore) String() string { return "file:" + s.Path }
+
+// StorageStore persists the cache through a certmagic storage backend,
+// such as the one configured for Caddy
+type StorageStore struct {
+	Storage certmagic.Storage
+	Key     string
+}
+
+func (s *StorageStore) Load() ([]byte, error) {
+	data, err := s.Storage.Load(context.Background(), s.Key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *StorageStore) Save(data []byte) error {
+	if err := s.Storage.Store(context.Background(), s.Key, data); err != nil {
+		return fmt.Errorf("failed to store cache key %s: %w", s.Key, err)
+	}
+	return nil
+}
+
+func (s *StorageStore) Shared() bool { return true }
+
+func (s *StorageStore) String() string { return "storage:" + s.Key }
@@ -0,0 +1,93 @@
+package caddyauth
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig configures the Redis cache backend
+type RedisConfig struct {
+	// Address is the Redis server address (default: "localhost:6379")
+	Address string `json:"address,omitempty"`
+
+	// Username is the optional Redis ACL username
+	Username string `json:"username,omitempty"`
+
+	// Password is the optional Redis password
+	Password string `json:"password,omitempty"`
+
+	// DB is the Redis database number (default: 0)
+	DB int `json:"db,omitempty"`
+
+	// Key is the Redis key holding the device cache (default: "tailscale_auth:<tailnet>:devices")
+	Key string `json:"key,omitempty"`
+}
+
+// newStore connects to Redis using the configuration, defaulting the key to the tailnet's
+func (c *RedisConfig) newStore(tailnet string) *cache.RedisStore {
+	if c == nil {
+		c = &RedisConfig{}
+	}
+	addr := c.Address
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	key := c.Key
+	if key == "" {
+		key = "tailscale_auth:" + tailnet + ":devices"
+	}
+	return cache.NewRedisStore(&redis.Options{
+		Addr:     addr,
+		Username: c.Username,
+		Password: c.Password,
+		DB:       c.DB,
+	}, key)
+}
+
+// unmarshalCaddyfile parses a redis { ... } block
+func (c *RedisConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Address = d.Val()
+
+		case "username":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Username = d.Val()
+
+		case "password":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Password = d.Val()
+
+		case "db":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			db, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid redis db %q: %v", d.Val(), err)
+			}
+			c.DB = db
+
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Key = d.Val()
+
+		default:
+			return d.Errf("unrecognized redis subdirective: %s", d.Val())
+		}
+	}
+	return nil
+}
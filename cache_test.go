@@ -0,0 +1,316 @@
+package caddyauth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+func newFileCache(t *testing.T, data string, passphrase string) (*tailnetCache, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := cache.NewCipher(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tailnetCache{
+		logger:  zap.NewNop(),
+		devices: &DeviceCache{IPToDevice: map[string]*Device{}},
+		store:   &cache.FileStore{Path: path},
+		codec:   cache.Codec{Cipher: cipher},
+	}, path
+}
+
+func TestLoadDiscardsCorruptCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		passphrase string
+	}{
+		{name: "invalid json", data: `{"ip_to_device":`},
+		{name: "broken gzip", data: "\x1f\x8b\x08\x00garbage"},
+		{name: "truncated encryption", data: "TSAUTH-AESGCM2\nshort", passphrase: "secret"},
+		{name: "encrypted without key", data: "TSAUTH-AESGCM2\n0123456789abcdef0123456789abcdef"},
+		{name: "plaintext with key", data: `{"version":1,"ip_to_device":{"100.64.0.1":{"id":"planted"}}}`, passphrase: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, path := newFileCache(t, tt.data, tt.passphrase)
+			if err := c.load(); err != nil {
+				t.Fatalf("load = %v, want the cache discarded", err)
+			}
+			if len(c.devices.IPToDevice) != 0 {
+				t.Errorf("loaded %d devices from a corrupt cache", len(c.devices.IPToDevice))
+			}
+			if _, err := os.Stat(path + ".corrupt"); err != nil {
+				t.Errorf("cache was not moved aside: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadMigratesPlaintextCache(t *testing.T) {
+	c, path := newFileCache(t, `{"version":1,"ip_to_device":{"100.64.0.1":{"id":"dev1"}}}`, "secret")
+	c.migrate.Store(true)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if device, ok := c.lookup("100.64.0.1"); !ok || device.ID != "dev1" {
+		t.Fatalf("lookup = %v, %v, want the migrated device", device, ok)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.Encrypted(data) {
+		t.Error("migrated cache was not encrypted")
+	}
+	if c.migrate.Load() {
+		t.Error("migration is not one-shot")
+	}
+}
+
+func TestMatchTaggedDeviceHasNoUser(t *testing.T) {
+	c := &tailnetCache{
+		tailnet: "example.com",
+		logger:  zap.NewNop(),
+		devices: &DeviceCache{
+			IPToDevice: map[string]*Device{
+				"100.64.0.1": {ID: "laptop", User: "alice@example.com"},
+				"100.64.0.2": {ID: "ci", User: "alice@example.com", Tags: []string{"tag:ci"}},
+			},
+			Users: map[string]*User{"alice@example.com": {LoginName: "alice@example.com", Role: "admin"}},
+		},
+	}
+
+	if m, ok := c.match("100.64.0.1"); !ok || m.user == nil || m.user.Role != "admin" {
+		t.Errorf("match(laptop) = %+v, want alice's user", m)
+	}
+	m, ok := c.match("100.64.0.2")
+	if !ok {
+		t.Fatal("tagged device not matched")
+	}
+	if m.user != nil {
+		t.Errorf("tagged device has user %+v, want none", m.user)
+	}
+
+	id := policy.Identity{Device: m.device, User: m.user}
+	if reason, err := (&policy.Policy{RequireRole: []string{"admin"}}).Check(id); reason != policy.ReasonRole {
+		t.Errorf("require_role admin = %q, %v, want a role denial for the tagged device", reason, err)
+	}
+}
+
+func TestTaggedDeviceHasNoGroups(t *testing.T) {
+	c := &tailnetCache{
+		tailnet: "example.com",
+		logger:  zap.NewNop(),
+		devices: &DeviceCache{
+			IPToDevice: map[string]*Device{
+				"100.64.0.1": {ID: "laptop", User: "alice@example.com"},
+				"100.64.0.2": {ID: "ci", User: "alice@example.com", Tags: []string{"tag:ci"}},
+			},
+			Groups: map[string][]string{"group:admins": {"alice@example.com"}},
+		},
+	}
+	ts := &TailscaleAuth{groups: map[string][]string{"group:oncall": {"alice@example.com"}}}
+
+	m, ok := c.match("100.64.0.1")
+	if !ok {
+		t.Fatal("user device not matched")
+	}
+	if got := ts.userGroups(m); !slices.Equal(got, []string{"group:admins", "group:oncall"}) {
+		t.Errorf("userGroups(laptop) = %v, want both groups", got)
+	}
+
+	m, ok = c.match("100.64.0.2")
+	if !ok {
+		t.Fatal("tagged device not matched")
+	}
+	groups := ts.userGroups(m)
+	if len(m.groups) != 0 || len(groups) != 0 {
+		t.Errorf("tagged device is in groups %v and %v, want none", m.groups, groups)
+	}
+
+	id := policy.Identity{Device: m.device, Groups: groups}
+	if reason, err := (&policy.Policy{RequireGroup: []string{"group:admins"}}).Check(id); reason != policy.ReasonGroup {
+		t.Errorf("require_group group:admins = %q, %v, want a group denial for the tagged device", reason, err)
+	}
+}
+
+func TestNewerCacheIsNotOverwritten(t *testing.T) {
+	data := `{"version":99,"ip_to_device":{"100.64.0.1":{"id":"future"}}}`
+	c, path := newFileCache(t, data, "")
+	if err := c.load(); !errors.Is(err, cache.ErrUnsupportedVersion) {
+		t.Fatalf("load = %v, want ErrUnsupportedVersion", err)
+	}
+
+	c.replace([]Device{{ID: "dev1", Addresses: []string{"100.64.0.2"}}}, nil, nil, "")
+	if _, ok := c.lookup("100.64.0.2"); !ok {
+		t.Error("refreshed device is not served from memory")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Errorf("cache written by a newer release was overwritten with %s", got)
+	}
+}
+
+// blockingStore holds every Save until release is closed
+type blockingStore struct {
+	saving  chan struct{}
+	release chan struct{}
+	saved   [][]byte
+}
+
+func (s *blockingStore) Load() ([]byte, error) { return nil, nil }
+func (s *blockingStore) Shared() bool          { return false }
+func (s *blockingStore) String() string        { return "blocking" }
+
+func (s *blockingStore) Save(data []byte) error {
+	s.saving <- struct{}{}
+	<-s.release
+	s.saved = append(s.saved, data)
+	return nil
+}
+
+func TestSaveDoesNotBlockLookups(t *testing.T) {
+	store := &blockingStore{saving: make(chan struct{}), release: make(chan struct{})}
+	c := &tailnetCache{
+		logger:  zap.NewNop(),
+		devices: &DeviceCache{IPToDevice: map[string]*Device{}},
+		store:   store,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.upsert(&Device{ID: "dev1", Addresses: []string{"100.64.0.1"}})
+	}()
+	<-store.saving
+
+	looked := make(chan bool)
+	go func() {
+		_, ok := c.lookup("100.64.0.1")
+		looked <- ok
+	}()
+	select {
+	case ok := <-looked:
+		if !ok {
+			t.Error("upserted device is not served while it is being saved")
+		}
+	case <-time.After(time.Second):
+		t.Error("lookup blocked on the store write")
+	}
+
+	close(store.release)
+	<-done
+	if len(store.saved) != 1 {
+		t.Errorf("saved %d times, want once", len(store.saved))
+	}
+}
+
+// sharedStore is a store other instances write to, counting its loads
+type sharedStore struct {
+	data  []byte
+	loads int
+}
+
+func (s *sharedStore) Load() ([]byte, error)  { s.loads++; return s.data, nil }
+func (s *sharedStore) Save(data []byte) error { s.data = data; return nil }
+func (s *sharedStore) Shared() bool           { return true }
+func (s *sharedStore) String() string         { return "shared" }
+
+func TestMissReloadsNewerSharedCacheOnly(t *testing.T) {
+	store := &sharedStore{data: []byte(`{"version":1,"last_update":"Mon, 12 Oct 2026 10:00:00 GMT","ip_to_device":{}}`)}
+	c := &tailnetCache{
+		logger: zap.NewNop(),
+		devices: &DeviceCache{
+			IPToDevice: map[string]*Device{"100.64.0.1": {ID: "dev1"}},
+			LastUpdate: "Mon, 12 Oct 2026 10:00:00 GMT",
+		},
+		store:        store,
+		missCooldown: time.Minute,
+	}
+	c.lastAttempt.Store(time.Now().UnixNano())
+
+	// An unflushed webhook update must survive a reload of the same list
+	c.upsert(&Device{ID: "dev2", Addresses: []string{"100.64.0.2"}})
+	store.data = []byte(`{"version":1,"last_update":"Mon, 12 Oct 2026 10:00:00 GMT","ip_to_device":{"100.64.0.1":{"id":"dev1"}}}`)
+
+	for range 3 {
+		if _, err := c.get(t.Context(), "100.64.0.3", 0); !errors.Is(err, errDeviceNotFound) {
+			t.Fatalf("get = %v, want device not found", err)
+		}
+	}
+	if store.loads != 1 {
+		t.Errorf("misses loaded the shared store %d times, want once per miss_refresh_cooldown", store.loads)
+	}
+	if _, ok := c.lookup("100.64.0.2"); !ok {
+		t.Error("reloading a list no newer than the cache rolled back the upserted device")
+	}
+
+	store.data = []byte(`{"version":1,"last_update":"Mon, 12 Oct 2026 11:00:00 GMT","ip_to_device":{"100.64.0.3":{"id":"dev3"}}}`)
+	c.lastReload.Store(0)
+	if m, err := c.get(t.Context(), "100.64.0.3", 0); err != nil || m.device.ID != "dev3" {
+		t.Errorf("get = %v, %v, want the device from the newer shared cache", m, err)
+	}
+}
+
+func TestFlushKeepsChangesMadeDuringWrite(t *testing.T) {
+	store := &blockingStore{saving: make(chan struct{}, 1), release: make(chan struct{})}
+	c := &tailnetCache{
+		logger:    zap.NewNop(),
+		devices:   &DeviceCache{IPToDevice: map[string]*Device{}},
+		store:     store,
+		flushStop: make(chan struct{}),
+	}
+	c.upsert(&Device{ID: "dev1", Addresses: []string{"100.64.0.1"}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.flush()
+	}()
+	<-store.saving
+
+	upserted := make(chan struct{})
+	go func() {
+		defer close(upserted)
+		c.upsert(&Device{ID: "dev2", Addresses: []string{"100.64.0.2"}})
+	}()
+	select {
+	case <-upserted:
+	case <-time.After(time.Second):
+		t.Error("upsert blocked on the store write")
+	}
+
+	close(store.release)
+	<-done
+	<-upserted
+
+	c.mu.RLock()
+	dirty := c.dirty
+	c.mu.RUnlock()
+	if !dirty {
+		t.Fatal("flush marked a change made during its write as saved")
+	}
+
+	c.flush()
+	if len(store.saved) != 2 {
+		t.Errorf("saved %d times, want the second change flushed too", len(store.saved))
+	}
+}
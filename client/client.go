@@ -0,0 +1,211 @@
+// Package client accesses the Tailscale REST API and maps the LocalAPI's
+// whois results to the same device and user types, for resolving the
+// identity behind a tailnet address outside of Caddy.
+package client
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by an APIClient for devices that do not exist
+var ErrNotFound = errors.New("not found")
+
+// DefaultTimeout bounds every request to the Tailscale API, including
+// reading the response
+const DefaultTimeout = 30 * time.Second
+
+// ErrUnauthorized is returned by an APIClient whose API key was rejected,
+// e.g. because it expired or was revoked
+var ErrUnauthorized = errors.New("unauthorized")
+
+// APIClient is the access to the Tailscale API the device caches use.
+// Implementations other than REST can stub the API in tests
+type APIClient interface {
+	// Devices lists the tailnet's devices together with the response's Date
+	// header. allFields includes the devices' routes
+	Devices(ctx context.Context, tailnet string, allFields bool) ([]Device, string, error)
+
+	// Device fetches one device, or returns ErrNotFound
+	Device(ctx context.Context, id string, allFields bool) (*Device, error)
+
+	// PostureAttributes fetches a device's posture attributes
+	PostureAttributes(ctx context.Context, id string) (map[string]any, error)
+
+	// Users lists the tailnet's users
+	Users(ctx context.Context, tailnet string) ([]User, error)
+
+	// PolicyFile fetches the tailnet policy file
+	PolicyFile(ctx context.Context, tailnet string) (*PolicyFile, error)
+}
+
+// DefaultUserAgent identifies API requests unless a client sets its own
+const DefaultUserAgent = "Caddy-Tailscale-Auth/1.0"
+
+// Exchange is one request to the API and its outcome
+type Exchange struct {
+	Method   string
+	URL      string
+	Duration time.Duration
+
+	// Status, Header and Body are those of the response, if there was one.
+	// Body is as received, secrets included
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// Err is the error of a request that failed without a response or
+	// whose body could not be read
+	Err error
+}
+
+// REST is the APIClient for the Tailscale REST API
+type REST struct {
+	// UserAgent is sent with every request (default: DefaultUserAgent)
+	UserAgent string
+
+	// Observe, if set, is called with every request once it completed, e.g.
+	// to log API traffic while debugging
+	Observe func(*Exchange)
+
+	baseURL string
+	apiKey  func() string
+	client  *http.Client
+}
+
+// NewREST returns a client for the API at baseURL, e.g.
+// "https://api.tailscale.com", authenticating with apiKey
+func NewREST(baseURL, apiKey string) *REST {
+	return NewRESTKeyFunc(baseURL, func() string { return apiKey })
+}
+
+// NewRESTKeyFunc is like NewREST but calls apiKey for every request, so
+// the key can be rotated while the client is in use
+func NewRESTKeyFunc(baseURL string, apiKey func() string) *REST {
+	return &REST{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// get fetches path from the Tailscale API into v and returns the response's Date header
+func (c *REST) get(ctx context.Context, path string, v any) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/api/v2/"+path, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey())
+	req.Header.Set("User-Agent", cmp.Or(c.UserAgent, DefaultUserAgent))
+	// The policy file is served as HuJSON unless JSON is requested explicitly
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.observe(&Exchange{Method: req.Method, URL: req.URL.String(), Duration: time.Since(start), Err: err})
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	c.observe(&Exchange{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Duration: time.Since(start),
+		Status:   resp.StatusCode,
+		Header:   resp.Header,
+		Body:     body,
+		Err:      err,
+	})
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("API request failed with status %d: %w", resp.StatusCode, ErrUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status %d", resp.StatusCode)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return resp.Header.Get("Date"), nil
+}
+
+// observe passes exchange to Observe, if set
+func (c *REST) observe(exchange *Exchange) {
+	if c.Observe != nil {
+		c.Observe(exchange)
+	}
+}
+
+// deviceFields returns the query selecting the device fields
+func deviceFields(allFields bool) string {
+	if allFields {
+		// Routes are only included in the full device fields
+		return "?fields=all"
+	}
+	return ""
+}
+
+// Devices implements APIClient.
+func (c *REST) Devices(ctx context.Context, tailnet string, allFields bool) ([]Device, string, error) {
+	var resp DevicesResponse
+	date, err := c.get(ctx, "tailnet/"+url.PathEscape(tailnet)+"/devices"+deviceFields(allFields), &resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Devices, date, nil
+}
+
+// Device implements APIClient.
+func (c *REST) Device(ctx context.Context, id string, allFields bool) (*Device, error) {
+	var device Device
+	if _, err := c.get(ctx, "device/"+url.PathEscape(id)+deviceFields(allFields), &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// PostureAttributes implements APIClient.
+func (c *REST) PostureAttributes(ctx context.Context, id string) (map[string]any, error) {
+	var resp AttributesResponse
+	if _, err := c.get(ctx, "device/"+url.PathEscape(id)+"/attributes", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Attributes, nil
+}
+
+// Users implements APIClient.
+func (c *REST) Users(ctx context.Context, tailnet string) ([]User, error) {
+	var resp UsersResponse
+	if _, err := c.get(ctx, "tailnet/"+url.PathEscape(tailnet)+"/users", &resp); err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// PolicyFile implements APIClient.
+func (c *REST) PolicyFile(ctx context.Context, tailnet string) (*PolicyFile, error) {
+	var policy PolicyFile
+	if _, err := c.get(ctx, "tailnet/"+url.PathEscape(tailnet)+"/acl", &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Failover is an APIClient that switches between two clients with different
+// API keys when the one in use is rejected, for rotating keys without downtime
+type Failover struct {
+	// OnSwitch is called after a rejected key was replaced by the other one.
+	// toSecondary tells which client is now in use
+	OnSwitch func(toSecondary bool, cause error)
+
+	mu          sync.Mutex
+	clients     [2]APIClient
+	onSecondary bool
+}
+
+// NewFailover returns a client that uses primary until its key is rejected
+func NewFailover(primary, secondary APIClient) *Failover {
+	return &Failover{clients: [2]APIClient{primary, secondary}}
+}
+
+// active returns the client in use and the other one
+func (f *Failover) active() (APIClient, APIClient, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.onSecondary {
+		return f.clients[1], f.clients[0], true
+	}
+	return f.clients[0], f.clients[1], false
+}
+
+// switchFrom makes the other client the one in use, unless a concurrent
+// call already switched away from the client of onSecondary
+func (f *Failover) switchFrom(onSecondary bool, cause error) {
+	f.mu.Lock()
+	switched := f.onSecondary == onSecondary
+	if switched {
+		f.onSecondary = !onSecondary
+	}
+	f.mu.Unlock()
+
+	if switched && f.OnSwitch != nil {
+		f.OnSwitch(!onSecondary, cause)
+	}
+}
+
+// failover runs call with the client in use and, if its key is rejected,
+// with the other one, which stays in use if it succeeds
+func failover[T any](f *Failover, call func(APIClient) (T, error)) (T, error) {
+	current, other, onSecondary := f.active()
+
+	result, err := call(current)
+	if !errors.Is(err, ErrUnauthorized) {
+		return result, err
+	}
+
+	fallback, fallbackErr := call(other)
+	if errors.Is(fallbackErr, ErrUnauthorized) {
+		// Both keys are rejected; report the original error
+		return result, err
+	}
+	// A missing device still means the other key was accepted
+	if fallbackErr == nil || errors.Is(fallbackErr, ErrNotFound) {
+		f.switchFrom(onSecondary, err)
+	}
+	return fallback, fallbackErr
+}
+
+// devicesResult bundles the results of Devices for failover
+type devicesResult struct {
+	devices []Device
+	date    string
+}
+
+// Devices implements APIClient.
+func (f *Failover) Devices(ctx context.Context, tailnet string, allFields bool) ([]Device, string, error) {
+	result, err := failover(f, func(c APIClient) (devicesResult, error) {
+		devices, date, err := c.Devices(ctx, tailnet, allFields)
+		return devicesResult{devices, date}, err
+	})
+	return result.devices, result.date, err
+}
+
+// Device implements APIClient.
+func (f *Failover) Device(ctx context.Context, id string, allFields bool) (*Device, error) {
+	return failover(f, func(c APIClient) (*Device, error) {
+		return c.Device(ctx, id, allFields)
+	})
+}
+
+// PostureAttributes implements APIClient.
+func (f *Failover) PostureAttributes(ctx context.Context, id string) (map[string]any, error) {
+	return failover(f, func(c APIClient) (map[string]any, error) {
+		return c.PostureAttributes(ctx, id)
+	})
+}
+
+// Users implements APIClient.
+func (f *Failover) Users(ctx context.Context, tailnet string) ([]User, error) {
+	return failover(f, func(c APIClient) ([]User, error) {
+		return c.Users(ctx, tailnet)
+	})
+}
+
+// PolicyFile implements APIClient.
+func (f *Failover) PolicyFile(ctx context.Context, tailnet string) (*PolicyFile, error) {
+	return failover(f, func(c APIClient) (*PolicyFile, error) {
+		return c.PolicyFile(ctx, tailnet)
+	})
+}
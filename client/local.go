@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/client/local"
+)
+
+// Peer is the identity behind a tailnet address as the LocalAPI reports it
+type Peer struct {
+	// Device is the peer's device, with the fields the LocalAPI knows about
+	Device *Device
+
+	// User is the device's user, or nil for tagged devices
+	User *User
+
+	// Groups are the user's groups reported by the coordination server
+	Groups []string
+
+	// Tailnet is the domain of the device's MagicDNS name
+	Tailnet string
+}
+
+// WhoIs resolves addr through the LocalAPI of lc, such as a tsnet node's
+// or the local tailscaled's (&local.Client{}). It needs no API key
+func WhoIs(ctx context.Context, lc *local.Client, addr string) (*Peer, error) {
+	who, err := lc.WhoIs(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("whois %s: %w", addr, err)
+	}
+	if who.Node == nil {
+		return nil, fmt.Errorf("whois %s: no node", addr)
+	}
+
+	node := who.Node
+	name := strings.TrimSuffix(node.Name, ".")
+	device := &Device{
+		ID:                 strconv.FormatInt(int64(node.ID), 10),
+		NodeID:             string(node.StableID),
+		Name:               name,
+		Authorized:         node.MachineAuthorized,
+		IsExternal:         node.Sharer != 0,
+		Tags:               node.Tags,
+		ConnectedToControl: node.Online != nil && *node.Online,
+	}
+	for capability := range who.CapMap {
+		device.Capabilities = append(device.Capabilities, string(capability))
+	}
+	slices.Sort(device.Capabilities)
+	for _, prefix := range node.Addresses {
+		device.Addresses = append(device.Addresses, prefix.Addr().String())
+	}
+	if hostinfo := node.Hostinfo; hostinfo.Valid() {
+		device.Hostname = hostinfo.Hostname()
+		device.OS = hostinfo.OS()
+		device.ClientVersion = hostinfo.IPNVersion()
+		device.BlocksIncomingConnections = hostinfo.ShieldsUp()
+	}
+	if !node.Created.IsZero() {
+		device.Created = node.Created.Format(time.RFC3339)
+	}
+	if node.LastSeen != nil {
+		device.LastSeen = node.LastSeen.Format(time.RFC3339)
+	}
+	if node.KeyExpiry.IsZero() {
+		device.KeyExpiryDisabled = true
+	} else {
+		device.Expires = node.KeyExpiry.Format(time.RFC3339)
+	}
+
+	peer := &Peer{Device: device}
+	if _, tailnet, ok := strings.Cut(name, "."); ok {
+		peer.Tailnet = tailnet
+	}
+	if profile := who.UserProfile; profile != nil {
+		device.User = profile.LoginName
+		if len(node.Tags) == 0 {
+			peer.User = &User{
+				ID:          strconv.FormatInt(int64(profile.ID), 10),
+				LoginName:   profile.LoginName,
+				DisplayName: profile.DisplayName,
+			}
+			peer.Groups = profile.Groups
+		}
+	}
+
+	return peer, nil
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by a RateLimited client for calls that would
+// have to wait longer than its MaxWait
+var ErrRateLimited = errors.New("API rate limit reached")
+
+// RateLimited is an APIClient that spaces out the calls of another one with
+// a token bucket, queuing calls until the bucket allows them
+type RateLimited struct {
+	// Client makes the calls
+	Client APIClient
+
+	// Limiter is the token bucket calls take a token from
+	Limiter *rate.Limiter
+
+	// MaxWait is the longest a call queues for a token before it fails with
+	// ErrRateLimited. Zero queues without a limit
+	MaxWait time.Duration
+}
+
+// wait blocks until the bucket allows a call
+func (c *RateLimited) wait(ctx context.Context) error {
+	r := c.Limiter.Reserve()
+	delay := r.Delay()
+	if c.MaxWait > 0 && delay > c.MaxWait {
+		r.Cancel()
+		return fmt.Errorf("%w: next call allowed in %s", ErrRateLimited, delay.Round(time.Second))
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// Devices implements APIClient.
+func (c *RateLimited) Devices(ctx context.Context, tailnet string, allFields bool) ([]Device, string, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, "", err
+	}
+	return c.Client.Devices(ctx, tailnet, allFields)
+}
+
+// Device implements APIClient.
+func (c *RateLimited) Device(ctx context.Context, id string, allFields bool) (*Device, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.Device(ctx, id, allFields)
+}
+
+// PostureAttributes implements APIClient.
+func (c *RateLimited) PostureAttributes(ctx context.Context, id string) (map[string]any, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.PostureAttributes(ctx, id)
+}
+
+// Users implements APIClient.
+func (c *RateLimited) Users(ctx context.Context, tailnet string) ([]User, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.Users(ctx, tailnet)
+}
+
+// PolicyFile implements APIClient.
+func (c *RateLimited) PolicyFile(ctx context.Context, tailnet string) (*PolicyFile, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.PolicyFile(ctx, tailnet)
+}
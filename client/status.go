@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// StatusPeers runs `<binary> status --json` and returns the peers it lists,
+// including the local node, keyed by each of their Tailscale IPs. It works
+// wherever the tailscale CLI does, even if the LocalAPI socket is not accessible
+func StatusPeers(ctx context.Context, binary string) (map[string]*Peer, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, "status", "--json")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s status: %w: %s", binary, err, msg)
+		}
+		return nil, fmt.Errorf("%s status: %w", binary, err)
+	}
+
+	var status ipnstate.Status
+	if err := json.Unmarshal(stdout.Bytes(), &status); err != nil {
+		return nil, fmt.Errorf("failed to parse %s status output: %w", binary, err)
+	}
+
+	peers := make(map[string]*Peer)
+	add := func(ps *ipnstate.PeerStatus) {
+		if ps == nil {
+			return
+		}
+		peer := statusPeer(ps, status.User)
+		for _, addr := range ps.TailscaleIPs {
+			peers[addr.String()] = peer
+		}
+	}
+	add(status.Self)
+	for _, ps := range status.Peer {
+		add(ps)
+	}
+	return peers, nil
+}
+
+// statusPeer maps a peer of `tailscale status --json` to a Peer
+func statusPeer(ps *ipnstate.PeerStatus, users map[tailcfg.UserID]tailcfg.UserProfile) *Peer {
+	name := strings.TrimSuffix(ps.DNSName, ".")
+	device := &Device{
+		ID:                 strconv.FormatInt(int64(ps.NodeID), 10),
+		NodeID:             string(ps.ID),
+		Name:               name,
+		Hostname:           ps.HostName,
+		OS:                 ps.OS,
+		Authorized:         true, // only authorized nodes are distributed to peers
+		IsExternal:         ps.ShareeNode,
+		ConnectedToControl: ps.Online,
+	}
+	if ps.Tags != nil {
+		device.Tags = ps.Tags.AsSlice()
+	}
+	for _, addr := range ps.TailscaleIPs {
+		device.Addresses = append(device.Addresses, addr.String())
+	}
+	if !ps.Created.IsZero() {
+		device.Created = ps.Created.Format(time.RFC3339)
+	}
+	if !ps.LastSeen.IsZero() {
+		device.LastSeen = ps.LastSeen.Format(time.RFC3339)
+	}
+	if ps.KeyExpiry == nil {
+		device.KeyExpiryDisabled = true
+	} else {
+		device.Expires = ps.KeyExpiry.Format(time.RFC3339)
+	}
+
+	peer := &Peer{Device: device}
+	if _, tailnet, ok := strings.Cut(name, "."); ok {
+		peer.Tailnet = tailnet
+	}
+	if profile, ok := users[ps.UserID]; ok {
+		device.User = profile.LoginName
+		if len(device.Tags) == 0 {
+			peer.User = &User{
+				ID:          strconv.FormatInt(int64(profile.ID), 10),
+				LoginName:   profile.LoginName,
+				DisplayName: profile.DisplayName,
+			}
+		}
+	}
+	return peer
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Device represents a Tailscale device from the API
+type Device struct {
+	Addresses                 []string `json:"addresses"`
+	Authorized                bool     `json:"authorized"`
+	BlocksIncomingConnections bool     `json:"blocksIncomingConnections"`
+	ClientVersion             string   `json:"clientVersion"`
+	ConnectedToControl        bool     `json:"connectedToControl"`
+	Created                   string   `json:"created"`
+	Expires                   string   `json:"expires"`
+	Hostname                  string   `json:"hostname"`
+	ID                        string   `json:"id"`
+	IsExternal                bool     `json:"isExternal"`
+	KeyExpiryDisabled         bool     `json:"keyExpiryDisabled"`
+	LastSeen                  string   `json:"lastSeen"`
+	MachineKey                string   `json:"machineKey"`
+	Name                      string   `json:"name"`
+	NodeID                    string   `json:"nodeId"`
+	NodeKey                   string   `json:"nodeKey"`
+	OS                        string   `json:"os"`
+	AdvertisedRoutes          []string `json:"advertisedRoutes"`
+	EnabledRoutes             []string `json:"enabledRoutes"`
+	Tags                      []string `json:"tags"`
+	TailnetLockError          string   `json:"tailnetLockError"`
+	TailnetLockKey            string   `json:"tailnetLockKey"`
+	UpdateAvailable           bool     `json:"updateAvailable"`
+	User                      string   `json:"user"`
+
+	// PostureAttributes are the device's posture attributes, fetched separately when enabled
+	PostureAttributes map[string]any `json:"postureAttributes,omitempty"`
+
+	// Capabilities are the peer capabilities granted to the device, only known
+	// through a tsnet node or Tailscale Serve
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// DevicesResponse represents the response from Tailscale's devices API
+type DevicesResponse struct {
+	Devices []Device `json:"devices"`
+}
+
+// AttributesResponse represents the response from Tailscale's device posture attributes API
+type AttributesResponse struct {
+	Attributes map[string]any `json:"attributes"`
+}
+
+// User represents a Tailscale user from the API
+type User struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	LoginName   string `json:"loginName"`
+	Type        string `json:"type"`
+	Role        string `json:"role"`
+	Status      string `json:"status"`
+}
+
+// PolicyFile holds the parts of the tailnet policy file the device caches use
+type PolicyFile struct {
+	Groups map[string][]string `json:"groups"`
+	Grants []Grant             `json:"grants,omitempty"`
+}
+
+// Grant is an entry of the policy file's grants section. App maps the
+// application capabilities it grants, such as "example.com/cap/app", to
+// their parameters, which are up to the application to interpret
+type Grant struct {
+	Src []string                     `json:"src"`
+	Dst []string                     `json:"dst"`
+	IP  []string                     `json:"ip,omitempty"`
+	App map[string][]json.RawMessage `json:"app,omitempty"`
+}
+
+// UsersResponse represents the response from Tailscale's users API
+type UsersResponse struct {
+	Users []User `json:"users"`
+}
+
+// WhoIsResponse represents the response from Tailscale's whois API
+type WhoIsResponse struct {
+	Node struct {
+		ID            string   `json:"id"`
+		Name          string   `json:"name"`
+		User          string   `json:"user"`
+		Tailnet       string   `json:"tailnet"`
+		Hostname      string   `json:"hostname"`
+		ClientVersion string   `json:"clientVersion"`
+		OS            string   `json:"os"`
+		Created       string   `json:"created"`
+		LastSeen      string   `json:"lastSeen"`
+		Online        bool     `json:"online"`
+		Expired       bool     `json:"expired"`
+		KeyExpiry     string   `json:"keyExpiry"`
+		MachineKey    string   `json:"machineKey"`
+		NodeKey       string   `json:"nodeKey"`
+		Addresses     []string `json:"addresses"`
+		Tags          []string `json:"tags"`
+	} `json:"Node"`
+	UserProfile struct {
+		ID            string `json:"id"`
+		LoginName     string `json:"loginName"`
+		DisplayName   string `json:"displayName"`
+		ProfilePicURL string `json:"profilePicURL"`
+	} `json:"UserProfile"`
+	CapMap map[string][]string `json:"CapMap"`
+}
+
+// SeenWithin reports whether the device is connected to the control plane or
+// was last seen within maxAge. Devices without a valid lastSeen are stale
+func (d *Device) SeenWithin(maxAge time.Duration, now time.Time) bool {
+	if d.ConnectedToControl {
+		return true
+	}
+	lastSeen, err := time.Parse(time.RFC3339, d.LastSeen)
+	if err != nil {
+		return false
+	}
+	return now.Sub(lastSeen) <= maxAge
+}
+
+// KeyExpiresIn returns how long until the device's node key expires, or
+// false if key expiry is disabled or the expiry is unknown
+func (d *Device) KeyExpiresIn(now time.Time) (time.Duration, bool) {
+	if d.KeyExpiryDisabled || d.Expires == "" {
+		return 0, false
+	}
+	expires, err := time.Parse(time.RFC3339, d.Expires)
+	if err != nil || expires.IsZero() {
+		return 0, false
+	}
+	return expires.Sub(now), true
+}
+
+// IdentityType returns "machine" for tagged nodes, which act as service
+// identities without a meaningful user, and "user" for all other devices
+func (d *Device) IdentityType() string {
+	if len(d.Tags) > 0 {
+		return "machine"
+	}
+	return "user"
+}
@@ -0,0 +1,50 @@
+package caddyauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+// cliStatusTTL is how long the output of `tailscale status` is reused
+const cliStatusTTL = 10 * time.Second
+
+// cliResolver identifies clients from the output of `tailscale status --json`
+type cliResolver struct {
+	binary string
+
+	mu      sync.Mutex
+	fetched time.Time
+	peers   map[string]*client.Peer
+}
+
+// resolve returns the identity behind clientIP, running the CLI at most once per cliStatusTTL
+func (c *cliResolver) resolve(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peers == nil || time.Since(c.fetched) > cliStatusTTL {
+		peers, err := client.StatusPeers(ctx, c.binary)
+		if err != nil {
+			return nil, err
+		}
+		c.peers, c.fetched = peers, time.Now()
+	}
+
+	addr, ok := parseClientAddr(clientIP)
+	if !ok {
+		return nil, fmt.Errorf("invalid client IP %q", clientIP)
+	}
+	peer, ok := c.peers[addr.String()]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a peer in %s status", clientIP, c.binary)
+	}
+	return &deviceMatch{
+		device:  peer.Device,
+		tailnet: peer.Tailnet,
+		user:    peer.User,
+	}, nil
+}
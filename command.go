@@ -0,0 +1,175 @@
+package caddyauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "tailscale-auth",
+		Short: "Commands for the tailscale_auth handler",
+		CobraFunc: func(cmd *cobra.Command) {
+			testCmd := &cobra.Command{
+				Use:   "test-policy (--user <login> | --tags <tags>) [--path <path>] [--groups <groups>] [--address <admin>]",
+				Short: "Evaluates the running config's policies against a synthetic identity",
+				Long: `
+Asks the running Caddy instance, through its admin API, how every tailscale_auth
+handler and every named policy would decide a request from a synthetic identity,
+and reports which rule denies it. Nothing is logged, metered or recorded.
+
+Checks of a device's live state, such as key expiry, Shields Up or last seen,
+are not simulated. Groups are the policy file groups of the identity; groups
+defined with the handler's groups option are added from the handler.
+
+Exit code 0 means the evaluation ran, whatever its decisions.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdTestPolicy),
+			}
+			testCmd.Flags().String("user", "", "Login name of the identity, e.g. alice@example.com")
+			testCmd.Flags().StringSlice("tags", nil, "Tags of the identity, which makes it a tagged device")
+			testCmd.Flags().StringSlice("groups", nil, "Groups the user is in, e.g. group:eng")
+			testCmd.Flags().String("role", "", "Tailnet role of the user, e.g. admin")
+			testCmd.Flags().String("os", "", "Operating system of the device, e.g. linux")
+			testCmd.Flags().String("hostname", "", "Hostname of the device")
+			testCmd.Flags().String("tailnet", "", "Tailnet the device is in, for expected_tailnet")
+			testCmd.Flags().Bool("external", false, "The device is shared in from another tailnet")
+			testCmd.Flags().StringSlice("posture", nil, "Posture attributes of the device, as <attribute>=<value>")
+			testCmd.Flags().Bool("update-available", false, "A client update is available for the device")
+			testCmd.Flags().String("tailnet-lock-error", "", "Tailnet Lock error of the device")
+			testCmd.Flags().String("method", http.MethodGet, "Request method, for skip_methods")
+			testCmd.Flags().String("path", "/", "Request path, for skip_paths")
+			testCmd.Flags().Bool("json", false, "Print the admin API's JSON response")
+			testCmd.Flags().StringP("address", "", "", "The address to use to reach the admin API endpoint, if not the default")
+			testCmd.Flags().StringP("config", "c", "", "Configuration file to use to parse the admin address, if --address is not used")
+			testCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply (when --config is used)")
+			cmd.AddCommand(testCmd)
+		},
+	})
+}
+
+// cmdTestPolicy posts the synthetic identity to the admin API and prints the result
+func cmdTestPolicy(fl caddycmd.Flags) (int, error) {
+	pt := policyTest{
+		User:             fl.String("user"),
+		Role:             fl.String("role"),
+		OS:               fl.String("os"),
+		Hostname:         fl.String("hostname"),
+		Tailnet:          fl.String("tailnet"),
+		External:         fl.Bool("external"),
+		UpdateAvailable:  fl.Bool("update-available"),
+		TailnetLockError: fl.String("tailnet-lock-error"),
+		Method:           fl.String("method"),
+		Path:             fl.String("path"),
+	}
+	var err error
+	if pt.Tags, err = fl.GetStringSlice("tags"); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if pt.Groups, err = fl.GetStringSlice("groups"); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	posture, err := fl.GetStringSlice("posture")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	for _, attr := range posture {
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok || key == "" {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("posture attribute %q must be <attribute>=<value>", attr)
+		}
+		if pt.Posture == nil {
+			pt.Posture = make(map[string]string)
+		}
+		pt.Posture[key] = value
+	}
+	if _, err := pt.identity(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), nil, fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	body, err := json.Marshal(pt)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	headers := http.Header{"Content-Type": []string{"application/json"}}
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodPost, "/tailscale_auth/test-policy", headers, bytes.NewReader(body))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	if fl.Bool("json") {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	var result policyTestResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding response: %v", err)
+	}
+	printPolicyTest(os.Stdout, &result)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// printPolicyTest writes a readable report of a test-policy result
+func printPolicyTest(w io.Writer, result *policyTestResult) {
+	fmt.Fprintf(w, "identity type: %s\n", result.IdentityType)
+
+	if len(result.Handlers) == 0 {
+		fmt.Fprintln(w, "\nno tailscale_auth handlers are configured")
+	}
+	for _, h := range result.Handlers {
+		fmt.Fprintf(w, "\nhandler %d", h.Handler)
+		if h.Tailnet != "" {
+			fmt.Fprintf(w, " (tailnet %s)", h.Tailnet)
+		}
+		if len(h.Policies) > 0 {
+			fmt.Fprintf(w, " with policies %s", strings.Join(h.Policies, ", "))
+		}
+		fmt.Fprintf(w, ": %s\n", h.Decision)
+		if h.Reason != "" {
+			fmt.Fprintf(w, "  rule: %s\n", describeRule(h.Policy, h.Reason))
+		}
+		if h.Error != "" {
+			fmt.Fprintf(w, "  %s\n", h.Error)
+		}
+		for _, rule := range h.WouldDeny {
+			fmt.Fprintf(w, "  would deny: %s: %s\n", describeRule(rule.Policy, rule.Reason), rule.Error)
+		}
+	}
+
+	if len(result.Policies) > 0 {
+		fmt.Fprintln(w, "\nnamed policies:")
+	}
+	for _, rule := range result.Policies {
+		fmt.Fprintf(w, "  %s (enforce %s): %s", rule.Policy, rule.Enforce, rule.Decision)
+		if rule.Reason != "" {
+			fmt.Fprintf(w, " by %s: %s", rule.Reason, rule.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// describeRule names the rule that decided, in the handler's own rules or a named policy
+func describeRule(policyName, reason string) string {
+	if policyName == "" {
+		return reason
+	}
+	return fmt.Sprintf("%s in policy %s", reason, policyName)
+}
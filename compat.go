@@ -0,0 +1,61 @@
+package caddyauth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// remoteUserHeaders are the trusted-header SSO headers of the Authelia
+// convention, set by compat remote_user
+var remoteUserHeaders = []string{"Remote-User", "Remote-Email", "Remote-Name", "Remote-Groups"}
+
+// validateCompat checks the compat header sets
+func validateCompat(compat []string) error {
+	for _, name := range compat {
+		if name != "remote_user" {
+			return fmt.Errorf("compat must be 'remote_user', got %q", name)
+		}
+	}
+	return nil
+}
+
+// stripCompatHeaders removes compat headers sent by the client, so upstreams
+// trusting them only ever see values set by this handler
+func (t *TailscaleAuth) stripCompatHeaders(r *http.Request) {
+	if !slices.Contains(t.Compat, "remote_user") {
+		return
+	}
+	for _, name := range remoteUserHeaders {
+		r.Header.Del(name)
+	}
+}
+
+// addRemoteUserHeaders sets Remote-User, Remote-Email, Remote-Name and, when
+// the user is in groups, Remote-Groups. Only users get them, since tagged
+// devices have no user. pseudonymize leaves out the email and name, and
+// privacy the name and groups, like they do for the prefixed headers
+func (t *TailscaleAuth) addRemoteUserHeaders(r *http.Request, match *deviceMatch, loginName, displayName string) {
+	if !slices.Contains(t.Compat, "remote_user") || t.Output == "vars_only" ||
+		match.device.IdentityType() != "user" {
+		return
+	}
+
+	username := t.localUsername(loginName)
+	t.setSanitizedHeader(r, "Remote-User", username)
+	if t.pseudonymKey == nil {
+		t.setSanitizedHeader(r, "Remote-Email", loginName)
+	}
+	if t.Privacy {
+		return
+	}
+	if t.pseudonymKey == nil {
+		if displayName == "" {
+			displayName = username
+		}
+		t.setSanitizedHeader(r, "Remote-Name", displayName)
+	}
+	if groups := t.userGroups(match); len(groups) > 0 {
+		t.setSanitizedList(r, "Remote-Groups", groups)
+	}
+}
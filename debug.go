@@ -0,0 +1,302 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// lastError remembers the most recent error of an operation
+type lastError struct {
+	mu  sync.Mutex
+	err error
+	at  time.Time
+}
+
+// record remembers err as the most recent error
+func (e *lastError) record(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.err, e.at = err, time.Now()
+}
+
+// get returns when the most recent error happened and the error, or nil
+func (e *lastError) get() (time.Time, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.at, e.err
+}
+
+// adminAPI serves the module's internal state under Caddy's admin API
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.tailscale_auth",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{
+		Pattern: "/tailscale_auth/debug",
+		Handler: caddy.AdminHandlerFunc(a.handleDebug),
+	}, {
+		Pattern: "/tailscale_auth/test-policy",
+		Handler: caddy.AdminHandlerFunc(a.handleTestPolicy),
+	}, {
+		Pattern: "/tailscale_auth/ip-history",
+		Handler: caddy.AdminHandlerFunc(a.handleIPHistory),
+	}}
+}
+
+// cacheDebug is the state of one live device cache
+type cacheDebug struct {
+	Key             string       `json:"key"`
+	Tailnet         string       `json:"tailnet"`
+	Entries         int          `json:"entries"`
+	Routes          int          `json:"routes"`
+	LastUpdate      string       `json:"last_update,omitempty"`
+	LastRefresh     *time.Time   `json:"last_refresh,omitempty"`
+	LastAPIError    string       `json:"last_api_error,omitempty"`
+	LastAPIErrorAt  *time.Time   `json:"last_api_error_at,omitempty"`
+	ErrorStreak     int64        `json:"refresh_error_streak"`
+	OldestEntry     *entryDebug  `json:"oldest_entry,omitempty"`
+	LookupsInFlight int64        `json:"lookups_in_flight"`
+	HitRatio        *float64     `json:"hit_ratio,omitempty"`
+	Store           string       `json:"store,omitempty"`
+	Flusher         bool         `json:"flusher"`
+	UnsavedChanges  bool         `json:"unsaved_changes"`
+	Credentials     string       `json:"credentials"`
+	APIClient       string       `json:"api_client"`
+	Devices         []entryDebug `json:"devices,omitempty"`
+}
+
+// entryDebug is the age of one cached device. Its times are unknown for
+// devices loaded from caches persisted before they were recorded
+type entryDebug struct {
+	DeviceID     string     `json:"device_id"`
+	Name         string     `json:"name"`
+	Addresses    []string   `json:"addresses"`
+	FirstSeen    *time.Time `json:"first_seen,omitempty"`
+	LastVerified *time.Time `json:"last_verified,omitempty"`
+}
+
+// debugState is the module's internal state across all configs
+type debugState struct {
+	Caches []cacheDebug `json:"caches"`
+	Nodes  []string     `json:"nodes"`
+}
+
+// handleDebug serves the state of every live device cache and embedded node
+func (adminAPI) handleDebug(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	withDevices := false
+	if value := r.URL.Query().Get("devices"); value != "" {
+		var err error
+		if withDevices, err = strconv.ParseBool(value); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid devices parameter %q", value),
+			}
+		}
+	}
+
+	state := debugState{Caches: liveCacheStates(withDevices), Nodes: []string{}}
+	nodePool.Range(func(key, _ any) bool {
+		state.Nodes = append(state.Nodes, key.(string))
+		return true
+	})
+	sort.Strings(state.Nodes)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(state)
+}
+
+// liveCacheStates returns the state of every live device cache, sorted by
+// key, listing their devices if withDevices is set
+func liveCacheStates(withDevices bool) []cacheDebug {
+	states := []cacheDebug{}
+	cachePool.Range(func(key, value any) bool {
+		if cache, ok := value.(*tailnetCache); ok {
+			states = append(states, cache.debug(key.(string), withDevices))
+		}
+		return true
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// debug returns the cache's state for the admin API
+func (c *tailnetCache) debug(key string, withDevices bool) cacheDebug {
+	c.mu.RLock()
+	d := cacheDebug{
+		Key:            key,
+		Tailnet:        c.tailnet,
+		Entries:        len(c.devices.IPToDevice),
+		Routes:         len(c.routes),
+		LastUpdate:     c.devices.LastUpdate,
+		Flusher:        c.flushStop != nil,
+		UnsavedChanges: c.dirty,
+	}
+	devices := c.entryStates()
+	c.mu.RUnlock()
+
+	for i := range devices {
+		entry := &devices[i]
+		if entry.LastVerified != nil && (d.OldestEntry == nil || entry.LastVerified.Before(*d.OldestEntry.LastVerified)) {
+			d.OldestEntry = entry
+		}
+	}
+	if withDevices {
+		d.Devices = devices
+	}
+	d.ErrorStreak = c.errStreak.Load()
+
+	if c.store != nil {
+		d.Store = c.store.String()
+	}
+	if refreshed := c.lastRefresh.Load(); refreshed != 0 {
+		at := time.Unix(0, refreshed)
+		d.LastRefresh = &at
+	}
+	if at, err := c.apiErr.get(); err != nil {
+		d.LastAPIError = err.Error()
+		d.LastAPIErrorAt = &at
+	}
+	d.LookupsInFlight = c.lookups.Load()
+	if ratio, ok := c.hits.ratio(); ok {
+		d.HitRatio = &ratio
+	}
+
+	switch c.keys.(type) {
+	case nil:
+		d.Credentials = "api_key"
+	case *secretFile:
+		d.Credentials = "api_key_file"
+	case *vaultSecret:
+		d.Credentials = "vault"
+	case *oauthToken:
+		d.Credentials = "oauth"
+	}
+	d.APIClient = fmt.Sprintf("%T", c.client)
+
+	return d
+}
+
+// entryStates returns the age of every cached device, sorted by name.
+// Callers must hold the read lock
+func (c *tailnetCache) entryStates() []entryDebug {
+	var entries []entryDebug
+	seen := make(map[string]bool)
+	for _, device := range c.devices.IPToDevice {
+		if device == nil || seen[device.ID] {
+			continue
+		}
+		seen[device.ID] = true
+
+		entry := entryDebug{DeviceID: device.ID, Name: device.Name, Addresses: device.Addresses}
+		if times, ok := c.devices.Entries[device.ID]; ok && times != nil {
+			firstSeen, lastVerified := times.FirstSeen, times.LastVerified
+			entry.FirstSeen = &firstSeen
+			entry.LastVerified = &lastVerified
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// ipHistory is the recorded history of an IP address in one SQLite cache
+type ipHistory struct {
+	Key     string                 `json:"key"`
+	Tailnet string                 `json:"tailnet"`
+	Entries []cache.IPHistoryEntry `json:"entries"`
+}
+
+// handleIPHistory serves who an IP address belonged to, from every live
+// cache with SQLite persistence. With at, only the owners at that time are listed
+func (adminAPI) handleIPHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	addr, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("invalid ip parameter: %v", err),
+		}
+	}
+	var at time.Time
+	if value := r.URL.Query().Get("at"); value != "" {
+		if at, err = time.Parse(time.RFC3339, value); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid at parameter %q, must be RFC 3339", value),
+			}
+		}
+	}
+
+	history := []ipHistory{}
+	var lookupErr error
+	cachePool.Range(func(key, value any) bool {
+		c, ok := value.(*tailnetCache)
+		if !ok {
+			return true
+		}
+		store, ok := c.store.(*cache.SQLiteStore)
+		if !ok {
+			return true
+		}
+
+		h := ipHistory{Key: key.(string), Tailnet: c.tailnet}
+		if at.IsZero() {
+			h.Entries, lookupErr = store.IPHistory(addr.String())
+		} else {
+			h.Entries, lookupErr = store.OwnerAt(addr.String(), at)
+		}
+		if lookupErr != nil {
+			lookupErr = fmt.Errorf("cache %s: %v", h.Key, lookupErr)
+			return false
+		}
+		if h.Entries == nil {
+			h.Entries = []cache.IPHistoryEntry{}
+		}
+		history = append(history, h)
+		return true
+	})
+	if lookupErr != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        lookupErr,
+		}
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Key < history[j].Key })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(history)
+}
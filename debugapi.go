@@ -0,0 +1,66 @@
+package caddyauth
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"go.uber.org/zap"
+)
+
+// apiDebugBodyLimit caps the response bodies logged by debug_api
+const apiDebugBodyLimit = 2048
+
+// secretJSONField matches JSON string fields whose name suggests a secret
+// or key, such as "nodeKey" or "access_token"
+var secretJSONField = regexp.MustCompile(`"([A-Za-z_]*(?:[Kk]ey|[Tt]oken|[Ss]ecret|[Pp]assword))"(\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// logAPIExchange returns a client.REST Observe function that logs every API
+// request with its status, latency, rate limit headers and redacted body
+func logAPIExchange(logger *zap.Logger) func(*client.Exchange) {
+	return func(e *client.Exchange) {
+		fields := []zap.Field{
+			zap.String("method", e.Method),
+			zap.String("url", e.URL),
+			zap.Duration("duration", e.Duration),
+		}
+		if e.Status != 0 {
+			fields = append(fields, zap.Int("status", e.Status))
+		}
+		for name, values := range e.Header {
+			if isRateLimitHeader(name) {
+				fields = append(fields, zap.String("header."+strings.ToLower(name), strings.Join(values, ", ")))
+			}
+		}
+		if len(e.Body) > 0 {
+			fields = append(fields, zap.String("body", redactAPIBody(e.Body)))
+		}
+
+		if e.Err != nil {
+			logger.Warn("API request failed", append(fields, zap.Error(e.Err))...)
+		} else if e.Status != http.StatusOK {
+			logger.Warn("API request returned an error status", fields...)
+		} else {
+			logger.Info("API request", fields...)
+		}
+	}
+}
+
+// isRateLimitHeader reports whether the response header name describes
+// rate limiting, like Retry-After or X-RateLimit-Remaining
+func isRateLimitHeader(name string) bool {
+	name = strings.ToLower(name)
+	return name == "retry-after" || strings.HasPrefix(name, "ratelimit") || strings.HasPrefix(name, "x-ratelimit")
+}
+
+// redactAPIBody returns body with the values of secret fields replaced,
+// cut to apiDebugBodyLimit bytes
+func redactAPIBody(body []byte) string {
+	redacted := secretJSONField.ReplaceAllString(string(body), `"$1"$2"REDACTED"`)
+	if len(redacted) <= apiDebugBodyLimit {
+		return redacted
+	}
+	return truncateUTF8(redacted, apiDebugBodyLimit) + fmt.Sprintf("... (%d bytes)", len(body))
+}
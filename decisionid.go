@@ -0,0 +1,59 @@
+package caddyauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxDecisionIDLength bounds decision IDs propagated from a request header
+const maxDecisionIDLength = 128
+
+// decisionID returns the correlation ID of the request's identity decision,
+// choosing it on first use: the value of decision_id_header if the request
+// carries a valid one, or else Caddy's request UUID
+func (t *TailscaleAuth) decisionID(r *http.Request) string {
+	if id, ok := caddyhttp.GetVar(r.Context(), "tailscale_auth.decision_id").(string); ok && id != "" {
+		return id
+	}
+
+	id := ""
+	if t.DecisionIDHeader != "" {
+		if value := r.Header.Get(t.DecisionIDHeader); validDecisionID(value) {
+			id = value
+		}
+	}
+	if id == "" {
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			id, _ = repl.GetString("http.request.uuid")
+		}
+	}
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.decision_id", id)
+	return id
+}
+
+// validDecisionID reports whether a propagated ID is short and made of
+// characters that are safe in headers, logs and CEF or LEEF events
+func validDecisionID(id string) bool {
+	if id == "" || len(id) > maxDecisionIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
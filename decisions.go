@@ -0,0 +1,117 @@
+package caddyauth
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logWriterPool shares the writers of decision and user log files between
+// handlers and across config reloads, so a file is only rolled by one writer
+var logWriterPool = caddy.NewUsagePool()
+
+// logWriter is an open log file
+type logWriter struct {
+	io.WriteCloser
+}
+
+// Destruct implements caddy.Destructor.
+func (w *logWriter) Destruct() error {
+	return w.Close()
+}
+
+// openJSONLog opens fw through the writer pool and returns a logger writing
+// JSON records to it, along with the pool key to release when done
+func openJSONLog(fw *logging.FileWriter) (*zap.Logger, string, error) {
+	key := fw.WriterKey()
+	writer, _, err := logWriterPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		w, err := fw.OpenWriter()
+		if err != nil {
+			return nil, err
+		}
+		return &logWriter{w}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "ts"
+	encoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	encoderConfig.CallerKey = zapcore.OmitKey
+	encoderConfig.StacktraceKey = zapcore.OmitKey
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(writer.(*logWriter)), zap.InfoLevel)
+	return zap.New(core), key, nil
+}
+
+// provisionDecisionLog opens the decision log file and sets up its logger
+func (t *TailscaleAuth) provisionDecisionLog(ctx caddy.Context) error {
+	if err := t.DecisionLog.Provision(ctx); err != nil {
+		return err
+	}
+
+	logger, key, err := openJSONLog(t.DecisionLog)
+	if err != nil {
+		return err
+	}
+	t.decisionKey = key
+
+	t.decisionLogger = logger.Named("tailscale_auth.decisions")
+	if t.RedactLogs != "" {
+		t.decisionLogger = newRedactingLogger(t.decisionLogger, t.RedactLogs, caddy.NewReplacer().ReplaceAll(t.RedactSalt, ""))
+	}
+	return nil
+}
+
+// logDecision writes a decision record for the request to the decision log,
+// if one is configured, and forwards allowed requests to syslog with
+// include_allowed. reason and err are empty for allowed requests
+func (t *TailscaleAuth) logDecision(r *http.Request, decision, reason string, match *deviceMatch, err error) {
+	if decision == "allow" && t.syslog != nil && t.Syslog.IncludeAllowed {
+		t.syslog.send(newAllowEvent(r, t.clientIP(r), t.decisionID(r), match), syslogInfo, time.Now())
+	}
+
+	if t.decisionLogger == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("decision", decision),
+		zap.String("host", r.Host),
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.String("client_ip", t.clientIP(r)),
+		zap.String("decision_id", t.decisionID(r)),
+	}
+	if reason != "" {
+		fields = append(fields, zap.String("reason", reason))
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	if match != nil {
+		if match.tailnet != "" {
+			fields = append(fields, zap.String("tailnet", match.tailnet))
+		}
+		if match.user != nil {
+			fields = append(fields, zap.String("identity", match.user.LoginName))
+		}
+		if device := match.device; device != nil {
+			if match.user == nil {
+				fields = append(fields, zap.String("identity", device.User))
+			}
+			fields = append(fields,
+				zap.String("device", device.Name),
+				zap.String("device_id", device.ID))
+		}
+		if match.stale {
+			fields = append(fields, zap.String("cache", "stale"))
+		}
+	}
+	t.decisionLogger.Info("decision", fields...)
+}
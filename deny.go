@@ -0,0 +1,240 @@
+package caddyauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Reasons a request can be denied for, exposed to deny templates, error
+// routes and logs
+const (
+	reasonUnidentified = "unidentified"
+	reasonNonTailnet   = "non_tailnet"
+	reasonKeyExpiry    = "key_expiry"
+	reasonStale        = "stale"
+	reasonFunnel       = "funnel"
+	reasonShieldsUp    = "blocks_incoming"
+	reasonLockdown     = "lockdown"
+)
+
+// DenyError is the error of the caddyhttp.HandlerError returned for denied
+// requests, so handle_errors routes can tell policy denials apart
+type DenyError struct {
+	// Reason is a machine-readable reason code such as "unidentified"
+	Reason string
+
+	// Device is the client's device, or nil if it could not be identified
+	Device *Device
+
+	Err error
+}
+
+func (e *DenyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DenyError) Unwrap() error {
+	return e.Err
+}
+
+// problemDetails is an RFC 9457 problem+json body with the deny reason as an extension member
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Reason string `json:"reason"`
+}
+
+// denyPage is the HTML page served to browsers when deny_format is "negotiate"
+var denyPage = htmltemplate.Must(htmltemplate.New("deny").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Detail}}</p>
+</body>
+</html>
+`))
+
+// denyData is the data available to the deny_body template
+type denyData struct {
+	Status  int
+	Reason  string
+	Message string
+	Device  *Device
+}
+
+// provisionDeny sets up the deny response
+func (t *TailscaleAuth) provisionDeny() error {
+	if t.DenyStatus == 0 {
+		t.DenyStatus = http.StatusForbidden
+	}
+
+	if t.DenyContentType == "" {
+		t.DenyContentType = "text/plain; charset=utf-8"
+	}
+
+	if t.DenyBody != "" {
+		tmpl, err := template.New("deny_body").Parse(t.DenyBody)
+		if err != nil {
+			return fmt.Errorf("invalid deny_body template: %w", err)
+		}
+		t.denyTemplate = tmpl
+	}
+
+	return nil
+}
+
+// deny rejects the request. Browsers without a Tailscale identity are sent to
+// the login redirect if one is configured. Otherwise, without a deny_body it
+// returns a HandlerError carrying a *DenyError for Caddy's error routes, and
+// with one it writes the rendered body itself.
+func (t *TailscaleAuth) deny(w http.ResponseWriter, r *http.Request, reason string, device *Device, err error) error {
+	decisionID := t.decisionID(r)
+	t.logger.Info("request denied",
+		zap.String("reason", reason),
+		zap.String("decision_id", decisionID),
+		zap.Error(err))
+	if t.Output != "vars_only" {
+		w.Header().Set(t.HeaderPrefix+"Decision-ID", decisionID)
+	}
+
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.deny_reason", reason)
+
+	d := denial{
+		Time:     time.Now(),
+		Reason:   reason,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		ClientIP: t.clientIP(r),
+		Message:  err.Error(),
+	}
+	if device != nil {
+		d.Device = device.Name
+	}
+	recentDenials.record(d)
+
+	t.logDecision(r, "deny", reason, &deviceMatch{device: device}, err)
+
+	if t.DenyWebhook != "" || t.syslog != nil {
+		t.notifyDeny(r, reason, device, err)
+	}
+
+	if t.LoginRedirect != "" && device == nil && isBrowserRequest(r) {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		http.Redirect(w, r, repl.ReplaceAll(t.LoginRedirect, ""), http.StatusFound)
+		return nil
+	}
+
+	if t.denyTemplate == nil {
+		if t.DenyFormat == "negotiate" {
+			return t.writeNegotiatedDeny(w, r, reason, err)
+		}
+		return caddyhttp.Error(t.DenyStatus, &DenyError{Reason: reason, Device: device, Err: err})
+	}
+
+	var buf bytes.Buffer
+	if err := t.denyTemplate.Execute(&buf, denyData{
+		Status:  t.DenyStatus,
+		Reason:  reason,
+		Message: err.Error(),
+		Device:  device,
+	}); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed to render deny_body: %w", err))
+	}
+
+	w.Header().Set("Content-Type", t.DenyContentType)
+	w.WriteHeader(t.DenyStatus)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// writeNegotiatedDeny writes the deny response as problem+json for API
+// clients, as HTML for browsers and as plain text for everything else
+func (t *TailscaleAuth) writeNegotiatedDeny(w http.ResponseWriter, r *http.Request, reason string, cause error) error {
+	problem := problemDetails{
+		Type:   "about:blank",
+		Title:  http.StatusText(t.DenyStatus),
+		Status: t.DenyStatus,
+		Detail: cause.Error(),
+		Reason: reason,
+	}
+
+	var buf bytes.Buffer
+	switch negotiateDenyFormat(r.Header.Get("Accept")) {
+	case "json":
+		w.Header().Set("Content-Type", "application/problem+json")
+		if err := json.NewEncoder(&buf).Encode(problem); err != nil {
+			return err
+		}
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := denyPage.Execute(&buf, problem); err != nil {
+			return err
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(&buf, "%d %s: %s (%s)\n", problem.Status, problem.Title, problem.Detail, reason)
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(t.DenyStatus)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// negotiateDenyFormat picks "json", "html" or "text" from an Accept header by
+// quality value, preferring JSON on ties
+func negotiateDenyFormat(accept string) string {
+	best, bestQ := "text", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		var format string
+		switch mediaType := strings.ToLower(strings.TrimSpace(mediaRange)); {
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			format = "json"
+		case mediaType == "text/html", mediaType == "application/xhtml+xml":
+			format = "html"
+		default:
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && format == "json") {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// isBrowserRequest reports whether r is a browser navigation rather than an API call
+func isBrowserRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,159 @@
+package caddyauth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identification of the plugin in CEF and LEEF headers
+const (
+	eventVendor  = "juridia-net"
+	eventProduct = "caddy-tailscale-auth"
+	eventVersion = "1.0"
+)
+
+// eventField is a key/value pair of a CEF or LEEF event
+type eventField struct {
+	key, value string
+}
+
+// securityEvent is a notification that can be exported to SIEMs as a CEF or LEEF event
+type securityEvent interface {
+	// eventHeader returns the event's ID, its human-readable name and a CEF
+	// severity from 0 to 10
+	eventHeader() (id, name string, severity int)
+
+	// eventFields returns the event's attributes as CEF extension fields, with
+	// the label of a custom string right before it
+	eventFields() []eventField
+}
+
+// cefToLEEF maps the CEF keys used by events to their LEEF equivalents.
+// Keys missing here are used as they are, custom strings by their labels
+var cefToLEEF = map[string]string{
+	"rt":            "devTime",
+	"suser":         "usrName",
+	"shost":         "identHostName",
+	"requestMethod": "method",
+	"request":       "url",
+}
+
+// formatEvent renders event in format ("cef" or "leef") as a single line
+func formatEvent(format string, event securityEvent) (string, error) {
+	id, name, severity := event.eventHeader()
+	fields := event.eventFields()
+
+	var b strings.Builder
+	switch format {
+	case "cef":
+		fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+			cefHeaderEscaper.Replace(eventVendor),
+			cefHeaderEscaper.Replace(eventProduct),
+			cefHeaderEscaper.Replace(eventVersion),
+			cefHeaderEscaper.Replace(id),
+			cefHeaderEscaper.Replace(name),
+			severity)
+		for i, field := range fields {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(field.key + "=" + cefValueEscaper.Replace(field.value))
+		}
+
+	case "leef":
+		fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+			leefHeaderEscaper.Replace(eventVendor),
+			leefHeaderEscaper.Replace(eventProduct),
+			leefHeaderEscaper.Replace(eventVersion),
+			leefHeaderEscaper.Replace(id))
+		b.WriteString("cat=" + leefValueEscaper.Replace(name))
+		b.WriteString("\tsev=" + strconv.Itoa(severity))
+
+		// LEEF has no label fields, so custom CEF strings are named by their labels
+		labels := make(map[string]string)
+		for _, field := range fields {
+			key := field.key
+			if custom, ok := strings.CutSuffix(key, "Label"); ok {
+				labels[custom] = field.value
+				continue
+			}
+			if label, ok := labels[key]; ok {
+				key = label
+			} else if leefKey, ok := cefToLEEF[key]; ok {
+				key = leefKey
+			}
+			b.WriteString("\t" + key + "=" + leefValueEscaper.Replace(field.value))
+		}
+		b.WriteString("\tdevTimeFormat=MMM dd yyyy HH:mm:ss.SSS")
+
+	default:
+		return "", fmt.Errorf("unknown event format %q", format)
+	}
+	return b.String(), nil
+}
+
+// Escaping rules of the CEF and LEEF specifications
+var (
+	cefHeaderEscaper  = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`, "\n", " ", "\r", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+// eventTime formats t for the rt (CEF) and devTime (LEEF) fields
+func eventTime(t time.Time) string {
+	return t.UTC().Format("Jan 02 2006 15:04:05.000")
+}
+
+func (n newDeviceNotification) eventHeader() (string, string, int) {
+	if n.Event == "new_user" {
+		return "new_user", "New user accessed a protected route", 3
+	}
+	return "new_device", "New device accessed a protected route", 3
+}
+
+func (n newDeviceNotification) eventFields() []eventField {
+	return []eventField{
+		{"rt", eventTime(n.Time)},
+		{"act", "allow"},
+		{"externalId", n.DecisionID},
+		{"suser", n.User},
+		{"shost", n.Device},
+		{"request", n.Route},
+		{"cs1Label", "tailnet"},
+		{"cs1", n.Tailnet},
+		{"cs2Label", "deviceId"},
+		{"cs2", n.ID},
+		{"cs3Label", "os"},
+		{"cs3", n.OS},
+		{"msg", n.Text},
+	}
+}
+
+func (n denyNotification) eventHeader() (string, string, int) {
+	return "deny", "Request denied", 5
+}
+
+func (n denyNotification) eventFields() []eventField {
+	fields := []eventField{
+		{"rt", eventTime(n.Time)},
+		{"act", "deny"},
+		{"externalId", n.DecisionID},
+		{"src", n.ClientIP},
+		{"requestMethod", n.Method},
+		{"request", n.Route},
+		{"reason", n.Reason},
+	}
+	if n.User != "" {
+		fields = append(fields, eventField{"suser", n.User})
+	}
+	if n.Device != "" {
+		fields = append(fields,
+			eventField{"shost", n.Device},
+			eventField{"cs2Label", "deviceId"},
+			eventField{"cs2", n.ID})
+	}
+	return append(fields, eventField{"msg", n.Message})
+}
@@ -0,0 +1,360 @@
+package caddyauth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	caddyauth "github.com/juridia-net/caddy-tailscale-auth"
+	"github.com/juridia-net/caddy-tailscale-auth/tailscaletest"
+)
+
+const (
+	testTailnet = "example.com"
+	testAPIKey  = "tskey-api-test"
+	devicesPath = "/api/v2/tailnet/example.com/devices"
+)
+
+// newTestServer starts a mock API with one user's laptop at 100.64.0.1
+func newTestServer(t *testing.T) *tailscaletest.Server {
+	t.Helper()
+	srv := tailscaletest.NewServer(testTailnet, testAPIKey)
+	t.Cleanup(srv.Close)
+	srv.AddUser(caddyauth.User{ID: "u1", LoginName: "alice@example.com", DisplayName: "Alice", Role: "member"})
+	srv.AddDevice(caddyauth.Device{
+		ID:        "d1",
+		Name:      "laptop.example.ts.net",
+		Hostname:  "laptop",
+		User:      "alice@example.com",
+		Addresses: []string{"100.64.0.1"},
+	})
+	return srv
+}
+
+// provision points h at srv, with its cache file in a temporary directory
+// unless the test set one, and provisions it
+func provision(t *testing.T, srv *tailscaletest.Server, h *caddyauth.TailscaleAuth) *caddyauth.TailscaleAuth {
+	t.Helper()
+	h.APIKey = testAPIKey
+	h.Tailnet = testTailnet
+	h.APIURL = srv.URL
+	h.FetchUsers = true
+	if h.CacheFile == "" {
+		h.CacheFile = filepath.Join(t.TempDir(), "devices.json")
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	t.Cleanup(func() { h.Cleanup() })
+	if err := h.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	return h
+}
+
+// serve runs r through h and returns the response and the request that
+// reached the next handler, or nil if it was stopped
+func serve(t *testing.T, h *caddyauth.TailscaleAuth, r *http.Request) (*httptest.ResponseRecorder, *http.Request, error) {
+	t.Helper()
+	repl := caddy.NewReplacer()
+	ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.VarsCtxKey, map[string]any{})
+	r = r.WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	var upstream *http.Request
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		upstream = r
+		return nil
+	})
+	err := h.ServeHTTP(w, r, next)
+	return w, upstream, err
+}
+
+// newRequest returns a request from remoteAddr
+func newRequest(remoteAddr string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func TestHandlerStripsForgedIdentityHeaders(t *testing.T) {
+	h := provision(t, newTestServer(t), &caddyauth.TailscaleAuth{})
+
+	r := newRequest("192.0.2.1:51234")
+	r.Header.Set("X-Tailscale-User-LoginName", "admin@example.com")
+	r.Header.Set("x-tailscale-groups", "group:admins")
+	_, upstream, err := serve(t, h, r)
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if upstream == nil {
+		t.Fatal("non-tailnet request was not passed on")
+	}
+	for _, name := range []string{"X-Tailscale-User-LoginName", "X-Tailscale-Groups"} {
+		if value := upstream.Header.Get(name); value != "" {
+			t.Errorf("%s = %q reached the upstream", name, value)
+		}
+	}
+
+	r = newRequest("100.64.0.1:51234")
+	r.Header.Set("X-Tailscale-User-LoginName", "admin@example.com")
+	_, upstream, err = serve(t, h, r)
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if got := upstream.Header.Values("X-Tailscale-User-LoginName"); len(got) != 1 || got[0] != "alice@example.com" {
+		t.Errorf("X-Tailscale-User-LoginName = %q, want only the looked up user", got)
+	}
+}
+
+func TestHandlerClientIPSource(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "", want: ""},
+		{source: "connection", want: ""},
+		{source: "headers", want: "alice@example.com"},
+	}
+	srv := newTestServer(t)
+	for _, tt := range tests {
+		t.Run("source "+tt.source, func(t *testing.T) {
+			h := provision(t, srv, &caddyauth.TailscaleAuth{ClientIPSource: tt.source})
+
+			// A trusted proxy at 10.0.0.1, for which Caddy resolved the client IP
+			r := newRequest("10.0.0.1:51234")
+			r.Header.Set("X-Forwarded-For", "100.64.0.1")
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			vars := map[string]any{caddyhttp.ClientIPVarKey: "100.64.0.1"}
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+
+			w := httptest.NewRecorder()
+			var upstream *http.Request
+			err := h.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				upstream = r
+				return nil
+			}))
+			if err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if got := upstream.Header.Get("X-Tailscale-User-LoginName"); got != tt.want {
+				t.Errorf("X-Tailscale-User-LoginName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerSessionCookie(t *testing.T) {
+	srv := newTestServer(t)
+	h := provision(t, srv, &caddyauth.TailscaleAuth{
+		SessionCookie: caddy.Duration(3600e9),
+		SessionSecret: "test-secret",
+	})
+
+	w, _, err := serve(t, h, newRequest("100.64.0.1:51234"))
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "tailscale_auth_session" {
+		t.Fatalf("cookies = %v, want a session cookie", cookies)
+	}
+	session := cookies[0]
+
+	r := newRequest("100.64.0.1:51234")
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	w, upstream, err := serve(t, h, r)
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("session cookie was issued again for a valid session")
+	}
+	if got := upstream.Header.Get("X-Tailscale-User-LoginName"); got != "alice@example.com" {
+		t.Errorf("X-Tailscale-User-LoginName = %q, want the session's user", got)
+	}
+	if got := upstream.Header.Get("Cookie"); got != "app=1" {
+		t.Errorf("Cookie = %q, want the session cookie removed", got)
+	}
+
+	// A cookie replayed from another address is not honored
+	r = newRequest("100.64.0.2:51234")
+	r.AddCookie(session)
+	_, upstream, err = serve(t, h, r)
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if got := upstream.Header.Get("X-Tailscale-User-LoginName"); got != "" {
+		t.Errorf("X-Tailscale-User-LoginName = %q for a replayed cookie", got)
+	}
+}
+
+func TestHandlerPolicyEnforce(t *testing.T) {
+	tests := []struct {
+		enforce string
+		denied  bool
+	}{
+		{enforce: "on", denied: true},
+		{enforce: "off", denied: false},
+	}
+	srv := newTestServer(t)
+	for _, tt := range tests {
+		t.Run("enforce "+tt.enforce, func(t *testing.T) {
+			h := &caddyauth.TailscaleAuth{}
+			h.RequireRole = []string{"admin"}
+			h.Enforce = tt.enforce
+			provision(t, srv, h)
+
+			_, upstream, err := serve(t, h, newRequest("100.64.0.1:51234"))
+			var denyErr *caddyauth.DenyError
+			if denied := errors.As(err, &denyErr); denied != tt.denied {
+				t.Fatalf("ServeHTTP = %v, want denied %t", err, tt.denied)
+			}
+			if tt.denied {
+				return
+			}
+			if upstream == nil {
+				t.Fatal("request was not passed on")
+			}
+			if got := upstream.Header.Get("X-Tailscale-User-LoginName"); got != "alice@example.com" {
+				t.Errorf("X-Tailscale-User-LoginName = %q, want the identity of the would-be denied user", got)
+			}
+		})
+	}
+}
+
+func TestHandlerLoadsCache(t *testing.T) {
+	srv := tailscaletest.NewServer(testTailnet, testAPIKey)
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "devices.json")
+	data := `{"version":1,"ip_to_device":{"100.64.0.1":{"id":"d1","name":"laptop.example.ts.net","user":"alice@example.com","addresses":["100.64.0.1"]}},` +
+		`"users":{"alice@example.com":{"id":"u1","loginName":"alice@example.com","role":"member"}}}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := provision(t, srv, &caddyauth.TailscaleAuth{TailnetConfig: caddyauth.TailnetConfig{CacheFile: path}})
+
+	_, upstream, err := serve(t, h, newRequest("100.64.0.1:51234"))
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if got := upstream.Header.Get("X-Tailscale-Device-ID"); got != "d1" {
+		t.Errorf("X-Tailscale-Device-ID = %q, want the cached device", got)
+	}
+	if n := srv.Requests(devicesPath); n != 0 {
+		t.Errorf("devices were fetched %d times, want the cache used", n)
+	}
+}
+
+func TestHandlerDiscardsCorruptCache(t *testing.T) {
+	srv := newTestServer(t)
+
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(path, []byte(`{"ip_to_device":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := provision(t, srv, &caddyauth.TailscaleAuth{TailnetConfig: caddyauth.TailnetConfig{CacheFile: path}})
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt cache was not moved aside: %v", err)
+	}
+
+	_, upstream, err := serve(t, h, newRequest("100.64.0.1:51234"))
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if got := upstream.Header.Get("X-Tailscale-Device-ID"); got != "d1" {
+		t.Errorf("X-Tailscale-Device-ID = %q, want the device fetched from the API", got)
+	}
+	if n := srv.Requests(devicesPath); n != 1 {
+		t.Errorf("devices were fetched %d times, want 1", n)
+	}
+}
+
+func TestHandlerTaggedDevice(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddUser(caddyauth.User{ID: "u1", LoginName: "alice@example.com", Role: "admin"})
+	srv.SetGroups(map[string][]string{"group:admins": {"alice@example.com"}})
+	srv.AddDevice(caddyauth.Device{
+		ID:        "d2",
+		Name:      "ci.example.ts.net",
+		User:      "alice@example.com",
+		Tags:      []string{"tag:ci"},
+		Addresses: []string{"100.64.0.2"},
+	})
+
+	tests := []struct {
+		name   string
+		policy func(h *caddyauth.TailscaleAuth)
+	}{
+		{name: "require_role", policy: func(h *caddyauth.TailscaleAuth) { h.RequireRole = []string{"admin"} }},
+		{name: "require_group", policy: func(h *caddyauth.TailscaleAuth) { h.RequireGroup = []string{"group:admins"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &caddyauth.TailscaleAuth{}
+			h.FetchGroups = true
+			tt.policy(h)
+			provision(t, srv, h)
+
+			if _, _, err := serve(t, h, newRequest("100.64.0.1:51234")); err != nil {
+				t.Fatalf("user device: ServeHTTP = %v, want it allowed", err)
+			}
+			var denyErr *caddyauth.DenyError
+			if _, _, err := serve(t, h, newRequest("100.64.0.2:51234")); !errors.As(err, &denyErr) {
+				t.Errorf("tagged device: ServeHTTP = %v, want it denied", err)
+			}
+		})
+	}
+
+	h := provision(t, srv, &caddyauth.TailscaleAuth{TailnetConfig: caddyauth.TailnetConfig{FetchGroups: true}})
+	_, upstream, err := serve(t, h, newRequest("100.64.0.2:51234"))
+	if err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if got := upstream.Header.Get("X-Tailscale-Identity-Type"); got != "machine" {
+		t.Errorf("X-Tailscale-Identity-Type = %q, want machine", got)
+	}
+	for _, name := range []string{"X-Tailscale-User-LoginName", "X-Tailscale-User-Role", "X-Tailscale-Groups"} {
+		if value := upstream.Header.Get(name); value != "" {
+			t.Errorf("%s = %q for a tagged device", name, value)
+		}
+	}
+}
+
+func TestHandlerFunnelTag(t *testing.T) {
+	srv := newTestServer(t)
+	for _, output := range []string{"", "vars_only"} {
+		t.Run("output "+output, func(t *testing.T) {
+			h := provision(t, srv, &caddyauth.TailscaleAuth{FunnelAction: "tag", Output: output})
+
+			r := newRequest("127.0.0.1:51234")
+			r.Header.Set("Tailscale-Funnel-Request", "?1")
+			_, upstream, err := serve(t, h, r)
+			if err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			want := "funnel"
+			if output == "vars_only" {
+				want = ""
+			}
+			if got := upstream.Header.Get("X-Tailscale-Via"); got != want {
+				t.Errorf("X-Tailscale-Via = %q, want %q", got, want)
+			}
+			if got := caddyhttp.GetVar(upstream.Context(), "tailscale_auth.via"); got != "funnel" {
+				t.Errorf("{vars.tailscale_auth.via} = %v, want funnel", got)
+			}
+		})
+	}
+}
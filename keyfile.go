@@ -0,0 +1,111 @@
+package caddyauth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// secretFilePollInterval is how often a secret file is checked for a rotated secret
+const secretFilePollInterval = 10 * time.Second
+
+// apiKeySource supplies an API key that may be rotated while the cache uses it
+type apiKeySource interface {
+	// Key returns the current API key
+	Key() string
+	// Close stops watching for rotated keys
+	Close()
+}
+
+// secretFile holds a secret such as an API key read from a file, like a
+// Docker or Kubernetes secret mount, and rereads it when the file changes
+type secretFile struct {
+	option string
+	path   string
+	logger *zap.Logger
+	key    atomic.Pointer[string]
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newSecretFile reads the secret from path and starts watching it for
+// changes. option names the file's option in errors and logs
+func newSecretFile(option, path string, logger *zap.Logger) (*secretFile, error) {
+	f := &secretFile{
+		option: option,
+		path:   path,
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	key, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	f.key.Store(&key)
+
+	go f.watch()
+	return f, nil
+}
+
+// Key returns the current secret
+func (f *secretFile) Key() string {
+	return *f.key.Load()
+}
+
+// read returns the secret in the file, without surrounding whitespace
+func (f *secretFile) read() (string, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", f.option, err)
+	}
+	key := string(bytes.TrimSpace(data))
+	if key == "" {
+		return "", fmt.Errorf("%s %s is empty", f.option, f.path)
+	}
+	return key, nil
+}
+
+// watch polls the file for a rotated secret. Polling rather than file events
+// also catches secret mounts that are updated by swapping a symlink
+func (f *secretFile) watch() {
+	defer close(f.done)
+
+	ticker := time.NewTicker(secretFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.reload()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// reload rereads the file, keeping the previous secret if it cannot be read
+func (f *secretFile) reload() {
+	key, err := f.read()
+	if err != nil {
+		f.logger.Warn("failed to reload secret file, keeping the previous secret",
+			zap.String("option", f.option),
+			zap.Error(err))
+		return
+	}
+	if key != f.Key() {
+		f.key.Store(&key)
+		f.logger.Info("reloaded rotated secret", zap.String(f.option, f.path))
+	}
+}
+
+// Close stops watching the file
+func (f *secretFile) Close() {
+	close(f.stop)
+	<-f.done
+}
@@ -0,0 +1,66 @@
+package caddyauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// hashedKeyPrefix marks key material replaced by its truncated SHA-256 hash
+const hashedKeyPrefix = "sha256:"
+
+// validateKeyMaterial checks a key_material setting
+func validateKeyMaterial(mode string) error {
+	switch mode {
+	case "", "keep", "hash", "omit":
+		return nil
+	default:
+		return fmt.Errorf("key_material must be 'keep', 'hash' or 'omit', got %q", mode)
+	}
+}
+
+// protectKeys hashes or removes the machine, node and Tailnet Lock keys of
+// device as key_material mode asks. It reports whether the device changed
+func protectKeys(device *Device, mode string) bool {
+	changed := protectKey(&device.MachineKey, mode)
+	changed = protectKey(&device.NodeKey, mode) || changed
+	return protectKey(&device.TailnetLockKey, mode) || changed
+}
+
+// protectKey hashes or removes a single key. Hashing is idempotent, so caches
+// written with hash keep the same values
+func protectKey(key *string, mode string) bool {
+	if *key == "" {
+		return false
+	}
+	switch mode {
+	case "omit":
+		*key = ""
+		return true
+	case "hash":
+		if strings.HasPrefix(*key, hashedKeyPrefix) {
+			return false
+		}
+		sum := sha256.Sum256([]byte(*key))
+		*key = hashedKeyPrefix + hex.EncodeToString(sum[:12])
+		return true
+	}
+	return false
+}
+
+// appKeyMaterial returns the key_material setting of the tailscale_auth app,
+// or "" if the app is not configured
+func appKeyMaterial(ctx caddy.Context) (string, error) {
+	appIface, err := ctx.AppIfConfigured("tailscale_auth")
+	if errors.Is(err, caddy.ErrNotConfigured) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return appIface.(*App).KeyMaterial, nil
+}
@@ -0,0 +1,57 @@
+package caddyauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// checkCacheAge enforces max_cache_age. A match from a cache that was not
+// refreshed within it is refreshed once more, unless miss_refresh_cooldown
+// holds refreshes back, and rejected if that fails. It returns the possibly
+// updated match
+func (t *TailscaleAuth) checkCacheAge(ctx context.Context, clientIP string, match *deviceMatch) (*deviceMatch, error) {
+	cache := match.cache
+	if t.MaxCacheAge == 0 || cache == nil {
+		return match, nil
+	}
+
+	maxAge := time.Duration(t.MaxCacheAge)
+	refreshed := cache.refreshedAt()
+	if !refreshed.IsZero() && time.Since(refreshed) <= maxAge {
+		t.liftLockdown()
+		return match, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	var refreshErr error
+	if cache.coolingDown() {
+		refreshErr = fmt.Errorf("miss_refresh_cooldown holds refreshes back")
+	} else if refreshErr = cache.refreshOnce(ctx); refreshErr == nil {
+		t.liftLockdown()
+		refetched, ok := cache.match(clientIP)
+		if !ok {
+			return nil, fmt.Errorf("%w for IP %s after cache refresh", errDeviceNotFound, clientIP)
+		}
+		return refetched, nil
+	}
+
+	if t.lockedDown.CompareAndSwap(false, true) {
+		fields := []zap.Field{zap.String("tailnet", cache.tailnet), zap.Error(refreshErr)}
+		if !refreshed.IsZero() {
+			fields = append(fields, zap.Time("last_refresh", refreshed))
+		}
+		t.logger.Error("device cache exceeded max_cache_age, locking down", fields...)
+	}
+	return nil, fmt.Errorf("device cache of tailnet %s was not refreshed within max_cache_age %s: %w", cache.tailnet, maxAge, refreshErr)
+}
+
+// liftLockdown logs the end of a lockdown, if there was one
+func (t *TailscaleAuth) liftLockdown() {
+	if t.lockedDown.CompareAndSwap(true, false) {
+		t.logger.Info("device cache refreshed, lifting lockdown")
+	}
+}
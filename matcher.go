@@ -0,0 +1,252 @@
+package caddyauth
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(MatchUser{})
+	caddy.RegisterModule(MatchTag{})
+	caddy.RegisterModule(MatchGrant{})
+}
+
+// MatchUser matches requests whose resolved Tailscale login name matches one
+// of the glob patterns, ignoring case. The identity is resolved by a
+// tailscale_auth handler earlier in the route, so requests it did not
+// identify never match
+type MatchUser []string
+
+// CaddyModule returns the Caddy module information.
+func (MatchUser) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.tailscale_user",
+		New: func() caddy.Module { return new(MatchUser) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m MatchUser) Provision(caddy.Context) error {
+	for i, pattern := range m {
+		m[i] = strings.ToLower(pattern)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m MatchUser) Validate() error {
+	for _, pattern := range m {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m MatchUser) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError implements caddyhttp.RequestMatcherWithError.
+func (m MatchUser) MatchWithError(r *http.Request) (bool, error) {
+	loginName, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.login_name").(string)
+	if loginName == "" {
+		return false, nil
+	}
+
+	loginName = strings.ToLower(loginName)
+	for _, pattern := range m {
+		if matched, _ := path.Match(pattern, loginName); matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	tailscale_user <login_patterns...>
+func (m *MatchUser) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		patterns := d.RemainingArgs()
+		if len(patterns) == 0 {
+			return d.ArgErr()
+		}
+		*m = append(*m, patterns...)
+		if d.NextBlock(0) {
+			return d.Err("malformed tailscale_user matcher: blocks are not supported")
+		}
+	}
+	return nil
+}
+
+// MatchTag matches requests from devices carrying at least one of the ACL
+// tags. The "tag:" prefix is optional. Like MatchUser, it relies on a
+// tailscale_auth handler earlier in the route
+type MatchTag []string
+
+// CaddyModule returns the Caddy module information.
+func (MatchTag) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.tailscale_tag",
+		New: func() caddy.Module { return new(MatchTag) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m MatchTag) Provision(caddy.Context) error {
+	for i, tag := range m {
+		if !strings.HasPrefix(tag, "tag:") {
+			m[i] = "tag:" + tag
+		}
+	}
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m MatchTag) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError implements caddyhttp.RequestMatcherWithError.
+func (m MatchTag) MatchWithError(r *http.Request) (bool, error) {
+	tags, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.tags").(string)
+	if tags == "" {
+		return false, nil
+	}
+
+	for _, tag := range strings.Split(tags, ",") {
+		if slices.Contains(m, tag) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	tailscale_tag <tags...>
+func (m *MatchTag) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		tags := d.RemainingArgs()
+		if len(tags) == 0 {
+			return d.ArgErr()
+		}
+		*m = append(*m, tags...)
+		if d.NextBlock(0) {
+			return d.Err("malformed tailscale_tag matcher: blocks are not supported")
+		}
+	}
+	return nil
+}
+
+// MatchGrant matches requests from devices that were granted all of the peer
+// capabilities and whose posture attributes have all of the given values.
+// Capabilities are only known through a tsnet node or Tailscale Serve, and
+// posture attributes need fetch_posture
+type MatchGrant struct {
+	// Capabilities are peer capabilities such as "example.com/cap/beta"
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Posture maps posture attribute names such as "custom:tier" to required values
+	Posture map[string]string `json:"posture,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchGrant) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.tailscale_grant",
+		New: func() caddy.Module { return new(MatchGrant) },
+	}
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m MatchGrant) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+// MatchWithError implements caddyhttp.RequestMatcherWithError.
+func (m MatchGrant) MatchWithError(r *http.Request) (bool, error) {
+	if len(m.Capabilities) > 0 {
+		granted, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.capabilities").(string)
+		caps := strings.Split(granted, ",")
+		for _, capability := range m.Capabilities {
+			if !slices.Contains(caps, capability) {
+				return false, nil
+			}
+		}
+	}
+
+	for key, value := range m.Posture {
+		actual, ok := caddyhttp.GetVar(r.Context(), "tailscale_auth.posture."+key).(string)
+		if !ok || actual != value {
+			return false, nil
+		}
+	}
+
+	return len(m.Capabilities) > 0 || len(m.Posture) > 0, nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	tailscale_grant [<capabilities...>] {
+//	    capability <capabilities...>
+//	    posture <attribute> <value>
+//	}
+func (m *MatchGrant) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Capabilities = append(m.Capabilities, d.RemainingArgs()...)
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "capability":
+				caps := d.RemainingArgs()
+				if len(caps) == 0 {
+					return d.ArgErr()
+				}
+				m.Capabilities = append(m.Capabilities, caps...)
+
+			case "posture":
+				var key, value string
+				if !d.Args(&key, &value) {
+					return d.ArgErr()
+				}
+				if m.Posture == nil {
+					m.Posture = make(map[string]string)
+				}
+				m.Posture[key] = value
+
+			default:
+				return d.Errf("unrecognized tailscale_grant subdirective: %s", d.Val())
+			}
+		}
+	}
+
+	if len(m.Capabilities) == 0 && len(m.Posture) == 0 {
+		return d.Err("tailscale_grant needs at least one capability or posture attribute")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner                 = (*MatchUser)(nil)
+	_ caddy.Validator                   = (*MatchUser)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchUser)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchUser)(nil)
+	_ caddy.Provisioner                 = (*MatchTag)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchTag)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchTag)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchGrant)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchGrant)(nil)
+)
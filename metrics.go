@@ -0,0 +1,188 @@
+package caddyauth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var authMetrics = struct {
+	once            sync.Once
+	limitRejections *prometheus.CounterVec
+	quotaRequests   *prometheus.CounterVec
+	quotaBytes      *prometheus.CounterVec
+	shadowDenials   *prometheus.CounterVec
+}{}
+
+// initAuthMetrics creates the plugin's metrics once and registers them with
+// the config's registry. Several handlers register the same collectors, so
+// duplicate registrations are ignored
+func initAuthMetrics(registry *prometheus.Registry) error {
+	const ns, sub = "caddy", "tailscale_auth"
+
+	authMetrics.once.Do(func() {
+		authMetrics.limitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "limit_rejections_total",
+			Help:      "Requests rejected by tailscale_rate_limit and tailscale_quota, by limit (rate, concurrency or quota) and identity key.",
+		}, []string{"limit", "key"})
+		authMetrics.quotaRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "quota_requests_total",
+			Help:      "Requests counted by tailscale_quota, by identity key and identity.",
+		}, []string{"key", "identity"})
+		authMetrics.quotaBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "quota_response_bytes_total",
+			Help:      "Response bytes counted by tailscale_quota, by identity key and identity.",
+		}, []string{"key", "identity"})
+		authMetrics.shadowDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "shadow_denials_total",
+			Help:      "Requests that policies with enforce off would have denied, by policy and reason.",
+		}, []string{"policy", "reason"})
+	})
+
+	for _, collector := range []prometheus.Collector{
+		authMetrics.limitRejections,
+		authMetrics.quotaRequests,
+		authMetrics.quotaBytes,
+		authMetrics.shadowDenials,
+		cacheMetrics,
+	} {
+		if err := registry.Register(collector); err != nil &&
+			!errors.Is(err, prometheus.AlreadyRegisteredError{
+				ExistingCollector: collector,
+				NewCollector:      collector,
+			}) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hitWindowBuckets and hitWindowWidth make up the sliding window the cache
+// hit ratio is computed over
+const (
+	hitWindowBuckets = 10
+	hitWindowWidth   = 30 * time.Second
+)
+
+// hitWindow counts cache hits and misses over a sliding window of buckets
+type hitWindow struct {
+	mu      sync.Mutex
+	buckets [hitWindowBuckets]struct {
+		slot         int64
+		hits, misses uint64
+	}
+}
+
+// record counts a lookup as a hit or a miss
+func (w *hitWindow) record(hit bool) {
+	slot := time.Now().UnixNano() / int64(hitWindowWidth)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b := &w.buckets[slot%hitWindowBuckets]
+	if b.slot != slot {
+		b.slot, b.hits, b.misses = slot, 0, 0
+	}
+	if hit {
+		b.hits++
+	} else {
+		b.misses++
+	}
+}
+
+// ratio returns the share of hits among the lookups in the window, or false
+// if there were none
+func (w *hitWindow) ratio() (float64, bool) {
+	slot := time.Now().UnixNano() / int64(hitWindowWidth)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var hits, lookups uint64
+	for _, b := range w.buckets {
+		if b.slot > slot-hitWindowBuckets {
+			hits += b.hits
+			lookups += b.hits + b.misses
+		}
+	}
+	if lookups == 0 {
+		return 0, false
+	}
+	return float64(hits) / float64(lookups), true
+}
+
+// cacheCollector reports gauges for every live device cache when scraped
+type cacheCollector struct {
+	age         *prometheus.Desc
+	entries     *prometheus.Desc
+	hitRatio    *prometheus.Desc
+	lastRefresh *prometheus.Desc
+}
+
+// cacheMetrics is registered with every config's registry like the other metrics
+var cacheMetrics = newCacheCollector()
+
+func newCacheCollector() *cacheCollector {
+	labels := []string{"tailnet", "cache"}
+	return &cacheCollector{
+		age: prometheus.NewDesc("caddy_tailscale_auth_cache_age_seconds",
+			"Age of the device data in the cache, from the Date of the API response it came from.", labels, nil),
+		entries: prometheus.NewDesc("caddy_tailscale_auth_cache_entries",
+			"IP address mappings in the device cache.", labels, nil),
+		hitRatio: prometheus.NewDesc("caddy_tailscale_auth_cache_hit_ratio",
+			"Share of lookups answered from the cache without a refresh over the last 5 minutes.", labels, nil),
+		lastRefresh: prometheus.NewDesc("caddy_tailscale_auth_cache_seconds_since_refresh",
+			"Seconds since the last successful refresh from the API by this instance.", labels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.age
+	ch <- c.entries
+	ch <- c.hitRatio
+	ch <- c.lastRefresh
+}
+
+// Collect implements prometheus.Collector.
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	cachePool.Range(func(key, value any) bool {
+		cache, ok := value.(*tailnetCache)
+		if !ok {
+			return true
+		}
+		labels := []string{cache.tailnet, strings.TrimPrefix(key.(string), cache.tailnet+"/")}
+
+		cache.mu.RLock()
+		entries := len(cache.devices.IPToDevice)
+		lastUpdate := cache.devices.LastUpdate
+		cache.mu.RUnlock()
+
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(entries), labels...)
+		if updated, err := http.ParseTime(lastUpdate); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.age, prometheus.GaugeValue, now.Sub(updated).Seconds(), labels...)
+		}
+		if ratio, ok := cache.hits.ratio(); ok {
+			ch <- prometheus.MustNewConstMetric(c.hitRatio, prometheus.GaugeValue, ratio, labels...)
+		}
+		if refreshed := cache.lastRefresh.Load(); refreshed != 0 {
+			ch <- prometheus.MustNewConstMetric(c.lastRefresh, prometheus.GaugeValue, now.Sub(time.Unix(0, refreshed)).Seconds(), labels...)
+		}
+		return true
+	})
+}
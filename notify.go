@@ -0,0 +1,250 @@
+package caddyauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"go.uber.org/zap"
+)
+
+// notifyTimeout bounds how long a notification webhook may take
+const notifyTimeout = 10 * time.Second
+
+// maxPendingNotifications limits the notifications in flight per handler.
+// Further ones are dropped rather than piling up behind a slow receiver
+const maxPendingNotifications = 16
+
+// seenPool shares seen-device trackers between handlers using the same file
+var seenPool = caddy.NewUsagePool()
+
+// seenTracker records the devices and users this instance has seen, persisted
+// so restarts do not report every device as new again
+type seenTracker struct {
+	logger *zap.Logger
+	store  cache.Store
+	mu     sync.Mutex
+	seen   seenRecords
+}
+
+// seenRecords maps device IDs and login names to when they were first seen
+type seenRecords struct {
+	Devices map[string]time.Time `json:"devices"`
+	Users   map[string]time.Time `json:"users"`
+}
+
+// newSeenTracker loads the seen devices from path
+func newSeenTracker(path string, logger *zap.Logger) *seenTracker {
+	s := &seenTracker{
+		logger: logger,
+		store:  &cache.FileStore{Path: path},
+		seen:   seenRecords{Devices: make(map[string]time.Time), Users: make(map[string]time.Time)},
+	}
+
+	data, err := s.store.Load()
+	if err == nil && data != nil {
+		err = json.Unmarshal(data, &s.seen)
+	}
+	if err != nil {
+		logger.Warn("failed to load seen devices, treating every device as new", zap.Error(err))
+	}
+	if s.seen.Devices == nil {
+		s.seen.Devices = make(map[string]time.Time)
+	}
+	if s.seen.Users == nil {
+		s.seen.Users = make(map[string]time.Time)
+	}
+
+	return s
+}
+
+// Destruct implements caddy.Destructor.
+func (s *seenTracker) Destruct() error {
+	return nil
+}
+
+// observe records the device and its user and reports which of them are new
+func (s *seenTracker) observe(device *Device, now time.Time) (newDevice, newUser bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen.Devices[device.ID]; !ok {
+		s.seen.Devices[device.ID] = now
+		newDevice = true
+	}
+	if _, ok := s.seen.Users[device.User]; !ok && device.User != "" {
+		s.seen.Users[device.User] = now
+		newUser = true
+	}
+	if !newDevice && !newUser {
+		return false, false
+	}
+
+	data, err := json.Marshal(s.seen)
+	if err == nil {
+		err = s.store.Save(data)
+	}
+	if err != nil {
+		s.logger.Error("failed to save seen devices", zap.Error(err))
+	}
+
+	return newDevice, newUser
+}
+
+// newDeviceNotification is the body POSTed to new_device_webhook. The text
+// field makes it usable with Slack and Matrix incoming webhooks as is
+type newDeviceNotification struct {
+	Text       string    `json:"text"`
+	Event      string    `json:"event"`
+	DecisionID string    `json:"decision_id"`
+	Tailnet    string    `json:"tailnet"`
+	Device     string    `json:"device"`
+	ID         string    `json:"device_id"`
+	User       string    `json:"user"`
+	OS         string    `json:"os"`
+	Route      string    `json:"route"`
+	Time       time.Time `json:"time"`
+}
+
+// notifyNewDevice reports a device or user seen for the first time to the
+// new_device_webhook and syslog without delaying the request
+func (t *TailscaleAuth) notifyNewDevice(r *http.Request, match *deviceMatch) {
+	newDevice, newUser := t.seen.observe(match.device, time.Now())
+	if !newDevice && !newUser {
+		return
+	}
+
+	device := match.device
+	event, text := "new_device", fmt.Sprintf("New device %s (%s) of %s accessed %s", device.Name, device.OS, device.User, r.Host+r.URL.Path)
+	if newUser {
+		event, text = "new_user", fmt.Sprintf("New user %s accessed %s from device %s (%s)", device.User, r.Host+r.URL.Path, device.Name, device.OS)
+	}
+
+	notification := newDeviceNotification{
+		Text:       text,
+		Event:      event,
+		DecisionID: t.decisionID(r),
+		Tailnet:    match.tailnet,
+		Device:     device.Name,
+		ID:         device.ID,
+		User:       device.User,
+		OS:         device.OS,
+		Route:      r.Host + r.URL.Path,
+		Time:       time.Now().UTC(),
+	}
+
+	t.logger.Info("new device accessed a protected route",
+		zap.String("event", event),
+		zap.String("device", device.Name))
+
+	if t.NewDeviceWebhook != "" {
+		t.sendNotification(t.NewDeviceWebhook, notification)
+	}
+	if t.syslog != nil {
+		t.syslog.send(notification, syslogNotice, notification.Time)
+	}
+}
+
+// denyNotification is the body POSTed to deny_webhook for every denied request
+type denyNotification struct {
+	Text       string    `json:"text"`
+	Event      string    `json:"event"`
+	DecisionID string    `json:"decision_id"`
+	Reason     string    `json:"reason"`
+	Message    string    `json:"message"`
+	ClientIP   string    `json:"client_ip"`
+	User       string    `json:"user,omitempty"`
+	Device     string    `json:"device,omitempty"`
+	ID         string    `json:"device_id,omitempty"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Time       time.Time `json:"time"`
+}
+
+// notifyDeny reports a denied request to the deny_webhook and syslog
+func (t *TailscaleAuth) notifyDeny(r *http.Request, reason string, device *Device, cause error) {
+	notification := denyNotification{
+		Event:      "deny",
+		DecisionID: t.decisionID(r),
+		Reason:     reason,
+		Message:    cause.Error(),
+		ClientIP:   t.clientIP(r),
+		Method:     r.Method,
+		Route:      r.Host + r.URL.Path,
+		Time:       time.Now().UTC(),
+	}
+
+	who := notification.ClientIP
+	if device != nil {
+		notification.User = device.User
+		notification.Device = device.Name
+		notification.ID = device.ID
+		who = fmt.Sprintf("%s on %s", device.User, device.Name)
+	}
+	notification.Text = fmt.Sprintf("Denied %s %s for %s: %s", r.Method, notification.Route, who, reason)
+
+	if t.DenyWebhook != "" {
+		t.sendNotification(t.DenyWebhook, notification)
+	}
+	if t.syslog != nil {
+		t.syslog.send(notification, syslogWarning, notification.Time)
+	}
+}
+
+// sendNotification POSTs body to url in the background, dropping it if too
+// many notifications are already pending
+func (t *TailscaleAuth) sendNotification(url string, body any) {
+	select {
+	case t.notifySlots <- struct{}{}:
+	default:
+		t.logger.Warn("too many pending notifications, dropping one", zap.String("url", url))
+		return
+	}
+
+	go func() {
+		defer func() { <-t.notifySlots }()
+		t.postNotification(url, body)
+	}()
+}
+
+// postNotification POSTs body to url as JSON, or as a CEF or LEEF line
+// depending on event_format, logging failures
+func (t *TailscaleAuth) postNotification(url string, body any) {
+	data, contentType, err := t.encodeNotification(body)
+	if err != nil {
+		t.logger.Error("failed to marshal notification", zap.Error(err))
+		return
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, contentType, bytes.NewReader(data))
+	if err != nil {
+		t.logger.Warn("failed to send notification", zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		t.logger.Warn("notification webhook failed", zap.Int("status", resp.StatusCode))
+	}
+}
+
+// encodeNotification returns body in the handler's event format and its content type
+func (t *TailscaleAuth) encodeNotification(body any) ([]byte, string, error) {
+	event, ok := body.(securityEvent)
+	if t.EventFormat == "" || t.EventFormat == "json" || !ok {
+		data, err := json.Marshal(body)
+		return data, "application/json", err
+	}
+
+	line, err := formatEvent(t.EventFormat, event)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(line + "\n"), "text/plain; charset=utf-8", nil
+}
@@ -0,0 +1,142 @@
+package caddyauth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"go.uber.org/zap"
+)
+
+// oauthRetryInterval is how long to wait before retrying a failed token refresh
+const oauthRetryInterval = time.Minute
+
+// requiredScope is an OAuth scope a configured feature needs
+type requiredScope struct {
+	scope  string
+	option string
+}
+
+// requiredScopes returns the OAuth scopes the configuration needs, together
+// with the option needing each
+func (c *TailnetConfig) requiredScopes() []requiredScope {
+	scopes := []requiredScope{{"devices:core:read", "device lookups"}}
+	if c.FetchUsers {
+		scopes = append(scopes, requiredScope{"users:read", "fetch_users"})
+	}
+	if c.FetchPosture {
+		scopes = append(scopes, requiredScope{"devices:posture_attributes:read", "fetch_posture"})
+	}
+	if c.FetchGroups {
+		scopes = append(scopes, requiredScope{"policy_file:read", "fetch_groups"})
+	} else if c.FetchGrants {
+		scopes = append(scopes, requiredScope{"policy_file:read", "fetch_grants"})
+	}
+	return scopes
+}
+
+// checkScopes returns an error listing the required scopes token lacks
+func (c *TailnetConfig) checkScopes(token *client.Token) error {
+	var missing []string
+	for _, required := range c.requiredScopes() {
+		if !token.HasScope(required.scope) {
+			missing = append(missing, fmt.Sprintf("%s (needed by %s)", required.scope, required.option))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("oauth client %s is missing required scopes: %s", c.OAuthClientID, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// oauthToken holds an access token of an OAuth client and replaces it with
+// a new one before it expires
+type oauthToken struct {
+	apiURL       string
+	userAgent    string
+	clientID     string
+	clientSecret string
+	logger       *zap.Logger
+	key          atomic.Pointer[string]
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// newOAuthToken obtains a first access token, checks that it has the scopes
+// the configuration needs and starts refreshing it
+func newOAuthToken(cfg *TailnetConfig, logger *zap.Logger) (*oauthToken, error) {
+	t := &oauthToken{
+		apiURL:       cfg.APIURL,
+		userAgent:    cfg.userAgent(),
+		clientID:     cfg.OAuthClientID,
+		clientSecret: cfg.OAuthClientSecret,
+		logger:       logger,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	token, err := t.fetch()
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Scopes) == 0 {
+		logger.Warn("token response lists no scopes, skipping the scope check")
+	} else if err := cfg.checkScopes(token); err != nil {
+		return nil, err
+	}
+
+	go t.refreshLoop(token.Expiry)
+	return t, nil
+}
+
+// Key returns the current access token
+func (t *oauthToken) Key() string {
+	return *t.key.Load()
+}
+
+// Close stops refreshing the token
+func (t *oauthToken) Close() {
+	close(t.stop)
+	<-t.done
+}
+
+// fetch obtains a new access token and puts it in use
+func (t *oauthToken) fetch() (*client.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	token, err := client.ClientCredentialsWithUserAgent(ctx, t.userAgent, t.apiURL, t.clientID, t.clientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("oauth client %s: %w", t.clientID, err)
+	}
+	t.key.Store(&token.AccessToken)
+	return token, nil
+}
+
+// refreshLoop replaces the token once three quarters of its lifetime have
+// passed, retrying failures until it expires
+func (t *oauthToken) refreshLoop(expiry time.Time) {
+	defer close(t.done)
+
+	next := time.Now().Add(time.Until(expiry) * 3 / 4)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-t.stop:
+			timer.Stop()
+			return
+		}
+
+		token, err := t.fetch()
+		if err != nil {
+			t.logger.Error("failed to refresh OAuth access token", zap.Error(err))
+			next = time.Now().Add(oauthRetryInterval)
+			continue
+		}
+		next = time.Now().Add(time.Until(token.Expiry) * 3 / 4)
+	}
+}
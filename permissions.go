@@ -0,0 +1,65 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultPermissionsField is the capability parameter field permissions are read from
+const defaultPermissionsField = "permissions"
+
+// permissions returns the sorted permissions that the grants of
+// permissions_app give the identity
+func (t *TailscaleAuth) permissions(match *deviceMatch) []string {
+	var permissions []string
+	for _, param := range t.grantedApps(match)[t.PermissionsApp] {
+		permissions = append(permissions, permissionValues(param, t.PermissionsField)...)
+	}
+	slices.Sort(permissions)
+	return slices.Compact(permissions)
+}
+
+// permissionValues returns the permissions in field of a capability
+// parameter, a string or a list of strings. Parameters of any other shape
+// grant nothing
+func permissionValues(param json.RawMessage, field string) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(param, &fields); err != nil {
+		return nil
+	}
+	value, ok := fields[field]
+	if !ok {
+		return nil
+	}
+
+	var permission string
+	if err := json.Unmarshal(value, &permission); err == nil {
+		if permission == "" {
+			return nil
+		}
+		return []string{permission}
+	}
+	var permissions []string
+	if err := json.Unmarshal(value, &permissions); err == nil {
+		return slices.DeleteFunc(permissions, func(p string) bool { return p == "" })
+	}
+	return nil
+}
+
+// addPermissions sets the Permissions header and {vars.tailscale_auth.permissions}
+// to the identity's permissions in permissions_app. The var is set, if empty,
+// for identities without any
+func (t *TailscaleAuth) addPermissions(r *http.Request, match *deviceMatch) {
+	if t.PermissionsApp == "" {
+		return
+	}
+	permissions := t.permissions(match)
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.permissions", strings.Join(permissions, ","))
+	if len(permissions) > 0 {
+		t.setListHeader(r, "Permissions", permissions)
+	}
+}
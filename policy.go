@@ -0,0 +1,327 @@
+package caddyauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+// requiresIdentity reports whether requests from unidentified clients must be denied
+func (t *TailscaleAuth) requiresIdentity() bool {
+	return t.ExpectedTailnet != "" || t.anyPolicy(func(p *policy.Policy) bool {
+		return p.Enforced() && p.RequiresIdentity()
+	})
+}
+
+// reportUnidentified reports a request passed on without an identity that a
+// policy with enforce off would have denied for lacking one
+func (t *TailscaleAuth) reportUnidentified(r *http.Request, reason string, err error) {
+	for name, p := range t.namedPolicies() {
+		if !p.Enforced() && p.RequiresIdentity() {
+			t.reportShadowDenial(r, name, reason, nil, err)
+		}
+	}
+}
+
+// namedPolicies yields the handler's rules, named "", and then the named policies
+func (t *TailscaleAuth) namedPolicies() iter.Seq2[string, *policy.Policy] {
+	return func(yield func(string, *policy.Policy) bool) {
+		if !yield("", &t.Policy) {
+			return
+		}
+		for i, p := range t.policies {
+			if !yield(t.Policies[i], p) {
+				return
+			}
+		}
+	}
+}
+
+// reportShadowDenial logs, meters and records a denial that a policy with
+// enforce off would have made, and sets {vars.tailscale_auth.would_deny}
+func (t *TailscaleAuth) reportShadowDenial(r *http.Request, name, reason string, match *deviceMatch, err error) {
+	if _, ok := caddyhttp.GetVar(r.Context(), "tailscale_auth.would_deny").(string); !ok {
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.would_deny", reason)
+	}
+
+	fields := []zap.Field{
+		zap.String("reason", reason),
+		zap.String("client_ip", t.clientIP(r)),
+		zap.String("decision_id", t.decisionID(r)),
+		zap.Error(err),
+	}
+	label := "handler"
+	if name != "" {
+		fields = append(fields, zap.String("policy", name))
+		label = name
+	}
+	if match != nil {
+		fields = append(fields, zap.String("device", match.device.Name))
+	}
+	t.logger.Info("policy would deny request", fields...)
+
+	authMetrics.shadowDenials.WithLabelValues(label, reason).Inc()
+	t.logDecision(r, "would_deny", reason, match, err)
+}
+
+// anyPolicy reports whether f holds for the handler's rules or one of the named policies
+func (t *TailscaleAuth) anyPolicy(f func(*policy.Policy) bool) bool {
+	return f(&t.Policy) || slices.ContainsFunc(t.policies, f)
+}
+
+// refetchFlagged refetches a device once before require_updated_client or
+// require_tailnet_lock_ok deny it, since the flags they check only clear in
+// the cache on the next refresh. It returns the possibly updated match
+func (t *TailscaleAuth) refetchFlagged(ctx context.Context, clientIP string, match *deviceMatch) *deviceMatch {
+	if match.cache == nil {
+		return match
+	}
+	device := match.device
+	if !t.anyPolicy(func(p *policy.Policy) bool {
+		return p.RequireUpdatedClient && device.UpdateAvailable ||
+			p.RequireTailnetLockOK && device.TailnetLockError != ""
+	}) {
+		return match
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	if err := match.cache.refreshDevice(ctx, device.ID); err != nil {
+		t.logger.Warn("failed to refetch flagged device",
+			zap.String("device", match.device.Name),
+			zap.Error(err))
+		return match
+	}
+	if refetched, ok := match.cache.match(clientIP); ok {
+		return refetched
+	}
+	return match
+}
+
+// checkPolicies applies the handler's rules and then the named policies to an
+// identified client and returns the deny reason and error of the first rule it violates
+func (t *TailscaleAuth) checkPolicies(r *http.Request, match *deviceMatch) (string, error) {
+	id := policy.Identity{
+		Device: match.device,
+		User:   match.user,
+		Groups: t.userGroups(match),
+	}
+	for name, p := range t.namedPolicies() {
+		reason, err := p.Check(id)
+		if err == nil {
+			continue
+		}
+		if p.Enforced() {
+			return reason, err
+		}
+		t.reportShadowDenial(r, name, reason, match, err)
+	}
+	return "", nil
+}
+
+// provisionPolicies looks up the named policies in the tailscale_auth app
+func (t *TailscaleAuth) provisionPolicies(ctx caddy.Context) error {
+	if len(t.Policies) == 0 {
+		return nil
+	}
+
+	appIface, err := ctx.AppIfConfigured("tailscale_auth")
+	if err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+	app := appIface.(*App)
+
+	t.policies = make([]*policy.Policy, 0, len(t.Policies))
+	for _, name := range t.Policies {
+		p, err := app.policy(name)
+		if err != nil {
+			return err
+		}
+		t.policies = append(t.policies, p)
+	}
+	return nil
+}
+
+// provisionGroups merges the inline groups with those of the groups file
+func (t *TailscaleAuth) provisionGroups() error {
+	t.groups = make(map[string][]string, len(t.Groups))
+	for group, members := range t.Groups {
+		t.groups[group] = append(t.groups[group], members...)
+	}
+
+	if t.GroupsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.GroupsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read groups_file: %w", err)
+	}
+	var fileGroups map[string][]string
+	if err := json.Unmarshal(data, &fileGroups); err != nil {
+		return fmt.Errorf("failed to parse groups_file %s: %w", t.GroupsFile, err)
+	}
+	for group, members := range fileGroups {
+		t.groups[group] = append(t.groups[group], members...)
+	}
+
+	return nil
+}
+
+// userGroups returns the sorted groups the device's user belongs to, from
+// the configured groups and the groups fetched from the policy file. Tagged
+// devices are in no group, whoever tagged them
+func (t *TailscaleAuth) userGroups(match *deviceMatch) []string {
+	if match.device.IdentityType() != "user" {
+		return nil
+	}
+	groups := slices.Clone(match.groups)
+	for group, members := range t.groups {
+		if policy.ContainsFold(members, match.device.User) {
+			groups = append(groups, group)
+		}
+	}
+	slices.Sort(groups)
+	return slices.Compact(groups)
+}
+
+// grantedApps returns the application capabilities that the fetched grants
+// give the identity on grant_target, with their parameters
+func (t *TailscaleAuth) grantedApps(match *deviceMatch) map[string][]json.RawMessage {
+	if match.apps == nil && len(match.grants) > 0 {
+		id := policy.Identity{Device: match.device, User: match.user, Groups: t.userGroups(match)}
+		match.apps = policy.GrantedApps(match.grants, id, t.GrantTarget)
+	}
+	return match.apps
+}
+
+// capabilities returns the device's peer capabilities together with the
+// application capabilities granted through fetched grants, sorted
+func (t *TailscaleAuth) capabilities(match *deviceMatch) []string {
+	granted := t.grantedApps(match)
+	if len(granted) == 0 {
+		return match.device.Capabilities
+	}
+	capabilities := slices.AppendSeq(slices.Clone(match.device.Capabilities), maps.Keys(granted))
+	slices.Sort(capabilities)
+	return slices.Compact(capabilities)
+}
+
+// unmarshalPolicyOption parses the current subdirective if it is a policy
+// rule, reporting whether it was recognized
+func unmarshalPolicyOption(p *policy.Policy, d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "allow_external":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.DenyExternal = false
+
+	case "deny_external":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.DenyExternal = true
+
+	case "require_updated_client":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.RequireUpdatedClient = true
+
+	case "require_tailnet_lock_ok":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.RequireTailnetLockOK = true
+
+	case "enforce":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.Enforce = d.Val()
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "require_identity":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.RequireIdentity = d.Val()
+
+	case "require_role":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.RequireRole = append(p.RequireRole, d.Val())
+		p.RequireRole = append(p.RequireRole, d.RemainingArgs()...)
+
+	case "require_posture":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return true, d.ArgErr()
+		}
+		if p.RequirePosture == nil {
+			p.RequirePosture = make(map[string]string)
+		}
+		p.RequirePosture[args[0]] = args[1]
+
+	case "allow_os":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.AllowOS = append(p.AllowOS, d.Val())
+		p.AllowOS = append(p.AllowOS, d.RemainingArgs()...)
+
+	case "deny_os":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.DenyOS = append(p.DenyOS, d.Val())
+		p.DenyOS = append(p.DenyOS, d.RemainingArgs()...)
+
+	case "allow_hostnames":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.AllowHostnames = append(p.AllowHostnames, d.Val())
+		p.AllowHostnames = append(p.AllowHostnames, d.RemainingArgs()...)
+
+	case "deny_hostnames":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.DenyHostnames = append(p.DenyHostnames, d.Val())
+		p.DenyHostnames = append(p.DenyHostnames, d.RemainingArgs()...)
+
+	case "allow_domains":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.AllowDomains = append(p.AllowDomains, d.Val())
+		p.AllowDomains = append(p.AllowDomains, d.RemainingArgs()...)
+
+	case "require_group":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		p.RequireGroup = append(p.RequireGroup, d.Val())
+		p.RequireGroup = append(p.RequireGroup, d.RemainingArgs()...)
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
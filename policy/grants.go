@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+// GrantedApps returns the application capabilities that grants give id on a
+// destination named by one of targets, such as this server's tag or host
+// name, with the parameters of every matching grant merged. Grants to "*"
+// apply to every destination
+func GrantedApps(grants []client.Grant, id Identity, targets []string) map[string][]json.RawMessage {
+	var apps map[string][]json.RawMessage
+	for _, grant := range grants {
+		if len(grant.App) == 0 || !grantsTo(grant.Dst, targets) ||
+			!slices.ContainsFunc(grant.Src, id.MatchesSelector) {
+			continue
+		}
+		if apps == nil {
+			apps = make(map[string][]json.RawMessage)
+		}
+		for name, params := range grant.App {
+			apps[name] = append(apps[name], params...)
+		}
+	}
+	return apps
+}
+
+// grantsTo reports whether a grant's destinations include one of targets
+func grantsTo(dst, targets []string) bool {
+	return slices.ContainsFunc(dst, func(selector string) bool {
+		return selector == "*" || ContainsFold(targets, selector)
+	})
+}
+
+// MatchesSelector reports whether the identity is one of the sources a policy
+// file selector names: "*", a login name, "group:<name>", "tag:<name>", an
+// address or prefix, or an autogroup. autogroup:member stands for users of
+// the tailnet, autogroup:tagged for tagged devices, autogroup:shared for
+// devices shared in from another tailnet, and other autogroups for users with
+// the role of that name, such as autogroup:admin. Host aliases are not resolved
+func (id Identity) MatchesSelector(selector string) bool {
+	device := id.Device
+	tagged := len(device.Tags) > 0
+
+	switch {
+	case selector == "*":
+		return true
+	case strings.HasPrefix(selector, "group:"):
+		return !tagged && slices.Contains(id.Groups, selector)
+	case strings.HasPrefix(selector, "tag:"):
+		return slices.Contains(device.Tags, selector)
+	case strings.HasPrefix(selector, "autogroup:"):
+		switch name := strings.TrimPrefix(selector, "autogroup:"); name {
+		case "member":
+			return !tagged && !device.IsExternal
+		case "tagged":
+			return tagged
+		case "shared":
+			return device.IsExternal
+		default:
+			return !tagged && id.User != nil && id.User.Role == name
+		}
+	case strings.Contains(selector, "@"):
+		return !tagged && strings.EqualFold(device.User, selector)
+	}
+
+	prefix, err := netip.ParsePrefix(selector)
+	if err != nil {
+		addr, err := netip.ParseAddr(selector)
+		if err != nil {
+			return false
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return slices.ContainsFunc(device.Addresses, func(address string) bool {
+		addr, err := netip.ParseAddr(address)
+		return err == nil && prefix.Contains(addr)
+	})
+}
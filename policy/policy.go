@@ -0,0 +1,222 @@
+// Package policy decides whether a resolved tailnet identity may access a
+// resource, from its device, user and group memberships.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+// Reasons a Policy denies an identity for
+const (
+	ReasonExternalDevice = "external_device"
+	ReasonIdentityType   = "identity_type"
+	ReasonRole           = "role"
+	ReasonPosture        = "posture"
+	ReasonOS             = "os"
+	ReasonHostname       = "hostname"
+	ReasonGroup          = "group"
+	ReasonDomain         = "domain"
+	ReasonOutdatedClient = "outdated_client"
+	ReasonTailnetLock    = "tailnet_lock"
+)
+
+// Identity is a resolved tailnet identity
+type Identity struct {
+	// Device is the client's device
+	Device *client.Device
+
+	// User is the device's user, or nil if users are not fetched or the device is tagged
+	User *client.User
+
+	// Groups are the groups the device's user belongs to
+	Groups []string
+}
+
+// Policy holds the access rules for identities. The zero value allows every identity
+type Policy struct {
+	// DenyExternal denies requests from devices shared into the tailnet from
+	// another tailnet (isExternal). They are allowed and labelled by default
+	DenyExternal bool `json:"deny_external,omitempty"`
+
+	// RequireIdentity restricts the route to human users ("user") or to tagged
+	// service nodes ("machine"). Requests from any other or an unidentified
+	// device are denied
+	RequireIdentity string `json:"require_identity,omitempty"`
+
+	// RequireRole restricts the route to users with one of these tailnet roles,
+	// e.g. "owner" or "admin". Requires fetch_users
+	RequireRole []string `json:"require_role,omitempty"`
+
+	// RequirePosture restricts the route to devices whose posture attributes
+	// have these values, e.g. {"custom:managed": "true"}. Requires fetch_posture
+	RequirePosture map[string]string `json:"require_posture,omitempty"`
+
+	// AllowOS restricts the route to devices running one of these operating
+	// systems, e.g. "linux", "macOS" or "windows". Matching ignores case
+	AllowOS []string `json:"allow_os,omitempty"`
+
+	// DenyOS denies devices running one of these operating systems, e.g. "iOS" or "android"
+	DenyOS []string `json:"deny_os,omitempty"`
+
+	// AllowHostnames restricts the route to devices whose hostname or name
+	// matches one of these glob patterns, e.g. "corp-*"
+	AllowHostnames []string `json:"allow_hostnames,omitempty"`
+
+	// DenyHostnames denies devices whose hostname or name matches one of these glob patterns, e.g. "*-byod"
+	DenyHostnames []string `json:"deny_hostnames,omitempty"`
+
+	// AllowDomains restricts the route to devices whose user's login name
+	// belongs to one of these domains, e.g. "example.com"
+	AllowDomains []string `json:"allow_domains,omitempty"`
+
+	// RequireGroup restricts the route to users in at least one of these groups
+	RequireGroup []string `json:"require_group,omitempty"`
+
+	// RequireUpdatedClient denies devices for which the Tailscale API reports
+	// an available client update (updateAvailable)
+	RequireUpdatedClient bool `json:"require_updated_client,omitempty"`
+
+	// RequireTailnetLockOK denies devices with a Tailnet Lock error, such as
+	// nodes whose key is not signed by a trusted lock key (tailnetLockError)
+	RequireTailnetLockOK bool `json:"require_tailnet_lock_ok,omitempty"`
+
+	// Enforce is "on" to deny identities that violate the rules, or "off" to
+	// only report them, e.g. while rolling out stricter rules (default: "on")
+	Enforce string `json:"enforce,omitempty"`
+}
+
+// Enforced reports whether violations of the rules deny access
+func (p *Policy) Enforced() bool {
+	return p.Enforce != "off"
+}
+
+// RequiresIdentity reports whether the policy can only be satisfied by an
+// identified client
+func (p *Policy) RequiresIdentity() bool {
+	return p.RequireIdentity != "" || len(p.RequireRole) > 0 || len(p.RequirePosture) > 0 ||
+		len(p.AllowOS) > 0 || len(p.AllowHostnames) > 0 || len(p.AllowDomains) > 0 || len(p.RequireGroup) > 0 ||
+		p.RequireUpdatedClient || p.RequireTailnetLockOK
+}
+
+// Validate checks that the policy is usable
+func (p *Policy) Validate() error {
+	switch p.RequireIdentity {
+	case "", "user", "machine":
+	default:
+		return fmt.Errorf("require_identity must be 'user' or 'machine', got %q", p.RequireIdentity)
+	}
+
+	switch p.Enforce {
+	case "", "on", "off":
+	default:
+		return fmt.Errorf("enforce must be 'on' or 'off', got %q", p.Enforce)
+	}
+
+	for _, pattern := range slices.Concat(p.AllowHostnames, p.DenyHostnames) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid hostname pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Check returns the reason and error of the first rule id violates, or an
+// empty reason if it satisfies all of them. Tagged devices have no role,
+// groups or login domain, whoever tagged them
+func (p *Policy) Check(id Identity) (string, error) {
+	device := id.Device
+	human := device.IdentityType() == "user"
+
+	if device.IsExternal && p.DenyExternal {
+		return ReasonExternalDevice, fmt.Errorf("device %s is shared from another tailnet", device.Name)
+	}
+
+	if p.RequireIdentity != "" && device.IdentityType() != p.RequireIdentity {
+		return ReasonIdentityType, fmt.Errorf("device %s is not a %s identity", device.Name, p.RequireIdentity)
+	}
+
+	if len(p.RequireRole) > 0 && (!human || id.User == nil || !slices.Contains(p.RequireRole, id.User.Role)) {
+		return ReasonRole, fmt.Errorf("user %s of device %s does not have a required role", device.User, device.Name)
+	}
+
+	if key, ok := p.postureMismatch(device); ok {
+		return ReasonPosture, fmt.Errorf("device %s does not satisfy posture attribute %s", device.Name, key)
+	}
+
+	if len(p.AllowOS) > 0 && !ContainsFold(p.AllowOS, device.OS) || ContainsFold(p.DenyOS, device.OS) {
+		return ReasonOS, fmt.Errorf("operating system %q of device %s is not allowed", device.OS, device.Name)
+	}
+
+	if len(p.AllowHostnames) > 0 && !MatchesHostname(device, p.AllowHostnames) || MatchesHostname(device, p.DenyHostnames) {
+		return ReasonHostname, fmt.Errorf("hostname of device %s is not allowed", device.Name)
+	}
+
+	if len(p.RequireGroup) > 0 && (!human || !slices.ContainsFunc(id.Groups, func(group string) bool {
+		return slices.Contains(p.RequireGroup, group)
+	})) {
+		return ReasonGroup, fmt.Errorf("user %s of device %s is not in a required group", device.User, device.Name)
+	}
+
+	if len(p.AllowDomains) > 0 && (!human || !ContainsFold(p.AllowDomains, LoginDomain(device.User))) {
+		return ReasonDomain, fmt.Errorf("user %s of device %s is not in an allowed domain", device.User, device.Name)
+	}
+
+	if p.RequireUpdatedClient && device.UpdateAvailable {
+		return ReasonOutdatedClient, fmt.Errorf("device %s runs Tailscale %s, for which an update is available", device.Name, device.ClientVersion)
+	}
+
+	if p.RequireTailnetLockOK && device.TailnetLockError != "" {
+		return ReasonTailnetLock, fmt.Errorf("device %s has a Tailnet Lock error: %s", device.Name, device.TailnetLockError)
+	}
+
+	return "", nil
+}
+
+// postureMismatch returns the first required posture attribute the device does not satisfy
+func (p *Policy) postureMismatch(device *client.Device) (string, bool) {
+	for key, want := range p.RequirePosture {
+		value, ok := device.PostureAttributes[key]
+		if !ok || fmt.Sprint(value) != want {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// LoginDomain returns the domain of a login name such as "alice@example.com",
+// or "" for login names without one, like those of tagged devices
+func LoginDomain(loginName string) string {
+	if i := strings.LastIndex(loginName, "@"); i >= 0 {
+		return loginName[i+1:]
+	}
+	return ""
+}
+
+// MatchesHostname reports whether the device's hostname, its MagicDNS name or
+// the first label of that name matches one of the glob patterns, ignoring case
+func MatchesHostname(d *client.Device, patterns []string) bool {
+	shortName, _, _ := strings.Cut(d.Name, ".")
+	names := []string{strings.ToLower(d.Hostname), strings.ToLower(d.Name), strings.ToLower(shortName)}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ContainsFold reports whether list contains s, ignoring case
+func ContainsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(item string) bool {
+		return strings.EqualFold(item, s)
+	})
+}
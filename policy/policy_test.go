@@ -0,0 +1,36 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+)
+
+func TestCheckTaggedDevice(t *testing.T) {
+	// A CI runner tagged by an admin in group:admins, as the API reports it
+	tagged := &client.Device{ID: "ci", Name: "ci.example.ts.net", User: "alice@example.com", Tags: []string{"tag:ci"}}
+	human := &client.Device{ID: "laptop", Name: "laptop.example.ts.net", User: "alice@example.com"}
+	alice := &client.User{LoginName: "alice@example.com", Role: "admin"}
+	groups := []string{"group:admins"}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		reason string
+	}{
+		{name: "require_role", policy: Policy{RequireRole: []string{"admin"}}, reason: ReasonRole},
+		{name: "require_group", policy: Policy{RequireGroup: []string{"group:admins"}}, reason: ReasonGroup},
+		{name: "allow_domains", policy: Policy{AllowDomains: []string{"example.com"}}, reason: ReasonDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason, err := tt.policy.Check(Identity{Device: human, User: alice, Groups: groups}); err != nil {
+				t.Errorf("user device denied: %s: %v", reason, err)
+			}
+			reason, err := tt.policy.Check(Identity{Device: tagged, User: alice, Groups: groups})
+			if reason != tt.reason {
+				t.Errorf("tagged device: Check() = %q, %v, want reason %q", reason, err, tt.reason)
+			}
+		})
+	}
+}
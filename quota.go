@@ -0,0 +1,381 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule((*Quota)(nil))
+	httpcaddyfile.RegisterHandlerDirective("tailscale_quota", parseQuotaCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_quota", httpcaddyfile.After, "basic_auth")
+}
+
+// Quota is a Caddy handler that counts requests and response bytes per
+// Tailscale identity over fixed windows and optionally enforces limits on
+// them. The identity is the one resolved by a preceding tailscale_auth
+// handler; requests without one are not counted.
+type Quota struct {
+	// Key selects what usage is counted against: "user" (the login name, or
+	// the device for tagged devices) or "node" (the device) (default: "user")
+	Key string `json:"key,omitempty"`
+
+	// Window is the length of the fixed, epoch-aligned counting windows (default: 24h)
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// MaxRequests is the number of requests an identity may make per window. Zero counts without limiting
+	MaxRequests int64 `json:"max_requests,omitempty"`
+
+	// MaxBytes is the number of response bytes an identity may receive per window. Zero counts without limiting
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// Persistence selects where counters are kept across restarts: "file",
+	// "storage" (Caddy's storage backend) or "off" (default: "off")
+	Persistence string `json:"persistence,omitempty"`
+
+	// PersistFile is the counter file used by "file" persistence, relative to
+	// Caddy's data directory (default: "tailscale_quota.json")
+	PersistFile string `json:"persist_file,omitempty"`
+
+	// PersistInterval is how often changed counters are persisted (default: 1m)
+	PersistInterval caddy.Duration `json:"persist_interval,omitempty"`
+
+	logger    *zap.Logger
+	mu        sync.Mutex
+	usage     quotaUsage
+	dirty     bool
+	store     cache.Store
+	flushStop chan struct{}
+	flushDone chan struct{}
+}
+
+// quotaUsage holds the counters of the current window
+type quotaUsage struct {
+	WindowStart time.Time                 `json:"window_start"`
+	Identities  map[string]*identityUsage `json:"identities"`
+}
+
+// identityUsage is the usage of one identity within a window
+type identityUsage struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Quota) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_quota",
+		New: func() caddy.Module { return new(Quota) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (q *Quota) Provision(ctx caddy.Context) error {
+	q.logger = ctx.Logger(q)
+
+	if q.Key == "" {
+		q.Key = "user"
+	}
+	if q.Window == 0 {
+		q.Window = caddy.Duration(24 * time.Hour)
+	}
+	if q.Persistence == "" {
+		q.Persistence = "off"
+	}
+	if q.PersistFile == "" {
+		q.PersistFile = "tailscale_quota.json"
+	}
+	if q.PersistInterval == 0 {
+		q.PersistInterval = caddy.Duration(time.Minute)
+	}
+
+	if err := initAuthMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
+	q.usage = quotaUsage{Identities: make(map[string]*identityUsage)}
+
+	switch q.Persistence {
+	case "off":
+	case "file":
+		q.store = &cache.FileStore{Path: resolveDataPath(q.PersistFile)}
+	case "storage":
+		q.store = &cache.StorageStore{Storage: ctx.Storage(), Key: path.Join("tailscale_auth", "quota.json")}
+	default:
+		return fmt.Errorf("persistence must be 'file', 'storage' or 'off', got %q", q.Persistence)
+	}
+
+	if q.store != nil {
+		if err := q.load(); err != nil {
+			q.logger.Warn("failed to load quota counters, starting empty", zap.Error(err))
+		}
+		q.flushStop = make(chan struct{})
+		q.flushDone = make(chan struct{})
+		go q.flushLoop(time.Duration(q.PersistInterval))
+	}
+
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (q *Quota) Validate() error {
+	switch q.Key {
+	case "user", "node":
+	default:
+		return fmt.Errorf("key must be 'user' or 'node', got %q", q.Key)
+	}
+
+	if q.Window < 0 || q.PersistInterval < 0 {
+		return fmt.Errorf("window and persist_interval must not be negative")
+	}
+
+	if q.MaxRequests < 0 || q.MaxBytes < 0 {
+		return fmt.Errorf("max_requests and max_bytes must not be negative")
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. It persists the counters one last time.
+func (q *Quota) Cleanup() error {
+	if q.flushStop != nil {
+		close(q.flushStop)
+		<-q.flushDone
+		q.flushStop = nil
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (q *Quota) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	identity := requestIdentity(r, q.Key)
+	if identity == "" {
+		return next.ServeHTTP(w, r)
+	}
+
+	if retryAfter, ok := q.admit(identity, time.Now()); !ok {
+		q.logger.Debug("quota exceeded", zap.String("identity", identity))
+		authMetrics.limitRejections.WithLabelValues("quota", q.Key).Inc()
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("quota exceeded for %s %s", q.Key, identity))
+	}
+	authMetrics.quotaRequests.WithLabelValues(q.Key, identity).Inc()
+
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := next.ServeHTTP(rec, r)
+
+	q.addBytes(identity, int64(rec.Size()))
+	authMetrics.quotaBytes.WithLabelValues(q.Key, identity).Add(float64(rec.Size()))
+
+	return err
+}
+
+// admit counts a request of identity if it is within its quota, or returns
+// how long until the window resets
+func (q *Quota) admit(identity string, now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	window := time.Duration(q.Window)
+	if start := now.Truncate(window); !start.Equal(q.usage.WindowStart) {
+		q.usage = quotaUsage{WindowStart: start, Identities: make(map[string]*identityUsage)}
+	}
+
+	usage := q.usage.Identities[identity]
+	if usage == nil {
+		usage = new(identityUsage)
+		q.usage.Identities[identity] = usage
+	}
+
+	if q.MaxRequests > 0 && usage.Requests >= q.MaxRequests || q.MaxBytes > 0 && usage.Bytes >= q.MaxBytes {
+		return q.usage.WindowStart.Add(window).Sub(now), false
+	}
+
+	usage.Requests++
+	q.dirty = true
+	return 0, true
+}
+
+// addBytes adds response bytes to identity's usage in the current window
+func (q *Quota) addBytes(identity string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The window may have rolled over while the response was written
+	if usage := q.usage.Identities[identity]; usage != nil {
+		usage.Bytes += n
+		q.dirty = true
+	}
+}
+
+// load restores persisted counters if they belong to the current window
+func (q *Quota) load() error {
+	data, err := q.store.Load()
+	if err != nil || data == nil {
+		return err
+	}
+
+	var usage quotaUsage
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return err
+	}
+	if usage.Identities == nil {
+		usage.Identities = make(map[string]*identityUsage)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.usage = usage
+
+	return nil
+}
+
+// flushLoop persists changed counters every interval and once more when stopped
+func (q *Quota) flushLoop(interval time.Duration) {
+	defer close(q.flushDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.flushStop:
+			q.flush()
+			return
+		case <-ticker.C:
+			q.flush()
+		}
+	}
+}
+
+// flush saves the counters if they changed since the last flush
+func (q *Quota) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.dirty {
+		return
+	}
+
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		q.logger.Error("failed to marshal quota counters", zap.Error(err))
+		return
+	}
+	if err := q.store.Save(data); err != nil {
+		q.logger.Error("failed to save quota counters", zap.Error(err))
+		return
+	}
+	q.dirty = false
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_quota [<matcher>] {
+//	    key user|node
+//	    window <duration>
+//	    max_requests <n>
+//	    max_bytes <n>
+//	    persistence file|storage|off
+//	    persist_file <path>
+//	    persist_interval <duration>
+//	}
+func (q *Quota) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				q.Key = d.Val()
+
+			case "window":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				window, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid window %q: %v", d.Val(), err)
+				}
+				q.Window = caddy.Duration(window)
+
+			case "max_requests":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxRequests, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("invalid max_requests %q: %v", d.Val(), err)
+				}
+				q.MaxRequests = maxRequests
+
+			case "max_bytes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxBytes, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("invalid max_bytes %q: %v", d.Val(), err)
+				}
+				q.MaxBytes = maxBytes
+
+			case "persistence":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				q.Persistence = d.Val()
+
+			case "persist_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				q.PersistFile = d.Val()
+
+			case "persist_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid persist_interval %q: %v", d.Val(), err)
+				}
+				q.PersistInterval = caddy.Duration(interval)
+
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseQuotaCaddyfile unmarshals tokens from h into a new Quota handler.
+func parseQuotaCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var q Quota
+	err := q.UnmarshalCaddyfile(h.Dispenser)
+	return &q, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Quota)(nil)
+	_ caddy.Validator             = (*Quota)(nil)
+	_ caddy.CleanerUpper          = (*Quota)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Quota)(nil)
+	_ caddyfile.Unmarshaler       = (*Quota)(nil)
+)
@@ -0,0 +1,313 @@
+package caddyauth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+func init() {
+	caddy.RegisterModule((*RateLimit)(nil))
+	httpcaddyfile.RegisterHandlerDirective("tailscale_rate_limit", parseRateLimitCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_rate_limit", httpcaddyfile.After, "basic_auth")
+}
+
+// rateLimitSweepInterval is how often limiters of idle identities are dropped
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a Caddy handler that limits requests per Tailscale identity
+// with a token bucket and a cap on requests in flight. The identity is the
+// one resolved by a preceding tailscale_auth handler; requests without one
+// are not limited.
+type RateLimit struct {
+	// Key selects what requests are counted against: "user" (the login name,
+	// or the device for tagged devices) or "node" (the device) (default: "user")
+	Key string `json:"key,omitempty"`
+
+	// Events is the number of requests allowed per Window. Zero disables the rate limit
+	Events int `json:"events,omitempty"`
+
+	// Window is the period Events are spread over
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// Burst is the number of requests allowed at once (default: Events)
+	Burst int `json:"burst,omitempty"`
+
+	// MaxConcurrent is the number of requests an identity may have in flight at once. Zero disables the cap
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	logger    *zap.Logger
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+	inFlight  map[string]int
+	sweepStop chan struct{}
+}
+
+// CaddyModule returns the Caddy module information.
+func (*RateLimit) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_rate_limit",
+		New: func() caddy.Module { return new(RateLimit) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (rl *RateLimit) Provision(ctx caddy.Context) error {
+	rl.logger = ctx.Logger(rl)
+
+	if rl.Key == "" {
+		rl.Key = "user"
+	}
+	if rl.Burst == 0 {
+		rl.Burst = rl.Events
+	}
+
+	if err := initAuthMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
+	rl.limiters = make(map[string]*rate.Limiter)
+	rl.inFlight = make(map[string]int)
+	rl.sweepStop = make(chan struct{})
+	go rl.sweepLoop()
+
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (rl *RateLimit) Validate() error {
+	switch rl.Key {
+	case "user", "node":
+	default:
+		return fmt.Errorf("key must be 'user' or 'node', got %q", rl.Key)
+	}
+
+	if rl.Events == 0 && rl.MaxConcurrent == 0 {
+		return fmt.Errorf("at least one of rate and max_concurrent is required")
+	}
+
+	if rl.Events < 0 || rl.Events > 0 && rl.Window <= 0 {
+		return fmt.Errorf("rate must allow a positive number of events per positive window")
+	}
+
+	if rl.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+
+	if rl.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative")
+	}
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (rl *RateLimit) Cleanup() error {
+	if rl.sweepStop != nil {
+		close(rl.sweepStop)
+		rl.sweepStop = nil
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rl *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	identity := requestIdentity(r, rl.Key)
+	if identity == "" {
+		return next.ServeHTTP(w, r)
+	}
+
+	if rl.Events > 0 {
+		reservation := rl.limiter(identity).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+
+			rl.logger.Debug("rate limit exceeded",
+				zap.String("identity", identity),
+				zap.Duration("retry_after", delay))
+			authMetrics.limitRejections.WithLabelValues("rate", rl.Key).Inc()
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded for %s %s", rl.Key, identity))
+		}
+	}
+
+	if rl.MaxConcurrent > 0 {
+		if !rl.acquire(identity) {
+			rl.logger.Debug("concurrency limit exceeded", zap.String("identity", identity))
+			authMetrics.limitRejections.WithLabelValues("concurrency", rl.Key).Inc()
+
+			return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("too many concurrent requests for %s %s", rl.Key, identity))
+		}
+		defer rl.release(identity)
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// acquire takes one of the identity's in-flight slots, reporting false if all are taken
+func (rl *RateLimit) acquire(identity string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.inFlight[identity] >= rl.MaxConcurrent {
+		return false
+	}
+	rl.inFlight[identity]++
+	return true
+}
+
+// release returns an in-flight slot taken by acquire
+func (rl *RateLimit) release(identity string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.inFlight[identity] <= 1 {
+		delete(rl.inFlight, identity)
+	} else {
+		rl.inFlight[identity]--
+	}
+}
+
+// requestIdentity returns the user or node, depending on key, that
+// tailscale_auth resolved for the request, or "" if there is none. Tagged
+// devices have no user of their own, so with key user they are counted
+// per device instead of sharing the bucket of their placeholder user
+func requestIdentity(r *http.Request, key string) string {
+	deviceID, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.device_id").(string)
+	if key == "node" {
+		return deviceID
+	}
+
+	loginName, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.login_name").(string)
+	tags, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.tags").(string)
+	if (loginName == "" || tags != "") && deviceID != "" {
+		return "node:" + deviceID
+	}
+	return loginName
+}
+
+// limiter returns the token bucket of identity, creating it on first use
+func (rl *RateLimit) limiter(identity string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limiter, ok := rl.limiters[identity]
+	if !ok {
+		every := time.Duration(rl.Window) / time.Duration(rl.Events)
+		limiter = rate.NewLimiter(rate.Every(every), rl.Burst)
+		rl.limiters[identity] = limiter
+	}
+	return limiter
+}
+
+// sweepLoop periodically drops the limiters of identities whose bucket has
+// refilled completely, since a new limiter would behave the same
+func (rl *RateLimit) sweepLoop() {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+
+	stop := rl.sweepStop
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			rl.mu.Lock()
+			for identity, limiter := range rl.limiters {
+				if limiter.TokensAt(now) >= float64(rl.Burst) {
+					delete(rl.limiters, identity)
+				}
+			}
+			rl.mu.Unlock()
+		}
+	}
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_rate_limit [<matcher>] {
+//	    key user|node
+//	    rate <events> <window>
+//	    burst <n>
+//	    max_concurrent <n>
+//	}
+func (rl *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.Key = d.Val()
+
+			case "rate":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				events, err := strconv.Atoi(args[0])
+				if err != nil {
+					return d.Errf("invalid rate events %q: %v", args[0], err)
+				}
+				window, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("invalid rate window %q: %v", args[1], err)
+				}
+				rl.Events = events
+				rl.Window = caddy.Duration(window)
+
+			case "burst":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				burst, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid burst %q: %v", d.Val(), err)
+				}
+				rl.Burst = burst
+
+			case "max_concurrent":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxConcurrent, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_concurrent %q: %v", d.Val(), err)
+				}
+				rl.MaxConcurrent = maxConcurrent
+
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseRateLimitCaddyfile unmarshals tokens from h into a new RateLimit handler.
+func parseRateLimitCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var rl RateLimit
+	err := rl.UnmarshalCaddyfile(h.Dispenser)
+	return &rl, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RateLimit)(nil)
+	_ caddy.Validator             = (*RateLimit)(nil)
+	_ caddy.CleanerUpper          = (*RateLimit)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RateLimit)(nil)
+	_ caddyfile.Unmarshaler       = (*RateLimit)(nil)
+)
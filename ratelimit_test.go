@@ -0,0 +1,58 @@
+package caddyauth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRequestIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		vars map[string]any
+		want string
+	}{
+		{
+			name: "user",
+			key:  "user",
+			vars: map[string]any{"tailscale_auth.login_name": "alice@example.com", "tailscale_auth.device_id": "d1"},
+			want: "alice@example.com",
+		},
+		{
+			name: "tagged device by user",
+			key:  "user",
+			vars: map[string]any{"tailscale_auth.login_name": "tagged-devices", "tailscale_auth.device_id": "d2", "tailscale_auth.tags": "tag:ci"},
+			want: "node:d2",
+		},
+		{
+			name: "device without a user",
+			key:  "user",
+			vars: map[string]any{"tailscale_auth.device_id": "d3"},
+			want: "node:d3",
+		},
+		{
+			name: "node",
+			key:  "node",
+			vars: map[string]any{"tailscale_auth.login_name": "alice@example.com", "tailscale_auth.device_id": "d1"},
+			want: "d1",
+		},
+		{
+			name: "unidentified",
+			key:  "user",
+			vars: map[string]any{},
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, tt.vars))
+			if got := requestIdentity(r, tt.key); got != tt.want {
+				t.Errorf("requestIdentity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
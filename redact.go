@@ -0,0 +1,168 @@
+package caddyauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactedFields are the log fields holding login names, hostnames, IP
+// addresses or request URIs
+var redactedFields = map[string]bool{
+	"client_ip": true,
+	"device":    true,
+	"identity":  true,
+	"addresses": true,
+	"hostname":  true,
+	"user":      true,
+	"uri":       true,
+}
+
+// redactedTextFields are the free-text log fields, such as webhook event
+// messages, whose personal data is redacted like in error messages
+var redactedTextFields = map[string]bool{
+	"message": true,
+}
+
+// piiPattern matches email-style login names and MagicDNS names inside error
+// messages, and candidates for IP addresses that are confirmed by parsing them
+var piiPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)+` +
+	`|[\w-]+(?:\.[\w-]+)*\.ts\.net\b` +
+	`|[0-9A-Fa-f]*[:.][0-9A-Fa-f:.]*[0-9A-Fa-f]`)
+
+// logRedactor replaces personal data in log fields with stable hashes or a mask
+type logRedactor struct {
+	mode string
+	key  []byte
+}
+
+// redact returns the replacement for a single value
+func (lr *logRedactor) redact(value string) string {
+	if value == "" {
+		return value
+	}
+	if lr.mode == "mask" {
+		return "[redacted]"
+	}
+	mac := hmac.New(sha256.New, lr.key)
+	mac.Write([]byte(value))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// redactText redacts the personal data piiPattern finds in free text
+func (lr *logRedactor) redactText(text string) string {
+	return piiPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if !strings.Contains(match, "@") && !strings.HasSuffix(match, ".ts.net") {
+			if _, err := netip.ParseAddr(match); err != nil {
+				return match
+			}
+		}
+		return lr.redact(match)
+	})
+}
+
+// redactFields returns fields with personal data redacted
+func (lr *logRedactor) redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case redactedFields[field.Key] && field.Type == zapcore.StringType:
+			field = zap.String(field.Key, lr.redact(field.String))
+		case redactedTextFields[field.Key] && field.Type == zapcore.StringType:
+			field = zap.String(field.Key, lr.redactText(field.String))
+		case redactedFields[field.Key] && field.Type == zapcore.ArrayMarshalerType:
+			if values, ok := field.Interface.(zapcore.ArrayMarshaler); ok {
+				field = zap.Array(field.Key, redactedArray{values, lr})
+			}
+		case field.Type == zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field = zap.NamedError(field.Key, errors.New(lr.redactText(err.Error())))
+			}
+		}
+		redacted[i] = field
+	}
+	return redacted
+}
+
+// redactedArray redacts every string element of a logged array
+type redactedArray struct {
+	values zapcore.ArrayMarshaler
+	lr     *logRedactor
+}
+
+func (a redactedArray) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	return a.values.MarshalLogArray(redactingArrayEncoder{enc, a.lr})
+}
+
+// redactingArrayEncoder redacts strings on their way into an array encoder
+type redactingArrayEncoder struct {
+	zapcore.ArrayEncoder
+	lr *logRedactor
+}
+
+func (e redactingArrayEncoder) AppendString(value string) {
+	e.ArrayEncoder.AppendString(e.lr.redact(value))
+}
+
+// redactCore wraps a zapcore.Core and redacts the fields of every entry
+type redactCore struct {
+	zapcore.Core
+	lr *logRedactor
+}
+
+// validateRedactLogs checks a redact_logs mode
+func validateRedactLogs(mode string) error {
+	switch mode {
+	case "", "hash", "mask":
+		return nil
+	default:
+		return fmt.Errorf("redact_logs must be 'hash' or 'mask', got %q", mode)
+	}
+}
+
+// unmarshalRedactLogs parses the arguments of redact_logs [hash|mask] [<salt>]
+func unmarshalRedactLogs(d *caddyfile.Dispenser, mode, salt *string) error {
+	*mode = "hash"
+	if d.NextArg() {
+		*mode = d.Val()
+	}
+	if d.NextArg() {
+		*salt = d.Val()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// newRedactingLogger returns logger with personal data in its fields redacted
+func newRedactingLogger(logger *zap.Logger, mode, salt string) *zap.Logger {
+	lr := &logRedactor{mode: mode, key: []byte(salt)}
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactCore{Core: core, lr: lr}
+	}))
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.lr.redactFields(fields)), lr: c.lr}
+}
+
+func (c *redactCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, c.lr.redactFields(fields))
+}
@@ -0,0 +1,40 @@
+package caddyauth
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactingLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := newRedactingLogger(zap.New(core), "mask", "")
+
+	logger.Info("handled request",
+		zap.String("user", "alice@example.com"),
+		zap.String("hostname", "laptop"),
+		zap.String("uri", "/users/alice"),
+		zap.String("message", "Node laptop.tail1234.ts.net of alice@example.com at 100.64.0.1 was approved"),
+		zap.String("method", "GET"))
+
+	fields := logs.All()[0].ContextMap()
+	for _, key := range []string{"user", "hostname", "uri"} {
+		if fields[key] != "[redacted]" {
+			t.Errorf("%s = %v, want it redacted", key, fields[key])
+		}
+	}
+	message := fields["message"].(string)
+	for _, pii := range []string{"alice@example.com", "laptop.tail1234.ts.net", "100.64.0.1"} {
+		if strings.Contains(message, pii) {
+			t.Errorf("message %q contains %s", message, pii)
+		}
+	}
+	if !strings.Contains(message, "was approved") {
+		t.Errorf("message %q lost its text", message)
+	}
+	if fields["method"] != "GET" {
+		t.Errorf("method = %v, want it kept", fields["method"])
+	}
+}
@@ -0,0 +1,314 @@
+package caddyauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"tailscale.com/client/local"
+)
+
+// Sources a resolver chain can look client IPs up in
+const (
+	sourceLocalAPI = "localapi"
+	sourceREST     = "rest"
+	sourceCLI      = "cli"
+	sourceStale    = "stale"
+)
+
+var (
+	// errRefresh wraps the errors of failed cache refreshes
+	errRefresh = errors.New("failed to refresh device cache")
+
+	// errDeviceNotFound is returned for addresses that a successful refresh did
+	// not find. It ends a resolver chain, since later sources know no more
+	errDeviceNotFound = errors.New("device not found")
+)
+
+// ResolverConfig is one source in the chain a handler resolves client IPs
+// through. Sources are tried in order until one identifies the client
+type ResolverConfig struct {
+	// Source is "localapi" (the LocalAPI of the host's tailscaled), "rest"
+	// (the device cache, refreshed through the Tailscale API), "cli" (the
+	// output of `tailscale status --json`) or "stale" (the device cache as
+	// it is, without refreshing it)
+	Source string `json:"source"`
+
+	// Timeout bounds each lookup in this source (default: 5s for localapi
+	// and cli, 30s for rest and stale)
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	// MaxAge makes rest refresh caches that are older than this before
+	// trusting their entries, leaving older entries to stale (rest only)
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Socket is the tailscaled LocalAPI socket (localapi only, default: the platform's)
+	Socket string `json:"socket,omitempty"`
+
+	// Binary is the tailscale CLI (cli only, default: "tailscale")
+	Binary string `json:"binary,omitempty"`
+}
+
+// validate checks the options of the source
+func (c *ResolverConfig) validate() error {
+	switch c.Source {
+	case sourceLocalAPI, sourceREST, sourceCLI, sourceStale:
+	default:
+		return fmt.Errorf("resolver source must be 'localapi', 'rest', 'cli' or 'stale', got %q", c.Source)
+	}
+	if c.Timeout < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("resolver %s: timeout and max_age must not be negative", c.Source)
+	}
+	if c.MaxAge != 0 && c.Source != sourceREST {
+		return fmt.Errorf("resolver %s: max_age only applies to rest", c.Source)
+	}
+	if c.Socket != "" && c.Source != sourceLocalAPI {
+		return fmt.Errorf("resolver %s: socket only applies to localapi", c.Source)
+	}
+	if c.Binary != "" && c.Source != sourceCLI {
+		return fmt.Errorf("resolver %s: binary only applies to cli", c.Source)
+	}
+	return nil
+}
+
+// resolver looks up the identity behind a client IP in one source
+type resolver interface {
+	resolve(ctx context.Context, clientIP string) (*deviceMatch, error)
+}
+
+// chainedResolver is a source of the handler's resolver chain
+type chainedResolver struct {
+	resolver
+	source  string
+	timeout time.Duration
+}
+
+// provisionResolvers sets up the resolver chain. Without resolvers, the
+// device caches are used, followed by the CLI with cli_fallback and by the
+// stale caches with serve_stale
+func (t *TailscaleAuth) provisionResolvers() error {
+	if t.ServeStale < 0 {
+		return fmt.Errorf("serve_stale must not be negative")
+	}
+
+	configs := t.Resolvers
+	if len(configs) == 0 {
+		configs = []*ResolverConfig{{Source: sourceREST, MaxAge: t.ServeStale}}
+		if t.CLIFallback != "" {
+			configs = append(configs, &ResolverConfig{Source: sourceCLI, Binary: t.CLIFallback})
+		}
+		if t.ServeStale != 0 {
+			configs = append(configs, &ResolverConfig{Source: sourceStale})
+		}
+	} else if t.CLIFallback != "" {
+		return fmt.Errorf("cli_fallback cannot be combined with resolvers, add a cli resolver instead")
+	} else if t.ServeStale != 0 {
+		return fmt.Errorf("serve_stale cannot be combined with resolvers, add max_age to rest and a stale resolver instead")
+	}
+
+	seen := make(map[string]bool)
+	t.resolvers = nil
+	for _, cfg := range configs {
+		if cfg == nil {
+			return fmt.Errorf("resolver: configuration is empty")
+		}
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		if seen[cfg.Source] {
+			return fmt.Errorf("resolver %s is listed more than once", cfg.Source)
+		}
+		seen[cfg.Source] = true
+
+		r := chainedResolver{source: cfg.Source, timeout: time.Duration(cfg.Timeout)}
+		switch cfg.Source {
+		case sourceLocalAPI:
+			r.resolver = &localAPIResolver{client: &local.Client{Socket: cfg.Socket}}
+		case sourceREST:
+			r.resolver = &restResolver{caches: t.caches, maxAge: time.Duration(cfg.MaxAge)}
+		case sourceCLI:
+			binary := cfg.Binary
+			if binary == "" {
+				binary = "tailscale"
+			}
+			r.resolver = &cliResolver{binary: binary}
+		case sourceStale:
+			r.resolver = &staleResolver{caches: t.caches}
+		}
+		if r.timeout == 0 {
+			r.timeout = refreshTimeout
+			if cfg.Source == sourceLocalAPI || cfg.Source == sourceCLI {
+				r.timeout = whoisTimeout
+			}
+		}
+		t.resolvers = append(t.resolvers, r)
+	}
+	return nil
+}
+
+// resolve identifies clientIP through the resolver chain. A source that
+// fails passes the lookup on to the next one, unless the REST API reported
+// that the address belongs to no device
+func (t *TailscaleAuth) resolve(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	var errs []error
+	for i, r := range t.resolvers {
+		match, err := r.lookup(ctx, clientIP)
+		if err == nil {
+			err = t.checkExpectedTailnet(clientIP, match)
+		}
+		if err == nil {
+			t.logDegradation(clientIP, match, errs)
+			if i > 0 && !match.stale {
+				t.logger.Warn("identified client through a fallback resolver",
+					zap.String("client_ip", clientIP),
+					zap.String("resolver", r.source),
+					zap.Error(errors.Join(errs...)))
+			}
+			return match, nil
+		}
+
+		if len(t.resolvers) > 1 {
+			err = fmt.Errorf("%s: %w", r.source, err)
+		}
+		errs = append(errs, err)
+		if errors.Is(err, errDeviceNotFound) || errors.Is(err, errNotTailnetAddr) {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// lookup resolves clientIP within the source's timeout, or until ctx ends
+func (r chainedResolver) lookup(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	return r.resolve(ctx, clientIP)
+}
+
+// localAPIResolver identifies clients through the LocalAPI of the host's tailscaled
+type localAPIResolver struct {
+	client *local.Client
+}
+
+func (r *localAPIResolver) resolve(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	return localWhois(ctx, r.client, clientIP)
+}
+
+// restResolver looks the client IP up in every tailnet's cache and only
+// refreshes the tailnets in order if none of them knows it
+type restResolver struct {
+	caches []*tailnetCache
+	maxAge time.Duration
+}
+
+func (r *restResolver) resolve(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	for _, cache := range r.caches {
+		if match, ok := cache.match(clientIP); ok && cache.fresh(r.maxAge) {
+			cache.hits.record(true)
+			return match, nil
+		}
+	}
+
+	var errs []error
+	for _, cache := range r.caches {
+		match, err := cache.get(ctx, clientIP, r.maxAge)
+		if err == nil {
+			return match, nil
+		}
+		errs = append(errs, fmt.Errorf("tailnet %s: %w", cache.tailnet, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// staleResolver answers from the device caches however old they are, without
+// calling the API
+type staleResolver struct {
+	caches []*tailnetCache
+}
+
+func (r *staleResolver) resolve(_ context.Context, clientIP string) (*deviceMatch, error) {
+	for _, cache := range r.caches {
+		if match, ok := cache.match(clientIP); ok {
+			match.stale = true
+			return match, nil
+		}
+	}
+	return nil, fmt.Errorf("no cached device for %s", clientIP)
+}
+
+// logDegradation logs when the handler starts identifying clients from stale
+// caches and when it stops, instead of warning about every stale request
+func (t *TailscaleAuth) logDegradation(clientIP string, match *deviceMatch, errs []error) {
+	if !match.stale {
+		if t.degraded.CompareAndSwap(true, false) {
+			t.logger.Info("device cache refreshed, no longer serving stale identities")
+		}
+		return
+	}
+
+	fields := []zap.Field{zap.String("client_ip", clientIP), zap.String("tailnet", match.tailnet)}
+	if refreshed := match.cache.lastRefresh.Load(); refreshed != 0 {
+		fields = append(fields, zap.Duration("cache_age", time.Since(time.Unix(0, refreshed))))
+	}
+	fields = append(fields, zap.Error(errors.Join(errs...)))
+	if t.degraded.CompareAndSwap(false, true) {
+		t.logger.Warn("device cache cannot be refreshed, serving stale identities until it can", fields...)
+		return
+	}
+	t.logger.Debug("serving stale identity", fields...)
+}
+
+// unmarshalResolvers parses a resolvers { <source> { ... } } block
+func unmarshalResolvers(d *caddyfile.Dispenser) ([]*ResolverConfig, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	var configs []*ResolverConfig
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		cfg := &ResolverConfig{Source: d.Val()}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		for sourceNesting := d.Nesting(); d.NextBlock(sourceNesting); {
+			option := d.Val()
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			switch option {
+			case "timeout", "max_age":
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return nil, d.Errf("invalid %s %q: %v", option, d.Val(), err)
+				}
+				if option == "timeout" {
+					cfg.Timeout = caddy.Duration(dur)
+				} else {
+					cfg.MaxAge = caddy.Duration(dur)
+				}
+
+			case "socket":
+				cfg.Socket = d.Val()
+
+			case "binary":
+				cfg.Binary = d.Val()
+
+			default:
+				return nil, d.Errf("unrecognized %s resolver option: %s", cfg.Source, option)
+			}
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
@@ -0,0 +1,42 @@
+package caddyauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// blockingResolver waits for its lookup context to end
+type blockingResolver struct{}
+
+func (blockingResolver) resolve(ctx context.Context, _ string) (*deviceMatch, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestResolveEndsWithRequest(t *testing.T) {
+	ts := &TailscaleAuth{
+		logger:    zap.NewNop(),
+		resolvers: []chainedResolver{{resolver: blockingResolver{}, source: sourceLocalAPI, timeout: time.Minute}},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ts.getDevice(ctx, "100.64.0.1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("getDevice = %v, want the request's cancellation", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup outlived its request")
+	}
+}
@@ -0,0 +1,119 @@
+package caddyauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// defaultMaxHeaderLength caps header values unless max_header_length is set
+const defaultMaxHeaderLength = 2048
+
+// validateHeaderSanitize checks header_sanitize and max_header_length
+func (t *TailscaleAuth) validateHeaderSanitize() error {
+	switch t.HeaderSanitize {
+	case "", "truncate", "drop", "encode":
+	default:
+		return fmt.Errorf("header_sanitize must be 'truncate', 'drop' or 'encode', got %q", t.HeaderSanitize)
+	}
+	if t.MaxHeaderLength < 0 {
+		return fmt.Errorf("max_header_length must not be negative")
+	}
+	return nil
+}
+
+// setSanitizedHeader sets the request header name to value after applying
+// header_sanitize and max_header_length, or leaves it out with drop
+func (t *TailscaleAuth) setSanitizedHeader(r *http.Request, name, value string) {
+	sanitized, ok := t.sanitizeHeaderValue(value)
+	if !ok {
+		t.logger.Debug("dropped unsafe header value", zap.String("header", name))
+		return
+	}
+	if sanitized != value {
+		t.logger.Debug("sanitized header value", zap.String("header", name))
+	}
+	r.Header.Set(name, sanitized)
+}
+
+// setSanitizedList sets the request header name to values, comma-joined or,
+// with multi_value repeat, once per value
+func (t *TailscaleAuth) setSanitizedList(r *http.Request, name string, values []string) {
+	if t.MultiValue != "repeat" {
+		t.setSanitizedHeader(r, name, strings.Join(values, ","))
+		return
+	}
+
+	r.Header.Del(name)
+	for _, value := range values {
+		sanitized, ok := t.sanitizeHeaderValue(value)
+		if !ok {
+			t.logger.Debug("dropped unsafe header value", zap.String("header", name))
+			continue
+		}
+		r.Header.Add(name, sanitized)
+	}
+}
+
+// sanitizeHeaderValue makes value safe to send: truncate strips control
+// characters such as CR and LF and cuts the value to the maximum length,
+// encode percent-encodes them and '%' before cutting, and drop reports
+// false for values needing either
+func (t *TailscaleAuth) sanitizeHeaderValue(value string) (string, bool) {
+	maxLength := t.MaxHeaderLength
+	if maxLength == 0 {
+		maxLength = defaultMaxHeaderLength
+	}
+
+	switch t.HeaderSanitize {
+	case "drop":
+		if len(value) > maxLength || strings.IndexFunc(value, isControl) >= 0 {
+			return "", false
+		}
+		return value, true
+
+	case "encode":
+		var b strings.Builder
+		for i := 0; i < len(value); i++ {
+			if c := value[i]; c < 0x20 || c == 0x7f || c == '%' {
+				fmt.Fprintf(&b, "%%%02X", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+		encoded := truncateUTF8(b.String(), maxLength)
+		// Do not leave a partial escape at the end
+		if i := strings.LastIndexByte(encoded, '%'); i >= 0 && i > len(encoded)-3 {
+			encoded = encoded[:i]
+		}
+		return encoded, true
+
+	default:
+		return truncateUTF8(strings.Map(func(r rune) rune {
+			if isControl(r) {
+				return -1
+			}
+			return r
+		}, value), maxLength), true
+	}
+}
+
+// isControl reports whether r is an ASCII control character, which header
+// values must not contain
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
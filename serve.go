@@ -0,0 +1,124 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Headers tailscaled's Serve proxy sets on the requests it forwards
+const (
+	serveFunnelHeader     = "Tailscale-Funnel-Request"
+	serveLoginHeader      = "Tailscale-User-Login"
+	serveNameHeader       = "Tailscale-User-Name"
+	serveProfilePicHeader = "Tailscale-User-Profile-Pic"
+	serveCapsHeader       = "Tailscale-App-Capabilities"
+)
+
+// fromServeProxy reports whether the request came in over loopback, where
+// tailscaled's Serve proxy connects from. tailscaled always overwrites its
+// headers, but clients reaching Caddy directly could forge them
+func fromServeProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, ok := parseClientAddr(host)
+	return ok && addr.IsLoopback()
+}
+
+// isFunnelRequest reports whether tailscaled's Serve proxy marked the request
+// as coming in through Funnel
+func isFunnelRequest(r *http.Request) bool {
+	return r.Header.Get(serveFunnelHeader) == "?1" && fromServeProxy(r)
+}
+
+// serveIdentity returns the user identity tailscaled's Serve proxy attached to
+// the request. Serve only sets it for user devices, so tagged nodes and
+// Funnel requests have none
+func serveIdentity(r *http.Request) (*deviceMatch, bool) {
+	login := decodeServeHeader(r.Header.Get(serveLoginHeader))
+	if login == "" || !fromServeProxy(r) {
+		return nil, false
+	}
+
+	user := &User{
+		LoginName:   login,
+		DisplayName: decodeServeHeader(r.Header.Get(serveNameHeader)),
+	}
+	device := &Device{User: login, Capabilities: serveCapabilities(r)}
+	return &deviceMatch{device: device, user: user}, true
+}
+
+// serveCapabilities returns the names of the app capabilities Serve passed
+// on, which are only those the Serve configuration accepts
+func serveCapabilities(r *http.Request) []string {
+	value := r.Header.Get(serveCapsHeader)
+	if value == "" {
+		return nil
+	}
+
+	var caps map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(decodeServeHeader(value)), &caps); err != nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(caps))
+}
+
+// decodeServeHeader decodes the RFC 2047 encoding tailscaled uses for
+// non-ASCII header values
+func decodeServeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// addServeHeaders adds the user information of a Serve identity to request
+// headers. Device headers are left out, since Serve does not pass on the device
+func (t *TailscaleAuth) addServeHeaders(r *http.Request, match *deviceMatch) {
+	user := match.user
+
+	t.setHeader(r, "Identity-Type", "user")
+	if groups := t.userGroups(match); len(groups) > 0 {
+		t.setListHeader(r, "Groups", groups)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.groups", strings.Join(groups, ","))
+	}
+
+	t.setHeader(r, "User-LoginName", t.localUsername(user.LoginName))
+	t.setHeader(r, "Device-User", t.localUsername(user.LoginName))
+	if t.pseudonymKey == nil {
+		t.setHeader(r, "User-DisplayName", user.DisplayName)
+		if pic := r.Header.Get(serveProfilePicHeader); pic != "" {
+			t.setHeader(r, "User-ProfilePicURL", pic)
+		}
+	}
+
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.username", t.localUsername(user.LoginName))
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.login_name", user.LoginName)
+	t.setAuthUser(r, user.LoginName)
+	t.addRemoteUserHeaders(r, match, user.LoginName, user.DisplayName)
+	t.setHeader(r, "Decision-ID", t.decisionID(r))
+
+	if caps := match.device.Capabilities; len(caps) > 0 {
+		t.setListHeader(r, "Device-Capabilities", caps)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.capabilities", strings.Join(caps, ","))
+	}
+
+	if t.authpKey != nil {
+		t.addAuthpToken(r, match)
+	}
+	if len(t.upstreamTokens) > 0 {
+		t.addUpstreamToken(r, match)
+	}
+	if len(t.upstreamPasswords) > 0 {
+		t.addUpstreamBasicAuth(r, match)
+	}
+}
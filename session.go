@@ -0,0 +1,227 @@
+package caddyauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+// maxSessionCookieSize keeps session cookies below the 4096 byte limit browsers enforce
+const maxSessionCookieSize = 3800
+
+// sessionClaims is the encrypted content of a session cookie: the identity a
+// client IP was resolved to, bound to the handler configuration
+type sessionClaims struct {
+	IP              string   `json:"ip"`
+	Expires         int64    `json:"exp"`
+	Config          string   `json:"cfg"`
+	Tailnet         string   `json:"tn"`
+	DeviceID        string   `json:"did"`
+	Device          *Device  `json:"dev,omitempty"`
+	User            *User    `json:"usr,omitempty"`
+	Groups          []string `json:"grp,omitempty"`
+	ViaSubnetRouter bool     `json:"via,omitempty"`
+	SiteID          uint32   `json:"sid,omitempty"`
+	SiteAddr        string   `json:"sad,omitempty"`
+	Cached          bool     `json:"cch,omitempty"`
+}
+
+// provisionSession sets up the session cookie encryption key and the
+// fingerprint that invalidates cookies when the handler configuration or
+// one of its policies changes
+func (t *TailscaleAuth) provisionSession() error {
+	if t.SessionCookieName == "" {
+		t.SessionCookieName = "tailscale_auth_session"
+	}
+
+	secret := []byte(caddy.NewReplacer().ReplaceAll(t.SessionSecret, ""))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("failed to generate session key: %w", err)
+		}
+	}
+	key, err := hkdf.Key(sha256.New, secret, nil, "tailscale_auth session cookie", 32)
+	if err != nil {
+		return fmt.Errorf("failed to derive session key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("failed to create session cipher: %w", err)
+	}
+	if t.sessionAEAD, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("failed to create session cipher: %w", err)
+	}
+
+	policies := make(map[string]*policy.Policy)
+	for name, p := range t.namedPolicies() {
+		policies[name] = p
+	}
+	config, err := json.Marshal(struct {
+		Handler  *TailscaleAuth            `json:"handler"`
+		Policies map[string]*policy.Policy `json:"policies"`
+	}{t, policies})
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint configuration: %w", err)
+	}
+	sum := sha256.Sum256(config)
+	t.sessionConfig = hex.EncodeToString(sum[:8])
+
+	return nil
+}
+
+// takeSessionCookie removes the session cookie from the request, so it never
+// reaches the upstream, and returns its value
+func (t *TailscaleAuth) takeSessionCookie(r *http.Request) string {
+	if t.sessionAEAD == nil || len(r.Header.Values("Cookie")) == 0 {
+		return ""
+	}
+
+	var session string
+	var kept []string
+	for _, line := range r.Header.Values("Cookie") {
+		var parts []string
+		for part := range strings.SplitSeq(line, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == t.SessionCookieName {
+				if session == "" {
+					session = value
+				}
+				continue
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) > 0 {
+			kept = append(kept, strings.TrimSpace(strings.Join(parts, ";")))
+		}
+	}
+
+	r.Header.Del("Cookie")
+	for _, line := range kept {
+		r.Header.Add("Cookie", line)
+	}
+	return session
+}
+
+// sessionMatch returns the identity of a valid session cookie that was issued
+// to clientIP, which stands in for the lookup until the cookie expires. The
+// identity goes through the same checks and policies as a looked up one
+func (t *TailscaleAuth) sessionMatch(session, clientIP string) (*deviceMatch, bool) {
+	if session == "" {
+		return nil, false
+	}
+	claims, ok := t.openSession(session)
+	if !ok || claims.IP != canonicalIP(clientIP) || claims.Config != t.sessionConfig || time.Now().Unix() >= claims.Expires {
+		return nil, false
+	}
+
+	if claims.Device == nil || claims.Device.ID != claims.DeviceID ||
+		t.MaxLastSeen != 0 && !claims.Device.SeenWithin(time.Duration(t.MaxLastSeen), time.Now()) {
+		return nil, false
+	}
+	match := &deviceMatch{
+		device:          claims.Device,
+		tailnet:         claims.Tailnet,
+		viaSubnetRouter: claims.ViaSubnetRouter,
+		user:            claims.User,
+		groups:          claims.Groups,
+		siteID:          claims.SiteID,
+	}
+	if addr, err := netip.ParseAddr(claims.SiteAddr); err == nil {
+		match.siteAddr = addr
+	}
+
+	// Identities from a tailnet cache keep it for max_cache_age and refetches,
+	// and take its current grants
+	if claims.Cached {
+		for _, c := range t.caches {
+			if c.tailnet != claims.Tailnet {
+				continue
+			}
+			match.cache = c
+			if c.fetchGrants {
+				match.grants = c.lookupGrants()
+			}
+			break
+		}
+	}
+	return match, true
+}
+
+// setSessionCookie issues a session cookie for an allowed request
+func (t *TailscaleAuth) setSessionCookie(w http.ResponseWriter, r *http.Request, clientIP string, match *deviceMatch) {
+	claims := sessionClaims{
+		IP:              canonicalIP(clientIP),
+		Expires:         time.Now().Add(time.Duration(t.SessionCookie)).Unix(),
+		Config:          t.sessionConfig,
+		Tailnet:         match.tailnet,
+		DeviceID:        match.device.ID,
+		Device:          match.device,
+		User:            match.user,
+		Groups:          match.groups,
+		ViaSubnetRouter: match.viaSubnetRouter,
+		SiteID:          match.siteID,
+		Cached:          match.cache != nil,
+	}
+	if match.siteAddr.IsValid() {
+		claims.SiteAddr = match.siteAddr.String()
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		t.logger.Error("failed to marshal session", zap.Error(err))
+		return
+	}
+	nonce := make([]byte, t.sessionAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.logger.Error("failed to generate session nonce", zap.Error(err))
+		return
+	}
+	value := base64.RawURLEncoding.EncodeToString(t.sessionAEAD.Seal(nonce, nonce, data, nil))
+	if len(value) > maxSessionCookieSize {
+		t.logger.Debug("identity too large for a session cookie", zap.String("device", match.device.Name))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.SessionCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(time.Duration(t.SessionCookie).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// openSession decrypts and authenticates a session cookie value
+func (t *TailscaleAuth) openSession(session string) (*sessionClaims, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(session)
+	if err != nil || len(data) < t.sessionAEAD.NonceSize() {
+		return nil, false
+	}
+	nonce, sealed := data[:t.sessionAEAD.NonceSize()], data[t.sessionAEAD.NonceSize():]
+	data, err = t.sessionAEAD.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, false
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, false
+	}
+	return &claims, true
+}
@@ -0,0 +1,127 @@
+package caddyauth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+	"go.uber.org/zap"
+)
+
+func newSessionHandler(t *testing.T, devices map[string]*Device) *TailscaleAuth {
+	t.Helper()
+	ts := &TailscaleAuth{
+		SessionCookie: caddy.Duration(time.Minute),
+		SessionSecret: "secret",
+		logger:        zap.NewNop(),
+		caches: []*tailnetCache{{
+			tailnet: "example.com",
+			logger:  zap.NewNop(),
+			devices: &DeviceCache{IPToDevice: devices},
+		}},
+	}
+	if err := ts.provisionSession(); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func issueSession(t *testing.T, ts *TailscaleAuth, clientIP string, match *deviceMatch) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	ts.setSessionCookie(w, httptest.NewRequest("GET", "/", nil), clientIP, match)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	return cookies[0].Value
+}
+
+func TestSessionCachedDevice(t *testing.T) {
+	device := &Device{ID: "dev1", Name: "laptop", User: "alice@example.com"}
+	ts := newSessionHandler(t, map[string]*Device{"100.64.0.1": device})
+	match, ok := ts.caches[0].match("100.64.0.1")
+	if !ok {
+		t.Fatal("device not cached")
+	}
+	session := issueSession(t, ts, "100.64.0.1", match)
+
+	if strings.Contains(session, "alice") {
+		t.Errorf("session cookie exposes the identity: %s", session)
+	}
+	claims, ok := ts.openSession(session)
+	if !ok {
+		t.Fatal("session does not decrypt")
+	}
+	if claims.Device == nil || claims.DeviceID != "dev1" || !claims.Cached {
+		t.Errorf("claims of a cached device = %+v, want the device", claims)
+	}
+
+	if got, ok := ts.sessionMatch(session, "100.64.0.1"); !ok || got.device.ID != "dev1" || got.cache != ts.caches[0] {
+		t.Errorf("sessionMatch = %v, %v, want the device tied to its cache", got, ok)
+	}
+	if _, ok := ts.sessionMatch(session, "100.64.0.2"); ok {
+		t.Error("session accepted from another client IP")
+	}
+	if _, ok := ts.sessionMatch(session[:len(session)-2]+"AA", "100.64.0.1"); ok {
+		t.Error("tampered session accepted")
+	}
+
+	// The cookie stands in for the lookup until it expires
+	ts.caches[0].devices.IPToDevice = map[string]*Device{}
+	if got, ok := ts.sessionMatch(session, "100.64.0.1"); !ok || got.device.User != "alice@example.com" {
+		t.Errorf("sessionMatch = %v, %v, want the device from the cookie without a lookup", got, ok)
+	}
+}
+
+func TestSessionUncachedDevice(t *testing.T) {
+	ts := newSessionHandler(t, nil)
+	device := &Device{ID: "node1", Name: "server", User: "bob@example.com", LastSeen: time.Now().Add(-time.Hour).Format(time.RFC3339)}
+	session := issueSession(t, ts, "100.64.0.3", &deviceMatch{device: device, tailnet: "example.com"})
+
+	got, ok := ts.sessionMatch(session, "100.64.0.3")
+	if !ok || got.device.ID != "node1" || got.device.User != "bob@example.com" {
+		t.Fatalf("sessionMatch = %v, %v, want the device from the cookie", got, ok)
+	}
+
+	ts.MaxLastSeen = caddy.Duration(time.Minute)
+	if _, ok := ts.sessionMatch(session, "100.64.0.3"); ok {
+		t.Error("session accepted for a device not seen within max_last_seen")
+	}
+}
+
+func TestSessionConfigFingerprint(t *testing.T) {
+	ts := newSessionHandler(t, nil)
+	admins := &policy.Policy{RequireRole: []string{"admin"}}
+	ts.Policies = []string{"admins"}
+	ts.policies = []*policy.Policy{admins}
+	if err := ts.provisionSession(); err != nil {
+		t.Fatal(err)
+	}
+	before := ts.sessionConfig
+
+	admins.RequireRole = []string{"admin", "member"}
+	if err := ts.provisionSession(); err != nil {
+		t.Fatal(err)
+	}
+	if ts.sessionConfig == before {
+		t.Error("fingerprint does not change with the contents of a named policy")
+	}
+}
+
+func TestTakeSessionCookie(t *testing.T) {
+	ts := newSessionHandler(t, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("Cookie", "a=1; tailscale_auth_session=abc; b=2")
+	r.Header.Add("Cookie", "tailscale_auth_session=def")
+
+	if got := ts.takeSessionCookie(r); got != "abc" {
+		t.Errorf("takeSessionCookie = %q, want %q", got, "abc")
+	}
+	if got := r.Header.Values("Cookie"); len(got) != 1 || got[0] != "a=1; b=2" {
+		t.Errorf("Cookie = %q, want the other cookies only", got)
+	}
+}
@@ -0,0 +1,284 @@
+package caddyauth
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
+)
+
+// liveHandlers holds the provisioned handlers, in provisioning order, so
+// that test-policy can evaluate their rules
+var liveHandlers handlerRegistry
+
+// handlerRegistry is a set of provisioned handlers
+type handlerRegistry struct {
+	mu       sync.Mutex
+	handlers []*TailscaleAuth
+}
+
+// add registers a provisioned handler
+func (h *handlerRegistry) add(t *TailscaleAuth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers = append(h.handlers, t)
+}
+
+// remove unregisters a handler that is cleaned up
+func (h *handlerRegistry) remove(t *TailscaleAuth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers = slices.DeleteFunc(h.handlers, func(other *TailscaleAuth) bool { return other == t })
+}
+
+// list returns the registered handlers
+func (h *handlerRegistry) list() []*TailscaleAuth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.handlers)
+}
+
+// policyTest is the synthetic identity and request evaluated by test-policy
+type policyTest struct {
+	User             string            `json:"user,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	Groups           []string          `json:"groups,omitempty"`
+	Role             string            `json:"role,omitempty"`
+	OS               string            `json:"os,omitempty"`
+	Hostname         string            `json:"hostname,omitempty"`
+	Tailnet          string            `json:"tailnet,omitempty"`
+	External         bool              `json:"external,omitempty"`
+	Posture          map[string]string `json:"posture,omitempty"`
+	UpdateAvailable  bool              `json:"update_available,omitempty"`
+	TailnetLockError string            `json:"tailnet_lock_error,omitempty"`
+	Method           string            `json:"method,omitempty"`
+	Path             string            `json:"path,omitempty"`
+}
+
+// policyTestResult is the outcome of test-policy for every live handler and
+// every named policy of the tailscale_auth app
+type policyTestResult struct {
+	IdentityType string              `json:"identity_type"`
+	Handlers     []handlerTestResult `json:"handlers"`
+	Policies     []ruleTestResult    `json:"policies"`
+}
+
+// handlerTestResult is a handler's decision on the synthetic request. Handlers
+// are numbered in the order they were provisioned in
+type handlerTestResult struct {
+	Handler   int              `json:"handler"`
+	Tailnet   string           `json:"tailnet,omitempty"`
+	Policies  []string         `json:"policies,omitempty"`
+	Decision  string           `json:"decision"`
+	Policy    string           `json:"policy,omitempty"`
+	Reason    string           `json:"reason,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	WouldDeny []ruleTestResult `json:"would_deny,omitempty"`
+}
+
+// ruleTestResult is the decision of one set of rules: a named policy, or the
+// handler's own rules if Policy is empty
+type ruleTestResult struct {
+	Policy   string `json:"policy,omitempty"`
+	Enforce  string `json:"enforce"`
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// identity returns the synthetic identity of the test. Tagged devices have
+// neither a user nor groups, like in the API
+func (pt *policyTest) identity() (*deviceMatch, error) {
+	if pt.User == "" && len(pt.Tags) == 0 {
+		return nil, fmt.Errorf("a user or at least one tag is required")
+	}
+	for _, tag := range pt.Tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return nil, fmt.Errorf("tag %q must start with 'tag:'", tag)
+		}
+	}
+
+	name := cmp.Or(pt.Hostname, "test-device")
+	device := &Device{
+		ID:               "test",
+		Name:             name,
+		Hostname:         name,
+		User:             pt.User,
+		Tags:             pt.Tags,
+		OS:               pt.OS,
+		IsExternal:       pt.External,
+		UpdateAvailable:  pt.UpdateAvailable,
+		TailnetLockError: pt.TailnetLockError,
+	}
+	if len(pt.Posture) > 0 {
+		device.PostureAttributes = make(map[string]any, len(pt.Posture))
+		for key, value := range pt.Posture {
+			device.PostureAttributes[key] = value
+		}
+	}
+
+	match := &deviceMatch{device: device, tailnet: pt.Tailnet}
+	if len(pt.Tags) == 0 {
+		match.user = &User{LoginName: pt.User, Role: pt.Role}
+		match.groups = pt.Groups
+	}
+	return match, nil
+}
+
+// request returns the synthetic request of the test, for skip_paths and skip_methods
+func (pt *policyTest) request() (*http.Request, error) {
+	method := cmp.Or(strings.ToUpper(pt.Method), http.MethodGet)
+	path := cmp.Or(pt.Path, "/")
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with '/'", path)
+	}
+	r := httptest.NewRequest(method, path, nil)
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())), nil
+}
+
+// testPolicies evaluates the handler's skip rules, expected_tailnet and
+// policies the way ServeHTTP does, without logging, metering or recording
+// anything. Checks of the device's live state, such as key expiry, are not
+// simulated
+func (t *TailscaleAuth) testPolicies(r *http.Request, match *deviceMatch) handlerTestResult {
+	result := handlerTestResult{Tailnet: cmp.Or(t.Use, t.Tailnet), Policies: t.Policies}
+
+	skip, err := t.skipRequest(r)
+	if err != nil {
+		result.Decision = "error"
+		result.Error = err.Error()
+		return result
+	}
+	if skip {
+		result.Decision = "skip"
+		return result
+	}
+
+	if t.ExpectedTailnet != "" && match.tailnet != "" && !strings.EqualFold(match.tailnet, t.ExpectedTailnet) {
+		result.Decision = "deny"
+		result.Reason = reasonUnidentified
+		result.Error = fmt.Sprintf("device is in tailnet %s, not the expected tailnet %s", match.tailnet, t.ExpectedTailnet)
+		return result
+	}
+
+	id := policy.Identity{Device: match.device, User: match.user, Groups: t.userGroups(match)}
+	for name, p := range t.namedPolicies() {
+		rule := checkRules(name, p, id)
+		if rule.Decision == "allow" {
+			continue
+		}
+		if rule.Decision == "would_deny" {
+			result.WouldDeny = append(result.WouldDeny, rule)
+			continue
+		}
+		result.Decision = "deny"
+		result.Policy, result.Reason, result.Error = rule.Policy, rule.Reason, rule.Error
+		return result
+	}
+
+	result.Decision = "allow"
+	return result
+}
+
+// checkRules returns the decision of one set of rules on id
+func checkRules(name string, p *policy.Policy, id policy.Identity) ruleTestResult {
+	rule := ruleTestResult{Policy: name, Enforce: "on", Decision: "allow"}
+	if !p.Enforced() {
+		rule.Enforce = "off"
+	}
+	reason, err := p.Check(id)
+	if err == nil {
+		return rule
+	}
+	rule.Decision = "deny"
+	if !p.Enforced() {
+		rule.Decision = "would_deny"
+	}
+	rule.Reason, rule.Error = reason, err.Error()
+	return rule
+}
+
+// testPolicy evaluates pt against every live handler and every named policy
+// of the running config
+func testPolicy(pt *policyTest) (*policyTestResult, error) {
+	match, err := pt.identity()
+	if err != nil {
+		return nil, err
+	}
+	r, err := pt.request()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &policyTestResult{
+		IdentityType: match.device.IdentityType(),
+		Handlers:     []handlerTestResult{},
+		Policies:     []ruleTestResult{},
+	}
+	for i, t := range liveHandlers.list() {
+		handler := t.testPolicies(r, match)
+		handler.Handler = i
+		result.Handlers = append(result.Handlers, handler)
+	}
+
+	appIface, err := caddy.ActiveContext().AppIfConfigured("tailscale_auth")
+	if errors.Is(err, caddy.ErrNotConfigured) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	app := appIface.(*App)
+
+	names := make([]string, 0, len(app.Policies))
+	for name := range app.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	id := policy.Identity{Device: match.device, User: match.user, Groups: match.groups}
+	for _, name := range names {
+		result.Policies = append(result.Policies, checkRules(name, app.Policies[name], id))
+	}
+	return result, nil
+}
+
+// handleTestPolicy evaluates the posted synthetic identity and request
+func (adminAPI) handleTestPolicy(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var pt policyTest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&pt); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request: %v", err),
+		}
+	}
+
+	result, err := testPolicy(&pt)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
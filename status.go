@@ -0,0 +1,200 @@
+package caddyauth
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxRecentDenials is how many denials the status page shows
+const maxRecentDenials = 50
+
+// recentDenials holds the latest denials of every handler, for status pages
+var recentDenials denialLog
+
+// denial is a denied request as shown on the status page
+type denial struct {
+	Time     time.Time
+	Reason   string
+	Host     string
+	Path     string
+	ClientIP string
+	Device   string
+	Message  string
+}
+
+// denialLog keeps the most recent denials of a handler
+type denialLog struct {
+	mu      sync.Mutex
+	entries []denial
+	next    int
+}
+
+// record adds a denial, dropping the oldest one once the log is full
+func (l *denialLog) record(d denial) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < maxRecentDenials {
+		l.entries = append(l.entries, d)
+		return
+	}
+	l.entries[l.next] = d
+	l.next = (l.next + 1) % maxRecentDenials
+}
+
+// recent returns the recorded denials, newest first
+func (l *denialLog) recent() []denial {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := make([]denial, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		recent = append(recent, l.entries[(l.next+i)%len(l.entries)])
+	}
+	return recent
+}
+
+// statusDevice is a row of the status page's device inventory
+type statusDevice struct {
+	Tailnet string
+	*Device
+}
+
+// statusData is the data rendered by statusPage
+type statusData struct {
+	Generated time.Time
+	Caches    []cacheDebug
+	Denials   []denial
+	Devices   []statusDevice
+}
+
+// statusPage renders the handler's status_path
+var statusPage = htmltemplate.Must(htmltemplate.New("status").Funcs(htmltemplate.FuncMap{
+	"percent": func(ratio float64) float64 { return ratio * 100 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tailscale Auth Status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>Tailscale Auth Status</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+
+<h2>Caches</h2>
+{{if .Caches}}
+<table>
+<tr><th>Tailnet</th><th>Entries</th><th>Last update</th><th>Hit ratio</th><th>Store</th><th>Credentials</th><th>Last API error</th></tr>
+{{range .Caches}}
+<tr>
+<td>{{.Tailnet}}</td>
+<td>{{.Entries}}</td>
+<td>{{.LastUpdate}}</td>
+<td>{{with .HitRatio}}{{printf "%.1f%%" (percent .)}}{{else}}-{{end}}</td>
+<td>{{or .Store "memory"}}</td>
+<td>{{.Credentials}}</td>
+<td>{{with .LastAPIErrorAt}}{{.Format "2006-01-02 15:04:05"}}: {{end}}{{.LastAPIError}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No device caches are in use.</p>
+{{end}}
+
+<h2>Recent Denials</h2>
+{{if .Denials}}
+<table>
+<tr><th>Time</th><th>Reason</th><th>Host</th><th>Path</th><th>Client IP</th><th>Device</th><th>Message</th></tr>
+{{range .Denials}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Reason}}</td><td>{{.Host}}</td><td>{{.Path}}</td><td>{{.ClientIP}}</td><td>{{.Device}}</td><td>{{.Message}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No requests have been denied.</p>
+{{end}}
+
+<h2>Devices</h2>
+{{if .Devices}}
+<table>
+<tr><th>Tailnet</th><th>Name</th><th>User</th><th>OS</th><th>Addresses</th><th>Tags</th><th>Last seen</th></tr>
+{{range .Devices}}
+<tr><td>{{.Tailnet}}</td><td>{{.Name}}</td><td>{{.User}}</td><td>{{.OS}}</td><td>{{range $i, $a := .Addresses}}{{if $i}}, {{end}}{{$a}}{{end}}</td><td>{{range $i, $t := .Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</td><td>{{.LastSeen}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>No devices are cached.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// serveStatus renders the status page with the state of every live cache.
+// It is only served to identified clients that passed the handler's policies
+func (t *TailscaleAuth) serveStatus(w http.ResponseWriter, r *http.Request) error {
+	if loginName, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.login_name").(string); loginName == "" {
+		return t.deny(w, r, reasonUnidentified, nil, fmt.Errorf("the status page requires an identified user"))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	data := statusData{
+		Generated: time.Now(),
+		Caches:    liveCacheStates(false),
+		Denials:   recentDenials.recent(),
+		Devices:   liveInventory(),
+	}
+
+	var buf bytes.Buffer
+	if err := statusPage.Execute(&buf, data); err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed to render status page: %w", err))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// liveInventory returns the devices of every live device cache once each,
+// sorted by tailnet and name
+func liveInventory() []statusDevice {
+	seen := make(map[string]bool)
+	var devices []statusDevice
+	cachePool.Range(func(_, value any) bool {
+		cache, ok := value.(*tailnetCache)
+		if !ok {
+			return true
+		}
+		cache.mu.RLock()
+		for _, device := range cache.devices.IPToDevice {
+			if key := cache.tailnet + "/" + device.ID; !seen[key] {
+				seen[key] = true
+				devices = append(devices, statusDevice{Tailnet: cache.tailnet, Device: device})
+			}
+		}
+		cache.mu.RUnlock()
+		return true
+	})
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Tailnet != devices[j].Tailnet {
+			return devices[i].Tailnet < devices[j].Tailnet
+		}
+		return devices[i].Name < devices[j].Name
+	})
+	return devices
+}
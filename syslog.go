@@ -0,0 +1,368 @@
+package caddyauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// syslogQueueSize is how many events may wait for the syslog server. Further
+// ones are dropped rather than delaying requests
+const syslogQueueSize = 256
+
+// syslogDialTimeout bounds connecting and writing to the syslog server
+const syslogDialTimeout = 10 * time.Second
+
+// syslogFacilities maps facility names to their RFC 5424 codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogConfig forwards audit events to a syslog server in the RFC 5424 format
+type SyslogConfig struct {
+	// Address is the syslog server as udp://, tcp:// or tls://host:port
+	Address string `json:"address"`
+
+	// Facility is the syslog facility of the events, e.g. "local4" (default: "authpriv")
+	Facility string `json:"facility,omitempty"`
+
+	// AppName is the APP-NAME of the messages (default: "caddy-tailscale-auth")
+	AppName string `json:"app_name,omitempty"`
+
+	// IncludeAllowed also forwards a record of every allowed request, not
+	// only denials and new devices and users
+	IncludeAllowed bool `json:"include_allowed,omitempty"`
+
+	// CAFile is a PEM file of CAs to verify a tls:// server with, instead of the system roots
+	CAFile string `json:"ca_file,omitempty"`
+}
+
+// validate checks the syslog configuration
+func (c *SyslogConfig) validate() error {
+	u, err := url.Parse(c.Address)
+	if err != nil {
+		return fmt.Errorf("invalid syslog address %q: %w", c.Address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("syslog address must start with udp://, tcp:// or tls://, got %q", c.Address)
+	}
+	if u.Port() == "" {
+		return fmt.Errorf("syslog address %q has no port", c.Address)
+	}
+	if c.Facility != "" {
+		if _, ok := syslogFacilities[c.Facility]; !ok {
+			return fmt.Errorf("unknown syslog facility %q", c.Facility)
+		}
+	}
+	if c.CAFile != "" && u.Scheme != "tls" {
+		return fmt.Errorf("syslog ca_file needs a tls:// address")
+	}
+	return nil
+}
+
+// syslogSender writes events to a syslog server from a background goroutine,
+// reconnecting after errors
+type syslogSender struct {
+	logger   *zap.Logger
+	network  string
+	addr     string
+	tls      *tls.Config
+	appName  string
+	facility int
+	hostname string
+	format   string
+
+	queue chan syslogMessage
+	done  chan struct{}
+	conn  net.Conn
+}
+
+// syslogMessage is an event waiting to be sent
+type syslogMessage struct {
+	severity int
+	msgID    string
+	time     time.Time
+	body     string
+}
+
+// newSyslogSender starts sending events formatted in format to the server
+func newSyslogSender(c *SyslogConfig, format string, logger *zap.Logger) (*syslogSender, error) {
+	u, err := url.Parse(c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &syslogSender{
+		logger:   logger,
+		network:  u.Scheme,
+		addr:     u.Host,
+		appName:  c.AppName,
+		facility: syslogFacilities["authpriv"],
+		format:   format,
+		queue:    make(chan syslogMessage, syslogQueueSize),
+		done:     make(chan struct{}),
+	}
+	if s.appName == "" {
+		s.appName = "caddy-tailscale-auth"
+	}
+	if c.Facility != "" {
+		s.facility = syslogFacilities[c.Facility]
+	}
+	if s.hostname, err = os.Hostname(); err != nil || s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	if s.network == "tls" {
+		s.network = "tcp"
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+		if c.CAFile != "" {
+			pem, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read syslog ca_file: %w", err)
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("syslog ca_file %s holds no certificates", c.CAFile)
+			}
+		}
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// send queues event, dropping it if the queue is full
+func (s *syslogSender) send(event securityEvent, severity int, now time.Time) {
+	id, _, _ := event.eventHeader()
+
+	var body string
+	if s.format == "cef" || s.format == "leef" {
+		line, err := formatEvent(s.format, event)
+		if err != nil {
+			s.logger.Error("failed to format syslog event", zap.Error(err))
+			return
+		}
+		body = line
+	} else {
+		data, err := json.Marshal(event)
+		if err != nil {
+			s.logger.Error("failed to marshal syslog event", zap.Error(err))
+			return
+		}
+		body = string(data)
+	}
+
+	select {
+	case s.queue <- syslogMessage{severity: severity, msgID: id, time: now, body: body}:
+	default:
+		s.logger.Warn("syslog queue is full, dropping event", zap.String("event", id))
+	}
+}
+
+// run writes queued messages until close is called
+func (s *syslogSender) run() {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case msg := <-s.queue:
+			if err := s.write(msg); err != nil {
+				s.logger.Warn("failed to send syslog event", zap.Error(err))
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// write sends msg, connecting first if needed. Stream connections are
+// dropped on errors so the next message reconnects
+func (s *syslogSender) write(msg syslogMessage) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: syslogDialTimeout}
+		var err error
+		if s.tls != nil {
+			s.conn, err = tls.DialWithDialer(dialer, s.network, s.addr, s.tls)
+		} else {
+			s.conn, err = dialer.Dial(s.network, s.addr)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+
+	line := s.format5424(msg)
+	if s.network == "tcp" {
+		// RFC 6587 octet counting, so messages may contain newlines
+		line = strconv.Itoa(len(line)) + " " + line
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogDialTimeout))
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// format5424 renders msg as an RFC 5424 message without structured data
+func (s *syslogSender) format5424(msg syslogMessage) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.facility*8+msg.severity,
+		msg.time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.appName,
+		os.Getpid(),
+		msg.msgID,
+		msg.body)
+}
+
+// close stops the sender, dropping events that were not sent yet
+func (s *syslogSender) close() {
+	close(s.done)
+}
+
+// Syslog severities of the forwarded events
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+	syslogInfo    = 6
+)
+
+// allowEvent is the record of an allowed request forwarded with include_allowed
+type allowEvent struct {
+	Event      string    `json:"event"`
+	DecisionID string    `json:"decision_id"`
+	ClientIP   string    `json:"client_ip"`
+	Tailnet    string    `json:"tailnet,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Device     string    `json:"device,omitempty"`
+	ID         string    `json:"device_id,omitempty"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Time       time.Time `json:"time"`
+}
+
+// newAllowEvent returns the record of an allowed request
+func newAllowEvent(r *http.Request, clientIP, decisionID string, match *deviceMatch) allowEvent {
+	event := allowEvent{
+		Event:      "allow",
+		DecisionID: decisionID,
+		ClientIP:   clientIP,
+		Tailnet:    match.tailnet,
+		Method:     r.Method,
+		Route:      r.Host + r.URL.Path,
+		Time:       time.Now().UTC(),
+	}
+	if match.user != nil {
+		event.User = match.user.LoginName
+	}
+	if device := match.device; device != nil {
+		if event.User == "" {
+			event.User = device.User
+		}
+		event.Device = device.Name
+		event.ID = device.ID
+	}
+	return event
+}
+
+func (e allowEvent) eventHeader() (string, string, int) {
+	return "allow", "Request allowed", 1
+}
+
+func (e allowEvent) eventFields() []eventField {
+	fields := []eventField{
+		{"rt", eventTime(e.Time)},
+		{"act", "allow"},
+		{"externalId", e.DecisionID},
+		{"src", e.ClientIP},
+		{"requestMethod", e.Method},
+		{"request", e.Route},
+	}
+	if e.User != "" {
+		fields = append(fields, eventField{"suser", e.User})
+	}
+	if e.Tailnet != "" {
+		fields = append(fields, eventField{"cs1Label", "tailnet"}, eventField{"cs1", e.Tailnet})
+	}
+	if e.Device != "" {
+		fields = append(fields,
+			eventField{"shost", e.Device},
+			eventField{"cs2Label", "deviceId"},
+			eventField{"cs2", e.ID})
+	}
+	return fields
+}
+
+// unmarshalCaddyfile parses a syslog <address> { ... } directive
+func (c *SyslogConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	c.Address = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "facility":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Facility = strings.ToLower(d.Val())
+
+		case "app_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.AppName = d.Val()
+
+		case "include_allowed":
+			c.IncludeAllowed = true
+
+		case "ca_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.CAFile = d.Val()
+
+		default:
+			return d.Errf("unrecognized syslog option: %s", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// placeholderFields returns the options whose placeholders are expanded
+func (c *SyslogConfig) placeholderFields() []configField {
+	return []configField{
+		{"syslog address", &c.Address},
+		{"syslog ca_file", &c.CAFile},
+	}
+}
@@ -0,0 +1,926 @@
+package caddyauth
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/juridia-net/caddy-tailscale-auth/cache"
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// TailnetConfig holds the API credentials and device cache settings for one
+// tailnet. It is embedded in the handler and can also be defined once in the
+// tailscale_auth app and referenced by name. Its string options may use
+// global placeholders such as {env.*} and {file.*}, expanded at provision time.
+type TailnetConfig struct {
+	// APIKey is the Tailscale API key for authentication
+	APIKey string `json:"api_key,omitempty"`
+
+	// APIKeyFile reads the API key from a file instead, such as a Docker or
+	// Kubernetes secret mount. The file is watched so rotated keys are picked
+	// up without a restart, and the key never appears in the config
+	APIKeyFile string `json:"api_key_file,omitempty"`
+
+	// SecondaryAPIKey is used instead of the primary key once the API rejects
+	// that, and the other way round, so keys can be rotated without downtime
+	SecondaryAPIKey string `json:"secondary_api_key,omitempty"`
+
+	// OAuthClientID authenticates with an OAuth client's short-lived access
+	// tokens instead of an API key. Its scopes are checked against the
+	// enabled features when the cache starts
+	OAuthClientID string `json:"oauth_client_id,omitempty"`
+
+	// OAuthClientSecret is the OAuth client's secret
+	OAuthClientSecret string `json:"oauth_client_secret,omitempty"`
+
+	// Vault fetches the API key from a HashiCorp Vault secret instead, so it
+	// is stored neither on disk nor in the config
+	Vault *VaultConfig `json:"vault,omitempty"`
+
+	// Tailnet is the Tailscale tailnet name (e.g., "juridia.net")
+	Tailnet string `json:"tailnet,omitempty"`
+
+	// APIURL is the base URL of the Tailscale API, e.g. for a mock server in
+	// tests (default: "https://api.tailscale.com")
+	APIURL string `json:"api_url,omitempty"`
+
+	// UserAgent identifies the module's API requests, so the tailnet's admin
+	// logs can attribute them (default: "Caddy-Tailscale-Auth/1.0")
+	UserAgent string `json:"user_agent,omitempty"`
+
+	// InstanceID is appended to the User-Agent, e.g. "prod-eu-1" or
+	// "{system.hostname}", to tell apart deployments sharing credentials
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// DebugAPI logs every API request with its status, latency, rate limit
+	// headers and response body, with secrets redacted
+	DebugAPI bool `json:"debug_api,omitempty"`
+
+	// SubnetRoutes attributes traffic from addresses inside a subnet router's
+	// enabled routes to that router, for clients reaching Caddy through it
+	SubnetRoutes bool `json:"subnet_routes,omitempty"`
+
+	// FetchUsers additionally fetches the tailnet's users on every refresh to
+	// expose their role and status. The API key needs the users:read scope
+	FetchUsers bool `json:"fetch_users,omitempty"`
+
+	// FetchPosture additionally fetches every device's posture attributes on
+	// refresh, one API call per device. The API key needs the devices:posture_attributes:read scope
+	FetchPosture bool `json:"fetch_posture,omitempty"`
+
+	// FetchGroups additionally fetches the groups section of the tailnet policy
+	// file on refresh. The API key needs the policy_file:read scope
+	FetchGroups bool `json:"fetch_groups,omitempty"`
+
+	// FetchGrants additionally fetches the grants section of the tailnet
+	// policy file on refresh, together with the groups they refer to. The
+	// API key needs the policy_file:read scope
+	FetchGrants bool `json:"fetch_grants,omitempty"`
+
+	// CacheFile is the path to store the device cache (default: "tailscale_devices.json").
+	// Relative paths are resolved against Caddy's data directory
+	CacheFile string `json:"cache_file,omitempty"`
+
+	// CachePersistence controls where the device cache is persisted: "file"
+	// (or "on") for CacheFile, "storage" for Caddy's configured storage backend,
+	// "redis" for a Redis server shared between instances, "sqlite" for a
+	// SQLite database that also keeps device history, or "off" to keep the
+	// cache purely in memory (default: "file")
+	CachePersistence string `json:"cache_persistence,omitempty"`
+
+	// Redis configures the Redis cache backend used when CachePersistence is "redis"
+	Redis *RedisConfig `json:"redis,omitempty"`
+
+	// SQLiteFile is the database path used when CachePersistence is "sqlite" (default: "tailscale_devices.db").
+	// Relative paths are resolved against Caddy's data directory
+	SQLiteFile string `json:"sqlite_file,omitempty"`
+
+	// CacheEncryptionKey enables AES-GCM encryption of the persisted device cache.
+	// Falls back to the TAILSCALE_AUTH_CACHE_KEY environment variable when empty
+	CacheEncryptionKey string `json:"cache_encryption_key,omitempty"`
+
+	// CacheEncryptionMigrate reads a plaintext cache once despite
+	// CacheEncryptionKey and encrypts it right away. Without it, a plaintext
+	// cache is discarded once a key is set
+	CacheEncryptionMigrate bool `json:"cache_encryption_migrate,omitempty"`
+
+	// CacheCompression compresses the persisted device cache: "gzip", "zstd" or "off" (default: "off")
+	CacheCompression string `json:"cache_compression,omitempty"`
+
+	// CacheFlushInterval batches cache persistence: refreshes only mark the cache
+	// dirty and it is written out at most once per interval and on shutdown.
+	// Zero saves synchronously after every refresh (default: 0)
+	CacheFlushInterval caddy.Duration `json:"cache_flush_interval,omitempty"`
+
+	// RefreshInterval refreshes the device list in the background at about
+	// this interval, so changes are picked up before a client misses. Handlers
+	// sharing a cache share one poller, and each wait is jittered. Zero only
+	// refreshes on cache misses (default: 0)
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// MissRefreshCooldown is the least time between a refresh of any kind and
+	// one triggered by a cache miss. Misses within it are answered from the
+	// cache, so unknown clients cannot drive API usage. Zero refreshes on
+	// every miss (default: 0)
+	MissRefreshCooldown caddy.Duration `json:"miss_refresh_cooldown,omitempty"`
+
+	// WarmUp fetches the device list when a cache that was never refreshed
+	// is provisioned, waiting at most this long, so the first requests after
+	// startup do not all miss. A failed warm-up is only logged. Zero leaves
+	// the first fetch to the first miss (default: 0)
+	WarmUp caddy.Duration `json:"warm_up,omitempty"`
+
+	// APIRateLimit caps the calls to the Tailscale API per minute, so a burst
+	// of cache misses cannot trip the API's own rate limiting. Calls queue
+	// until they are allowed. Zero disables the limit (default: 0)
+	APIRateLimit int `json:"api_rate_limit,omitempty"`
+
+	// APIRateLimitWait is the longest a call queues under APIRateLimit
+	// before it fails (default: 10s)
+	APIRateLimitWait caddy.Duration `json:"api_rate_limit_wait,omitempty"`
+
+	// client replaces the REST client, set from TailscaleAuth.APIClient
+	client APIClient
+
+	// keyMaterial is the app's key_material setting
+	keyMaterial string
+}
+
+// configField is a string option whose placeholders are expanded at provision time
+type configField struct {
+	name  string
+	value *string
+}
+
+// expandPlaceholders replaces global placeholders such as {env.*} and
+// {file.*} in fields, so secrets need not be literal in the config.
+// Unknown placeholders are an error rather than silently left in place
+func expandPlaceholders(fields ...configField) error {
+	repl := caddy.NewReplacer()
+	for _, field := range fields {
+		value, err := repl.ReplaceOrErr(*field.value, false, true)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+		*field.value = value
+	}
+	return nil
+}
+
+// expandPlaceholders expands the placeholders of the string options. It runs
+// before inheriting, as inherited values are already expanded
+func (c *TailnetConfig) expandPlaceholders() error {
+	fields := []configField{
+		{"api_key", &c.APIKey},
+		{"api_key_file", &c.APIKeyFile},
+		{"secondary_api_key", &c.SecondaryAPIKey},
+		{"oauth_client_id", &c.OAuthClientID},
+		{"oauth_client_secret", &c.OAuthClientSecret},
+		{"tailnet", &c.Tailnet},
+		{"api_url", &c.APIURL},
+		{"user_agent", &c.UserAgent},
+		{"instance_id", &c.InstanceID},
+		{"cache_file", &c.CacheFile},
+		{"cache_persistence", &c.CachePersistence},
+		{"sqlite_file", &c.SQLiteFile},
+		{"cache_encryption_key", &c.CacheEncryptionKey},
+		{"cache_compression", &c.CacheCompression},
+	}
+	if c.Redis != nil {
+		fields = append(fields,
+			configField{"redis address", &c.Redis.Address},
+			configField{"redis username", &c.Redis.Username},
+			configField{"redis password", &c.Redis.Password},
+			configField{"redis key", &c.Redis.Key},
+		)
+	}
+	if c.Vault != nil {
+		fields = append(fields, c.Vault.placeholderFields()...)
+	}
+	return expandPlaceholders(fields...)
+}
+
+// setDefaults fills in default values for unset fields
+func (c *TailnetConfig) setDefaults() {
+	if c.APIURL == "" {
+		c.APIURL = "https://api.tailscale.com"
+	}
+
+	if c.CacheFile == "" {
+		c.CacheFile = "tailscale_devices.json"
+	}
+
+	if c.SQLiteFile == "" {
+		c.SQLiteFile = "tailscale_devices.db"
+	}
+
+	if c.CachePersistence == "" || c.CachePersistence == "on" {
+		c.CachePersistence = "file"
+	}
+
+	if c.APIRateLimitWait == 0 {
+		c.APIRateLimitWait = caddy.Duration(10 * time.Second)
+	}
+}
+
+// inherit fills every unset field from defaults
+func (c *TailnetConfig) inherit(defaults *TailnetConfig) {
+	if defaults == nil {
+		return
+	}
+
+	if c.APIKey == "" && c.APIKeyFile == "" && c.Vault == nil && c.OAuthClientID == "" {
+		c.APIKey = defaults.APIKey
+		c.APIKeyFile = defaults.APIKeyFile
+		c.SecondaryAPIKey = defaults.SecondaryAPIKey
+		c.OAuthClientID = defaults.OAuthClientID
+		c.OAuthClientSecret = defaults.OAuthClientSecret
+		if defaults.Vault != nil {
+			vault := *defaults.Vault
+			c.Vault = &vault
+		}
+	}
+
+	if c.Tailnet == "" {
+		c.Tailnet = defaults.Tailnet
+	}
+
+	if c.APIURL == "" {
+		c.APIURL = defaults.APIURL
+	}
+
+	if c.UserAgent == "" {
+		c.UserAgent = defaults.UserAgent
+	}
+
+	if c.InstanceID == "" {
+		c.InstanceID = defaults.InstanceID
+	}
+
+	if !c.DebugAPI {
+		c.DebugAPI = defaults.DebugAPI
+	}
+
+	if !c.SubnetRoutes {
+		c.SubnetRoutes = defaults.SubnetRoutes
+	}
+
+	if !c.FetchUsers {
+		c.FetchUsers = defaults.FetchUsers
+	}
+
+	if !c.FetchPosture {
+		c.FetchPosture = defaults.FetchPosture
+	}
+
+	if !c.FetchGroups {
+		c.FetchGroups = defaults.FetchGroups
+	}
+
+	if !c.FetchGrants {
+		c.FetchGrants = defaults.FetchGrants
+	}
+
+	if c.CacheFile == "" {
+		c.CacheFile = defaults.CacheFile
+	}
+
+	if c.CachePersistence == "" {
+		c.CachePersistence = defaults.CachePersistence
+	}
+
+	if c.Redis == nil && defaults.Redis != nil {
+		redis := *defaults.Redis
+		c.Redis = &redis
+	}
+
+	if c.SQLiteFile == "" {
+		c.SQLiteFile = defaults.SQLiteFile
+	}
+
+	if c.CacheEncryptionKey == "" {
+		c.CacheEncryptionKey = defaults.CacheEncryptionKey
+	}
+
+	if !c.CacheEncryptionMigrate {
+		c.CacheEncryptionMigrate = defaults.CacheEncryptionMigrate
+	}
+
+	if c.CacheCompression == "" {
+		c.CacheCompression = defaults.CacheCompression
+	}
+
+	if c.CacheFlushInterval == 0 {
+		c.CacheFlushInterval = defaults.CacheFlushInterval
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = defaults.RefreshInterval
+	}
+
+	if c.MissRefreshCooldown == 0 {
+		c.MissRefreshCooldown = defaults.MissRefreshCooldown
+	}
+
+	if c.WarmUp == 0 {
+		c.WarmUp = defaults.WarmUp
+	}
+
+	if c.APIRateLimit == 0 {
+		c.APIRateLimit = defaults.APIRateLimit
+	}
+
+	if c.APIRateLimitWait == 0 {
+		c.APIRateLimitWait = defaults.APIRateLimitWait
+	}
+}
+
+// inheritAdditional fills the unset cache options of an additional tailnet
+// from the primary one. Credentials are never inherited, and file names and
+// Redis keys keep their per-tailnet defaults so the caches do not collide
+func (c *TailnetConfig) inheritAdditional(primary *TailnetConfig) {
+	if c.CacheFile == "" {
+		c.CacheFile = "tailscale_devices_" + c.Tailnet + ".json"
+	}
+
+	if c.SQLiteFile == "" {
+		c.SQLiteFile = "tailscale_devices_" + c.Tailnet + ".db"
+	}
+
+	if c.APIURL == "" {
+		c.APIURL = primary.APIURL
+	}
+
+	if c.UserAgent == "" {
+		c.UserAgent = primary.UserAgent
+	}
+
+	if c.InstanceID == "" {
+		c.InstanceID = primary.InstanceID
+	}
+
+	if !c.DebugAPI {
+		c.DebugAPI = primary.DebugAPI
+	}
+
+	if !c.SubnetRoutes {
+		c.SubnetRoutes = primary.SubnetRoutes
+	}
+
+	if !c.FetchUsers {
+		c.FetchUsers = primary.FetchUsers
+	}
+
+	if !c.FetchPosture {
+		c.FetchPosture = primary.FetchPosture
+	}
+
+	if !c.FetchGroups {
+		c.FetchGroups = primary.FetchGroups
+	}
+
+	if !c.FetchGrants {
+		c.FetchGrants = primary.FetchGrants
+	}
+
+	if c.CachePersistence == "" {
+		c.CachePersistence = primary.CachePersistence
+	}
+
+	if c.Redis == nil && primary.Redis != nil {
+		redis := *primary.Redis
+		redis.Key = ""
+		c.Redis = &redis
+	}
+
+	if c.CacheEncryptionKey == "" {
+		c.CacheEncryptionKey = primary.CacheEncryptionKey
+	}
+
+	if !c.CacheEncryptionMigrate {
+		c.CacheEncryptionMigrate = primary.CacheEncryptionMigrate
+	}
+
+	if c.CacheCompression == "" {
+		c.CacheCompression = primary.CacheCompression
+	}
+
+	if c.CacheFlushInterval == 0 {
+		c.CacheFlushInterval = primary.CacheFlushInterval
+	}
+
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = primary.RefreshInterval
+	}
+
+	if c.MissRefreshCooldown == 0 {
+		c.MissRefreshCooldown = primary.MissRefreshCooldown
+	}
+
+	if c.WarmUp == 0 {
+		c.WarmUp = primary.WarmUp
+	}
+
+	if c.APIRateLimit == 0 {
+		c.APIRateLimit = primary.APIRateLimit
+	}
+
+	if c.APIRateLimitWait == 0 {
+		c.APIRateLimitWait = primary.APIRateLimitWait
+	}
+}
+
+// validate checks that the configuration is usable
+func (c *TailnetConfig) validate() error {
+	if c.Tailnet == "" {
+		return fmt.Errorf("tailnet is required")
+	}
+
+	sources := 0
+	for _, set := range []bool{c.APIKey != "", c.APIKeyFile != "", c.Vault != nil, c.OAuthClientID != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return fmt.Errorf("one of api_key, api_key_file, vault or oauth_client_id is required")
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of api_key, api_key_file, vault and oauth_client_id can be set")
+	}
+
+	if (c.OAuthClientID == "") != (c.OAuthClientSecret == "") {
+		return fmt.Errorf("oauth_client_id and oauth_client_secret must be set together")
+	}
+
+	if c.APIRateLimit < 0 || c.APIRateLimitWait < 0 {
+		return fmt.Errorf("api_rate_limit must not be negative")
+	}
+
+	if c.RefreshInterval < 0 || c.MissRefreshCooldown < 0 || c.WarmUp < 0 {
+		return fmt.Errorf("refresh_interval, miss_refresh_cooldown and warm_up must not be negative")
+	}
+
+	if strings.IndexFunc(c.userAgent(), isControl) >= 0 {
+		return fmt.Errorf("user_agent and instance_id must not contain control characters")
+	}
+
+	if c.SecondaryAPIKey != "" && c.SecondaryAPIKey == c.APIKey {
+		return fmt.Errorf("secondary_api_key must differ from api_key")
+	}
+
+	if c.Vault != nil {
+		if err := c.Vault.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch c.CachePersistence {
+	case "", "on", "file", "storage", "redis", "sqlite", "off":
+	default:
+		return fmt.Errorf("cache_persistence must be one of 'file', 'storage', 'redis', 'sqlite' or 'off', got %q", c.CachePersistence)
+	}
+
+	switch c.CacheCompression {
+	case "", "off", "gzip", "zstd":
+	default:
+		return fmt.Errorf("cache_compression must be one of 'gzip', 'zstd' or 'off', got %q", c.CacheCompression)
+	}
+
+	return nil
+}
+
+// unmarshalCaddyfileOption parses the current subdirective if it is a tailnet
+// option, reporting whether it was recognized
+func (c *TailnetConfig) unmarshalCaddyfileOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "api_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.APIKey = d.Val()
+
+	case "api_key_file":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.APIKeyFile = d.Val()
+
+	case "secondary_api_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.SecondaryAPIKey = d.Val()
+
+	case "oauth_client_id":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.OAuthClientID = d.Val()
+
+	case "oauth_client_secret":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.OAuthClientSecret = d.Val()
+
+	case "vault":
+		if c.Vault == nil {
+			c.Vault = new(VaultConfig)
+		}
+		if err := c.Vault.unmarshalCaddyfile(d); err != nil {
+			return true, err
+		}
+
+	case "tailnet":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.Tailnet = d.Val()
+
+	case "api_url":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.APIURL = d.Val()
+
+	case "user_agent":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.UserAgent = d.Val()
+
+	case "instance_id":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.InstanceID = d.Val()
+
+	case "debug_api":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.DebugAPI = true
+
+	case "subnet_routes":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.SubnetRoutes = true
+
+	case "fetch_users":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.FetchUsers = true
+
+	case "fetch_posture":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.FetchPosture = true
+
+	case "fetch_groups":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.FetchGroups = true
+
+	case "fetch_grants":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.FetchGrants = true
+
+	case "cache_file":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CacheFile = d.Val()
+
+	case "cache_persistence":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CachePersistence = d.Val()
+
+	case "sqlite_file":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.SQLiteFile = d.Val()
+
+	case "cache_encryption_key":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CacheEncryptionKey = d.Val()
+
+	case "cache_encryption_migrate":
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CacheEncryptionMigrate = true
+
+	case "cache_compression":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.CacheCompression = d.Val()
+
+	case "cache_flush_interval":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		interval, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid cache_flush_interval %q: %v", d.Val(), err)
+		}
+		c.CacheFlushInterval = caddy.Duration(interval)
+
+	case "refresh_interval":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		interval, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid refresh_interval %q: %v", d.Val(), err)
+		}
+		c.RefreshInterval = caddy.Duration(interval)
+
+	case "miss_refresh_cooldown":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		cooldown, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid miss_refresh_cooldown %q: %v", d.Val(), err)
+		}
+		c.MissRefreshCooldown = caddy.Duration(cooldown)
+
+	case "warm_up":
+		c.WarmUp = caddy.Duration(10 * time.Second)
+		if d.NextArg() {
+			timeout, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return true, d.Errf("invalid warm_up %q: %v", d.Val(), err)
+			}
+			c.WarmUp = caddy.Duration(timeout)
+		}
+
+	case "api_rate_limit":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		limit, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid api_rate_limit %q: %v", d.Val(), err)
+		}
+		c.APIRateLimit = limit
+		if d.NextArg() {
+			wait, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return true, d.Errf("invalid api_rate_limit wait %q: %v", d.Val(), err)
+			}
+			c.APIRateLimitWait = caddy.Duration(wait)
+		}
+
+	case "redis":
+		if c.Redis == nil {
+			c.Redis = new(RedisConfig)
+		}
+		if err := c.Redis.unmarshalCaddyfile(d); err != nil {
+			return true, err
+		}
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// stubClientSeq tells apart the caches of handlers with a stubbed APIClient
+var stubClientSeq atomic.Uint64
+
+// cachePoolKey identifies configurations that can share one tailnetCache.
+// WarmUp only applies while a cache is loaded, so it is left out
+func (c *TailnetConfig) cachePoolKey() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%s|%+v|%s|%s|%t|%t|%t|%t|%t|%t|%s|%s|%s|%+v|%s|%t|%s|%d|%d|%d|%d|%d|%s",
+		c.Tailnet, c.APIKey, c.APIKeyFile, c.SecondaryAPIKey, c.OAuthClientID, c.OAuthClientSecret, c.Vault, c.APIURL, c.userAgent(), c.DebugAPI, c.SubnetRoutes, c.FetchUsers, c.FetchPosture, c.FetchGroups, c.FetchGrants, c.CachePersistence, c.CacheFile, c.SQLiteFile, c.Redis,
+		c.CacheEncryptionKey, c.CacheEncryptionMigrate, c.CacheCompression, c.CacheFlushInterval, c.RefreshInterval, c.MissRefreshCooldown, c.APIRateLimit, c.APIRateLimitWait, c.keyMaterial)))
+	key := c.Tailnet + "/" + hex.EncodeToString(sum[:8])
+	// Caches of stubbed clients are never shared
+	if c.client != nil {
+		key += fmt.Sprintf("/client-%d", stubClientSeq.Add(1))
+	}
+	return key
+}
+
+// loadCache returns the live cache for this configuration from the cache pool,
+// creating it on first use, together with the pool key the caller must release
+func (c *TailnetConfig) loadCache(ctx caddy.Context, logger *zap.Logger) (*tailnetCache, string, error) {
+	key := c.cachePoolKey()
+	live, loaded, err := cachePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return c.newTailnetCache(ctx, logger)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if loaded {
+		logger.Debug("reusing live device cache", zap.String("cache_key", key))
+	}
+
+	cache := live.(*tailnetCache)
+	if c.WarmUp > 0 && cache.lastRefresh.Load() == 0 {
+		cache.warmUp(time.Duration(c.WarmUp))
+	}
+	return cache, key, nil
+}
+
+// newTailnetCache creates the cache for this configuration and loads it from its store
+func (cfg *TailnetConfig) newTailnetCache(ctx caddy.Context, logger *zap.Logger) (*tailnetCache, error) {
+	c := &tailnetCache{
+		tailnet:      cfg.Tailnet,
+		client:       cfg.client,
+		subnetRoutes: cfg.SubnetRoutes,
+		fetchUsers:   cfg.FetchUsers,
+		fetchPosture: cfg.FetchPosture,
+		fetchGroups:  cfg.FetchGroups || cfg.FetchGrants,
+		fetchGrants:  cfg.FetchGrants,
+		keyMaterial:  cfg.keyMaterial,
+		missCooldown: time.Duration(cfg.MissRefreshCooldown),
+		logger:       logger,
+		devices:      &DeviceCache{IPToDevice: make(map[string]*Device)},
+		codec:        cache.Codec{Compression: cfg.CacheCompression},
+		refreshSlot:  make(chan struct{}, 1),
+	}
+
+	cacheCipher, err := cache.NewCipher(cfg.CacheEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.CacheEncryptionMigrate && cacheCipher == nil {
+		return nil, fmt.Errorf("cache_encryption_migrate needs cache_encryption_key")
+	}
+	c.codec.Cipher = cacheCipher
+	c.migrate.Store(cfg.CacheEncryptionMigrate)
+
+	store, err := cfg.newCacheStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.store = store
+
+	if c.client == nil {
+		keys, err := cfg.newAPIKeySource(logger)
+		if err != nil {
+			c.Destruct()
+			return nil, err
+		}
+		var rest *client.REST
+		if keys != nil {
+			c.keys = keys
+			rest = client.NewRESTKeyFunc(cfg.APIURL, keys.Key)
+		} else {
+			rest = client.NewREST(cfg.APIURL, cfg.APIKey)
+		}
+		rest.UserAgent = cfg.userAgent()
+		if cfg.DebugAPI {
+			rest.Observe = logAPIExchange(logger.Named("api"))
+		}
+		c.client = rest
+
+		if cfg.SecondaryAPIKey != "" {
+			c.client = cfg.newFailover(ctx, c.client, logger)
+		}
+	}
+
+	if cfg.APIRateLimit > 0 {
+		// Allow bursts of up to ten seconds' worth of calls
+		burst := max(cfg.APIRateLimit/6, 1)
+		c.client = &client.RateLimited{
+			Client:  c.client,
+			Limiter: rate.NewLimiter(rate.Limit(float64(cfg.APIRateLimit)/60), burst),
+			MaxWait: time.Duration(cfg.APIRateLimitWait),
+		}
+	}
+
+	// Load existing cache from its persistent store
+	if c.store != nil {
+		if err := c.load(); err != nil {
+			c.logger.Warn("failed to load device cache, starting with empty cache", zap.Error(err))
+		}
+
+		if cfg.CacheFlushInterval > 0 {
+			c.flushStop = make(chan struct{})
+			c.flushDone = make(chan struct{})
+			go c.flushLoop(time.Duration(cfg.CacheFlushInterval))
+		}
+	}
+
+	if cfg.RefreshInterval > 0 {
+		c.pollStop = make(chan struct{})
+		c.pollDone = make(chan struct{})
+		go c.pollLoop(time.Duration(cfg.RefreshInterval))
+	}
+
+	return c, nil
+}
+
+// newFailover wraps primary in a client that switches to the secondary API
+// key when the API rejects the key in use, and reports every switch
+func (c *TailnetConfig) newFailover(ctx caddy.Context, primary APIClient, logger *zap.Logger) *client.Failover {
+	secondary := client.NewREST(c.APIURL, c.SecondaryAPIKey)
+	secondary.UserAgent = c.userAgent()
+	if c.DebugAPI {
+		secondary.Observe = logAPIExchange(logger.Named("api").With(zap.String("api_key", "secondary")))
+	}
+	failover := client.NewFailover(primary, secondary)
+
+	var events *caddyevents.App
+	if app, err := ctx.App("events"); err == nil {
+		events = app.(*caddyevents.App)
+	} else {
+		logger.Warn("events app unavailable, API key failovers are only logged", zap.Error(err))
+	}
+
+	tailnet := c.Tailnet
+	failover.OnSwitch = func(toSecondary bool, cause error) {
+		key := "primary"
+		if toSecondary {
+			key = "secondary"
+		}
+		logger.Warn("API key rejected, switched to the other key",
+			zap.String("api_key", key),
+			zap.Error(cause))
+		if events != nil {
+			events.Emit(ctx, "api_key_failover", map[string]any{
+				"tailnet": tailnet,
+				"api_key": key,
+			})
+		}
+	}
+	return failover
+}
+
+// userAgent returns the User-Agent of API requests, including the instance ID
+func (c *TailnetConfig) userAgent() string {
+	userAgent := cmp.Or(c.UserAgent, client.DefaultUserAgent)
+	if c.InstanceID != "" {
+		userAgent += " (instance " + c.InstanceID + ")"
+	}
+	return userAgent
+}
+
+// newAPIKeySource returns the source of a rotating API key or access token,
+// or nil for a static api_key
+func (c *TailnetConfig) newAPIKeySource(logger *zap.Logger) (apiKeySource, error) {
+	switch {
+	case c.APIKeyFile != "":
+		return newSecretFile("api_key_file", c.APIKeyFile, logger)
+	case c.Vault != nil:
+		return newVaultSecret(*c.Vault, logger)
+	case c.OAuthClientID != "":
+		return newOAuthToken(c, logger)
+	default:
+		return nil, nil
+	}
+}
+
+// newCacheStore returns the store selected by CachePersistence, or nil if persistence is off
+func (c *TailnetConfig) newCacheStore(ctx caddy.Context) (cache.Store, error) {
+	switch c.CachePersistence {
+	case "off":
+		return nil, nil
+	case "storage":
+		return &cache.StorageStore{
+			Storage: ctx.Storage(),
+			Key:     path.Join("tailscale_auth", c.Tailnet, "devices.json"),
+		}, nil
+	case "redis":
+		return c.Redis.newStore(c.Tailnet), nil
+	case "sqlite":
+		return cache.NewSQLiteStore(resolveDataPath(c.SQLiteFile))
+	case "file":
+		return &cache.FileStore{Path: c.getCacheFilePath()}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache_persistence %q", c.CachePersistence)
+	}
+}
+
+// getCacheFilePath returns the full path to the cache file
+func (c *TailnetConfig) getCacheFilePath() string {
+	return resolveDataPath(c.CacheFile)
+}
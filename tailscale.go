@@ -1,110 +1,366 @@
 package caddyauth
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"maps"
 	"net"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/logging"
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"github.com/juridia-net/caddy-tailscale-auth/policy"
 	"go.uber.org/zap"
 )
 
 func init() {
 	caddy.RegisterModule((*TailscaleAuth)(nil))
 	httpcaddyfile.RegisterHandlerDirective("tailscale_auth", parseCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_auth", httpcaddyfile.Before, "basic_auth")
 }
 
-// Device represents a Tailscale device from the API
-type Device struct {
-	Addresses                 []string `json:"addresses"`
-	Authorized                bool     `json:"authorized"`
-	BlocksIncomingConnections bool     `json:"blocksIncomingConnections"`
-	ClientVersion             string   `json:"clientVersion"`
-	Created                   string   `json:"created"`
-	Expires                   string   `json:"expires"`
-	Hostname                  string   `json:"hostname"`
-	ID                        string   `json:"id"`
-	IsExternal                bool     `json:"isExternal"`
-	KeyExpiryDisabled         bool     `json:"keyExpiryDisabled"`
-	LastSeen                  string   `json:"lastSeen"`
-	MachineKey                string   `json:"machineKey"`
-	Name                      string   `json:"name"`
-	NodeID                    string   `json:"nodeId"`
-	NodeKey                   string   `json:"nodeKey"`
-	OS                        string   `json:"os"`
-	TailnetLockError          string   `json:"tailnetLockError"`
-	TailnetLockKey            string   `json:"tailnetLockKey"`
-	UpdateAvailable           bool     `json:"updateAvailable"`
-	User                      string   `json:"user"`
-}
-
-// DevicesResponse represents the response from Tailscale's devices API
-type DevicesResponse struct {
-	Devices []Device `json:"devices"`
-}
-
-// DeviceCache represents the cached device information
-type DeviceCache struct {
-	IPToDevice map[string]*Device `json:"ip_to_device"`
-	LastUpdate string             `json:"last_update"`
-}
+// Aliases of the client package's API types, kept so configurations and
+// embedders can keep referring to them through this package
+type (
+	Device             = client.Device
+	DevicesResponse    = client.DevicesResponse
+	AttributesResponse = client.AttributesResponse
+	User               = client.User
+	PolicyFile         = client.PolicyFile
+	Grant              = client.Grant
+	UsersResponse      = client.UsersResponse
+	WhoIsResponse      = client.WhoIsResponse
+	APIClient          = client.APIClient
+)
 
 // TailscaleAuth is a Caddy module that fetches Tailscale user information
 // and adds it to request headers.
 type TailscaleAuth struct {
-	// APIKey is the Tailscale API key for authentication
-	APIKey string `json:"api_key,omitempty"`
-
-	// Tailnet is the Tailscale tailnet name (e.g., "juridia.net")
-	Tailnet string `json:"tailnet,omitempty"`
+	TailnetConfig
+
+	// Use names a tailnet configuration defined in the tailscale_auth app.
+	// When set, credentials and cache settings are taken from the app and the
+	// cache is shared with every other handler using the same name
+	Use string `json:"use,omitempty"`
+
+	// Node identifies clients through the named embedded tsnet node of the
+	// tailscale_auth app instead of the Tailscale API. No API key is needed,
+	// but the site must listen on the node, e.g. tsnet/<node>:443
+	Node string `json:"node,omitempty"`
+
+	// AdditionalTailnets are looked up in order when the client IP is not
+	// found in the primary tailnet. Unset cache options are inherited from the
+	// primary tailnet, with per-tailnet cache file names
+	AdditionalTailnets []*TailnetConfig `json:"additional_tailnets,omitempty"`
+
+	// APIClient replaces the Tailscale REST API for every tailnet of the
+	// handler, e.g. with a stub in tests. It can only be set from Go
+	APIClient APIClient `json:"-"`
+
+	// CLIFallback is the path of the tailscale CLI, whose `status --json`
+	// output identifies clients while the Tailscale API cannot be reached
+	CLIFallback string `json:"cli_fallback,omitempty"`
+
+	// ServeStale is how old a cache may be before its devices are refreshed
+	// through the API. If that fails, they are still served from the cache,
+	// marked as stale, instead of leaving their clients unidentified
+	ServeStale caddy.Duration `json:"serve_stale,omitempty"`
+
+	// MaxCacheAge is how long identities are trusted after the last successful
+	// refresh of their cache. Beyond it, a refresh is attempted, and while
+	// that fails, identities from the cache are rejected: requests are denied
+	// with fail_mode closed or policies that require an identity, and passed
+	// on without one otherwise
+	MaxCacheAge caddy.Duration `json:"max_cache_age,omitempty"`
+
+	// Resolvers are the sources client IPs are looked up in, in order
+	// (default: the device caches, refreshed through the Tailscale API)
+	Resolvers []*ResolverConfig `json:"resolvers,omitempty"`
+
+	// ExpectedTailnet denies requests from devices that are not found in this
+	// tailnet, including requests whose device cannot be identified at all.
+	// Lookups are then limited to the expected tailnet
+	ExpectedTailnet string `json:"expected_tailnet,omitempty"`
+
+	policy.Policy
+
+	// Policies names policies of the tailscale_auth app that requests must
+	// satisfy as well, in addition to the handler's own rules
+	Policies []string `json:"policies,omitempty"`
+
+	// KeyExpiryThreshold flags devices whose node key expires within this
+	// duration, giving users a chance to re-authenticate before access breaks
+	KeyExpiryThreshold caddy.Duration `json:"key_expiry_threshold,omitempty"`
+
+	// KeyExpiryAction is what happens to devices within KeyExpiryThreshold:
+	// "warn" logs and sets the Key-Expiry-Warning header, "deny" rejects them (default: "warn")
+	KeyExpiryAction string `json:"key_expiry_action,omitempty"`
+
+	// BlocksIncomingAction is what happens to devices that block incoming
+	// connections (shields up): "warn" logs them, "deny" rejects them. Unset,
+	// they are only flagged with the Device-Blocks-Incoming header
+	BlocksIncomingAction string `json:"blocks_incoming_action,omitempty"`
+
+	// MaxLastSeen refuses identity attribution for devices whose lastSeen is
+	// older than this, since their address may have been reused. Stale devices
+	// are refetched once before the request is treated as unidentified
+	MaxLastSeen caddy.Duration `json:"max_last_seen,omitempty"`
+
+	// StaleAction is what happens to requests from devices beyond MaxLastSeen:
+	// "skip" passes them through without headers, "deny" rejects them (default: "skip")
+	StaleAction string `json:"stale_action,omitempty"`
+
+	// Groups maps group names to the login names of their members, in the
+	// format of the policy file's groups section. Merged with fetched groups
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	// GroupsFile is a JSON file holding more groups in the same format, read at provisioning
+	GroupsFile string `json:"groups_file,omitempty"`
+
+	// GrantTarget lists the grant destinations that stand for this server,
+	// such as its tag or host name. Application capabilities of fetched grants
+	// to one of them or to "*" are added to the device's capabilities
+	GrantTarget []string `json:"grant_target,omitempty"`
+
+	// PermissionsApp is an application capability, such as
+	// "example.com/cap/wiki", whose granted permissions are sent in the
+	// Permissions header. Requires fetch_grants
+	PermissionsApp string `json:"permissions_app,omitempty"`
+
+	// PermissionsField is the field of the capability's parameters that holds
+	// the permissions, a string or a list of strings (default: "permissions")
+	PermissionsField string `json:"permissions_field,omitempty"`
+
+	// NonTailnetAction controls requests from addresses outside Tailscale's
+	// ranges that no subnet route accounts for: "skip" passes them through
+	// without headers, "deny" rejects them. They never trigger an API refresh (default: "skip")
+	NonTailnetAction string `json:"non_tailnet_action,omitempty"`
+
+	// ClientIPSource selects where the client IP is taken from: "connection"
+	// uses the connection's address, which is the PROXY protocol source
+	// address when the listener accepts PROXY headers, "headers" the client IP
+	// Caddy determined, which only comes from forwarding headers such as
+	// X-Forwarded-For when the connection is from one of the server's
+	// trusted_proxies (default: "connection")
+	ClientIPSource string `json:"client_ip_source,omitempty"`
+
+	// FailMode is what happens to requests whose client cannot be looked up,
+	// e.g. because the Tailscale API is unreachable: "open" passes them
+	// through without headers, "closed" denies them as unidentified. Policies
+	// that require an identity always deny them (default: "open")
+	FailMode string `json:"fail_mode,omitempty"`
+
+	// FunnelAction controls requests that Tailscale Funnel proxied in from the
+	// public internet: "deny" rejects them, "skip" passes them through without
+	// identity headers and "tag" also sets Via: funnel. Unset, they are
+	// treated like any other request
+	FunnelAction string `json:"funnel_action,omitempty"`
+
+	// TrustServeHeaders takes the user's identity from the Tailscale-User-*
+	// headers tailscaled's Serve proxy sets, instead of looking the client up.
+	// Only requests proxied over loopback are trusted
+	TrustServeHeaders bool `json:"trust_serve_headers,omitempty"`
+
+	// DenyStatus is the status code of denied requests: 401, 403 or 404 (default: 403)
+	DenyStatus int `json:"deny_status,omitempty"`
+
+	// DenyBody is a text/template rendered as the body of denied requests, with
+	// .Status, .Reason, .Message and .Device available. When empty, denials are
+	// returned as errors and handled by Caddy's handle_errors routes
+	DenyBody string `json:"deny_body,omitempty"`
+
+	// DenyFormat selects how denials without a DenyBody are answered: "error"
+	// returns them to Caddy's handle_errors routes, "negotiate" writes a
+	// problem+json, HTML or plain text body based on the Accept header (default: "error")
+	DenyFormat string `json:"deny_format,omitempty"`
+
+	// DenyContentType is the Content-Type of DenyBody (default: "text/plain; charset=utf-8")
+	DenyContentType string `json:"deny_content_type,omitempty"`
+
+	// LoginRedirect is a URL that browsers without a Tailscale identity are
+	// redirected to instead of being denied, such as a page explaining how to
+	// install and log in to Tailscale. Placeholders are expanded. API clients
+	// still receive the deny response
+	LoginRedirect string `json:"login_redirect,omitempty"`
+
+	// SkipPaths bypasses identity resolution for matching request paths, using
+	// the syntax of Caddy's path matcher ("/health", "/.well-known/acme-challenge/*")
+	SkipPaths []string `json:"skip_paths,omitempty"`
+
+	// SkipMethods bypasses identity resolution for these request methods, e.g. OPTIONS
+	SkipMethods []string `json:"skip_methods,omitempty"`
+
+	// MapUsers translates Tailscale login names to local application usernames,
+	// e.g. {"alice@corp.com": "alice"}. Mapped names replace the login name in
+	// the user headers; policies still see the original. Matching ignores case
+	MapUsers map[string]string `json:"map_users,omitempty"`
+
+	// PseudonymSalt enables pseudonymous identity mode: login names are
+	// forwarded as a salted hash that is stable per user, and display names are
+	// dropped. Placeholders such as {env.*} are expanded. Takes precedence over MapUsers
+	PseudonymSalt string `json:"pseudonym_salt,omitempty"`
+
+	// Privacy forwards only the login name and node name (Device-User,
+	// User-LoginName and Device-Name) and the Decision-ID, suppressing every
+	// other header. Vars and policies are unaffected
+	Privacy bool `json:"privacy,omitempty"`
+
+	// RedactLogs replaces login names, hostnames and IP addresses in the
+	// handler's log output: "hash" with stable keyed hashes that still allow
+	// correlating entries, "mask" with a fixed placeholder
+	RedactLogs string `json:"redact_logs,omitempty"`
+
+	// RedactSalt keys the hashes of RedactLogs. Placeholders such as {env.*} are expanded
+	RedactSalt string `json:"redact_salt,omitempty"`
+
+	// NewDeviceWebhook is a URL that a JSON notification is POSTed to when a
+	// device or user this instance has never seen before first makes a request
+	NewDeviceWebhook string `json:"new_device_webhook,omitempty"`
+
+	// SeenDevicesFile records the devices and users already seen, relative to
+	// Caddy's data directory (default: "tailscale_seen_devices.json")
+	SeenDevicesFile string `json:"seen_devices_file,omitempty"`
+
+	// DenyWebhook is a URL that a JSON event is POSTed to for every denied
+	// request, with the user, device, route and reason
+	DenyWebhook string `json:"deny_webhook,omitempty"`
+
+	// Syslog forwards denials, new devices and users and optionally allowed
+	// requests to a syslog server, formatted according to EventFormat
+	Syslog *SyslogConfig `json:"syslog,omitempty"`
+
+	// EventFormat is the body format of new_device_webhook, deny_webhook and
+	// syslog events: "json", or "cef" or "leef" for SIEMs such as Splunk,
+	// QRadar or Sentinel, sent as a single text/plain line (default: "json")
+	EventFormat string `json:"event_format,omitempty"`
+
+	// SessionCookie enables encrypted session cookies valid for this long.
+	// While a client presents a valid cookie from the same IP, its device is
+	// taken from the cookie without a lookup. Policies and all other checks
+	// still apply, and the cookie is removed before the request is proxied
+	SessionCookie caddy.Duration `json:"session_cookie,omitempty"`
+
+	// SessionCookieName is the name of the session cookie (default: "tailscale_auth_session")
+	SessionCookieName string `json:"session_cookie_name,omitempty"`
+
+	// SessionSecret is the key session cookies are encrypted with. Placeholders
+	// such as {env.*} are expanded. Without one, a random key is used and
+	// cookies are invalidated on every config load
+	SessionSecret string `json:"session_secret,omitempty"`
+
+	// AuthpSecret enables passing the identity on to caddy-security's authorize
+	// handler as a bearer token signed with this shared HS256 key. Placeholders
+	// such as {env.*} are expanded
+	AuthpSecret string `json:"authp_secret,omitempty"`
+
+	// AuthpRoles are the roles every token carries, before the user's groups
+	// and the device's tags (default: "authp/user")
+	AuthpRoles []string `json:"authp_roles,omitempty"`
+
+	// AuthpTokenLifetime is how long tokens for caddy-security are valid (default: 5m)
+	AuthpTokenLifetime caddy.Duration `json:"authp_token_lifetime,omitempty"`
+
+	// UpstreamTokens are bearer tokens passed on to the upstream for the
+	// identities they name, so tailnet clients without a token can reach a
+	// token-protected API. The first one that matches is used
+	UpstreamTokens []*UpstreamToken `json:"upstream_tokens,omitempty"`
+
+	// UpstreamBasicAuth are passwords of users, passed on to the upstream as
+	// Basic credentials together with the username, for legacy apps that
+	// only support Basic auth. The first one that matches is used
+	UpstreamBasicAuth []*UpstreamToken `json:"upstream_basic_auth,omitempty"`
+
+	// Output selects where the identity goes: "headers" adds request headers
+	// and vars, "vars_only" only sets vars and the authenticated user, so
+	// nothing reaches upstreams (default: "headers")
+	Output string `json:"output,omitempty"`
+
+	// Detail selects how many identity headers are set: "minimal" (who the
+	// client is), "standard" (plus user, device and tailnet details used for
+	// authorization) or "full" (every field). Vars are unaffected (default: "full")
+	Detail string `json:"detail,omitempty"`
+
+	// HeaderSanitize is what happens to header values with control
+	// characters, such as the CR and LF of a hostile device hostname, or
+	// beyond MaxHeaderLength: "truncate" strips the characters and cuts the
+	// value, "encode" percent-encodes them and cuts it, and "drop" leaves the
+	// header out (default: "truncate")
+	HeaderSanitize string `json:"header_sanitize,omitempty"`
+
+	// MaxHeaderLength caps the length of header values in bytes (default: 2048)
+	MaxHeaderLength int `json:"max_header_length,omitempty"`
+
+	// MultiValue selects how list-valued fields such as addresses, tags and
+	// groups are sent: "join" comma-joins them into one header, "repeat"
+	// sends the header once per value (default: "join")
+	MultiValue string `json:"multi_value,omitempty"`
+
+	// Compat also sets the headers other auth proxies use: "remote_user"
+	// adds Authelia's Remote-User, Remote-Email, Remote-Name and Remote-Groups
+	Compat []string `json:"compat,omitempty"`
+
+	// StatusPath serves an HTML page with the statistics of every device cache,
+	// recent denials and the device inventory at this request path. Only identified clients that
+	// pass the handler's policies can see it, so combine it with e.g. require_role
+	StatusPath string `json:"status_path,omitempty"`
+
+	// DecisionLog writes a JSON record of every allow and deny decision to a
+	// dedicated file, rolled by size and pruned by age, apart from Caddy's logs
+	DecisionLog *logging.FileWriter `json:"decision_log,omitempty"`
+
+	// DecisionIDHeader is a request header, such as X-Request-ID, whose value
+	// becomes the decision ID when it is valid. Otherwise Caddy's request
+	// UUID is used
+	DecisionIDHeader string `json:"decision_id_header,omitempty"`
 
 	// HeaderPrefix is the prefix for headers that will be added (default: "X-Tailscale-")
 	HeaderPrefix string `json:"header_prefix,omitempty"`
 
-	// CacheFile is the path to store the device cache (default: "tailscale_devices.json")
-	CacheFile string `json:"cache_file,omitempty"`
-
-	logger      *zap.Logger
-	deviceCache *DeviceCache
-	cacheMutex  sync.RWMutex
-}
-
-// WhoIsResponse represents the response from Tailscale's whois API
-type WhoIsResponse struct {
-	Node struct {
-		ID            string   `json:"id"`
-		Name          string   `json:"name"`
-		User          string   `json:"user"`
-		Tailnet       string   `json:"tailnet"`
-		Hostname      string   `json:"hostname"`
-		ClientVersion string   `json:"clientVersion"`
-		OS            string   `json:"os"`
-		Created       string   `json:"created"`
-		LastSeen      string   `json:"lastSeen"`
-		Online        bool     `json:"online"`
-		Expired       bool     `json:"expired"`
-		KeyExpiry     string   `json:"keyExpiry"`
-		MachineKey    string   `json:"machineKey"`
-		NodeKey       string   `json:"nodeKey"`
-		Addresses     []string `json:"addresses"`
-		Tags          []string `json:"tags"`
-	} `json:"Node"`
-	UserProfile struct {
-		ID            string `json:"id"`
-		LoginName     string `json:"loginName"`
-		DisplayName   string `json:"displayName"`
-		ProfilePicURL string `json:"profilePicURL"`
-	} `json:"UserProfile"`
-	CapMap map[string][]string `json:"CapMap"`
+	logger       *zap.Logger
+	caches       []*tailnetCache
+	cacheKeys    []string
+	denyTemplate *template.Template
+	skipPaths    caddyhttp.MatchPath
+	userMap      map[string]string
+	pseudonymKey []byte
+	seen         *seenTracker
+	seenKey      string
+	notifySlots  chan struct{}
+	groups       map[string][]string
+
+	sessionAEAD       cipher.AEAD
+	sessionConfig     string
+	node              *tsnetNode
+	authpKey          []byte
+	upstreamTokens    []*upstreamToken
+	upstreamPasswords []*upstreamToken
+
+	decisionLogger *zap.Logger
+	decisionKey    string
+	syslog         *syslogSender
+	policies       []*policy.Policy
+	resolvers      []chainedResolver
+
+	// degraded is set while clients are identified from stale caches, and
+	// lockedDown while max_cache_age rejects them
+	degraded   atomic.Bool
+	lockedDown atomic.Bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -119,358 +375,1420 @@ func (*TailscaleAuth) CaddyModule() caddy.ModuleInfo {
 func (t *TailscaleAuth) Provision(ctx caddy.Context) error {
 	t.logger = ctx.Logger(t)
 
+	// Handler defaults of the app apply before any of the built-in defaults
+	if err := t.inheritHandlerDefaults(ctx); err != nil {
+		return err
+	}
+
+	if t.RedactLogs != "" {
+		t.logger = newRedactingLogger(t.logger, t.RedactLogs, caddy.NewReplacer().ReplaceAll(t.RedactSalt, ""))
+	}
+
 	// Set default values
 	if t.HeaderPrefix == "" {
 		t.HeaderPrefix = "X-Tailscale-"
 	}
 
-	if t.CacheFile == "" {
-		t.CacheFile = "tailscale_devices.json"
+	if err := t.provisionDeny(); err != nil {
+		return err
 	}
 
-	if t.Tailnet == "" {
-		return fmt.Errorf("tailnet is required")
+	if err := initAuthMetrics(ctx.GetMetricsRegistry()); err != nil {
+		return err
 	}
 
-	if t.APIKey == "" {
-		return fmt.Errorf("api_key is required")
+	for i, method := range t.SkipMethods {
+		t.SkipMethods[i] = strings.ToUpper(method)
 	}
 
-	// Initialize device cache
-	t.deviceCache = &DeviceCache{
-		IPToDevice: make(map[string]*Device),
+	t.userMap = make(map[string]string, len(t.MapUsers))
+	for loginName, username := range t.MapUsers {
+		t.userMap[strings.ToLower(loginName)] = username
 	}
 
-	// Load existing cache from disk
-	if err := t.loadDeviceCache(); err != nil {
-		t.logger.Warn("failed to load device cache, starting with empty cache", zap.Error(err))
+	if t.PseudonymSalt != "" {
+		salt := caddy.NewReplacer().ReplaceAll(t.PseudonymSalt, "")
+		if salt == "" {
+			return fmt.Errorf("pseudonym_salt is empty after expanding placeholders")
+		}
+		t.pseudonymKey = []byte(salt)
 	}
 
-	return nil
-}
+	if len(t.SkipPaths) > 0 {
+		t.skipPaths = caddyhttp.MatchPath(slices.Clone(t.SkipPaths))
+		if err := t.skipPaths.Provision(ctx); err != nil {
+			return err
+		}
+	}
 
-// Validate implements caddy.Validator.
-func (t *TailscaleAuth) Validate() error {
-	if t.Tailnet == "" {
-		return fmt.Errorf("tailnet is required")
+	if err := expandPlaceholders(
+		configField{"expected_tailnet", &t.ExpectedTailnet},
+		configField{"groups_file", &t.GroupsFile},
+	); err != nil {
+		return err
 	}
 
-	if t.APIKey == "" {
-		return fmt.Errorf("api_key is required")
+	if err := t.provisionGroups(); err != nil {
+		return err
 	}
 
-	return nil
-}
+	if err := t.provisionPolicies(ctx); err != nil {
+		return err
+	}
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler.
-func (t *TailscaleAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// Get client IP
-	clientIP := getClientIP(r)
-	if clientIP == "" {
-		t.logger.Warn("could not determine client IP")
-		return next.ServeHTTP(w, r)
+	var configs []*TailnetConfig
+	if t.Node != "" {
+		if t.Use != "" || len(t.AdditionalTailnets) > 0 {
+			return fmt.Errorf("node cannot be combined with use or additional_tailnet")
+		}
+		if t.CLIFallback != "" || t.ServeStale != 0 || len(t.Resolvers) > 0 {
+			return fmt.Errorf("node cannot be combined with cli_fallback, serve_stale or resolvers")
+		}
+		// The app registers the node configurations, so it must be provisioned first
+		if _, err := ctx.AppIfConfigured("tailscale_auth"); err != nil && !errors.Is(err, caddy.ErrNotConfigured) {
+			return err
+		}
+		node, err := loadTsnetNode(t.Node)
+		if err != nil {
+			return err
+		}
+		t.node = node
+	} else {
+		var err error
+		if configs, err = t.provisionTailnets(ctx); err != nil {
+			return err
+		}
 	}
 
-	// Get device information from cache (will refresh if not found)
-	device, err := t.getDeviceByIP(clientIP)
-	if err != nil {
-		t.logger.Error("failed to get device info",
-			zap.String("client_ip", clientIP),
-			zap.Error(err))
-		// Continue with the request even if device lookup fails
-		return next.ServeHTTP(w, r)
+	if (len(t.GrantTarget) > 0 || t.PermissionsApp != "") &&
+		!slices.ContainsFunc(configs, func(cfg *TailnetConfig) bool { return cfg.FetchGrants }) {
+		return fmt.Errorf("grant_target and permissions_app need fetch_grants to look up grants")
+	}
+	if t.PermissionsField == "" {
+		t.PermissionsField = defaultPermissionsField
 	}
 
-	// Add device information to headers
-	t.addDeviceHeaders(r, device)
+	t.notifySlots = make(chan struct{}, maxPendingNotifications)
 
-	return next.ServeHTTP(w, r)
-}
+	if t.DecisionLog != nil {
+		if err := t.provisionDecisionLog(ctx); err != nil {
+			return fmt.Errorf("decision_log: %w", err)
+		}
+	}
 
-// addDeviceHeaders adds Tailscale device information to request headers
-func (t *TailscaleAuth) addDeviceHeaders(r *http.Request, device *Device) {
-	// Device information
-	r.Header.Set(t.HeaderPrefix+"Device-ID", device.ID)
-	r.Header.Set(t.HeaderPrefix+"Device-Name", device.Name)
-	r.Header.Set(t.HeaderPrefix+"Device-User", device.User)
-	r.Header.Set(t.HeaderPrefix+"Device-Hostname", device.Hostname)
-	r.Header.Set(t.HeaderPrefix+"Device-OS", device.OS)
-	r.Header.Set(t.HeaderPrefix+"Device-Authorized", fmt.Sprintf("%t", device.Authorized))
-	r.Header.Set(t.HeaderPrefix+"Device-NodeID", device.NodeID)
+	if t.Syslog != nil {
+		if err := expandPlaceholders(t.Syslog.placeholderFields()...); err != nil {
+			return err
+		}
+		if err := t.Syslog.validate(); err != nil {
+			return err
+		}
+		sender, err := newSyslogSender(t.Syslog, t.EventFormat, t.logger)
+		if err != nil {
+			return err
+		}
+		t.syslog = sender
+	}
 
-	// Device addresses (join multiple addresses with comma)
-	if len(device.Addresses) > 0 {
-		r.Header.Set(t.HeaderPrefix+"Device-Addresses", strings.Join(device.Addresses, ","))
+	if t.NewDeviceWebhook != "" || t.syslog != nil {
+		if t.SeenDevicesFile == "" {
+			t.SeenDevicesFile = "tailscale_seen_devices.json"
+		}
+		path := resolveDataPath(t.SeenDevicesFile)
+		seen, _, err := seenPool.LoadOrNew(path, func() (caddy.Destructor, error) {
+			return newSeenTracker(path, t.logger), nil
+		})
+		if err != nil {
+			return err
+		}
+		t.seen = seen.(*seenTracker)
+		t.seenKey = path
 	}
 
-	// Additional device metadata
-	r.Header.Set(t.HeaderPrefix+"Device-ClientVersion", device.ClientVersion)
-	r.Header.Set(t.HeaderPrefix+"Device-LastSeen", device.LastSeen)
-	r.Header.Set(t.HeaderPrefix+"Device-Created", device.Created)
-}
+	if t.SessionCookie > 0 {
+		if err := t.provisionSession(); err != nil {
+			return err
+		}
+	}
 
-func (m *TailscaleAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
-		for d.NextBlock(0) {
-			switch d.Val() {
-			case "api_key":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				m.APIKey = d.Val()
+	if t.AuthpSecret != "" {
+		if err := t.provisionAuthp(); err != nil {
+			return err
+		}
+	}
 
-			case "tailnet":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				m.Tailnet = d.Val()
+	if err := t.provisionUpstreamTokens(); err != nil {
+		return err
+	}
 
-			case "header_prefix":
-				if !d.NextArg() {
-					m.HeaderPrefix = "X-Tailscale-"
-				} else {
-					m.HeaderPrefix = d.Val()
-				}
+	// Share the live caches with other handlers for the same tailnet, including
+	// the handlers of the previous config during a graceful reload
+	for _, cfg := range configs {
+		cache, key, err := cfg.loadCache(ctx, t.logger.With(zap.String("tailnet", cfg.Tailnet)))
+		if err != nil {
+			return err
+		}
+		t.cacheKeys = append(t.cacheKeys, key)
+		t.caches = append(t.caches, cache)
+	}
 
-			case "cache_file":
-				if !d.NextArg() {
-					return d.ArgErr()
-				}
-				m.CacheFile = d.Val()
-			}
+	if t.node == nil {
+		if err := t.provisionResolvers(); err != nil {
+			return err
 		}
 	}
+
+	liveHandlers.add(t)
 	return nil
 }
 
-// loadDeviceCache loads the device cache from disk
-func (t *TailscaleAuth) loadDeviceCache() error {
-	cacheFile := t.getCacheFilePath()
+// provisionTailnets resolves the handler's tailnet configurations and returns
+// the ones to look devices up in
+func (t *TailscaleAuth) provisionTailnets(ctx caddy.Context) ([]*TailnetConfig, error) {
+	if err := t.TailnetConfig.expandPlaceholders(); err != nil {
+		return nil, err
+	}
+	if err := resolveAppConfig(ctx, t.Use, &t.TailnetConfig); err != nil {
+		return nil, err
+	}
+
+	t.TailnetConfig.setDefaults()
 
-	data, err := os.ReadFile(cacheFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // Cache file doesn't exist, start with empty cache
+	if err := t.TailnetConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	configs := []*TailnetConfig{&t.TailnetConfig}
+	for _, cfg := range t.AdditionalTailnets {
+		if cfg == nil {
+			return nil, fmt.Errorf("additional tailnet: configuration is empty")
+		}
+		if err := cfg.expandPlaceholders(); err != nil {
+			return nil, fmt.Errorf("additional tailnet: %w", err)
 		}
-		return fmt.Errorf("failed to read cache file: %w", err)
+		cfg.inheritAdditional(&t.TailnetConfig)
+		cfg.setDefaults()
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("additional tailnet %q: %w", cfg.Tailnet, err)
+		}
+		configs = append(configs, cfg)
 	}
 
-	t.cacheMutex.Lock()
-	defer t.cacheMutex.Unlock()
+	// Devices from other tailnets are denied anyway, so only the expected one is looked up
+	if t.ExpectedTailnet != "" {
+		configs = slices.DeleteFunc(configs, func(cfg *TailnetConfig) bool {
+			return !strings.EqualFold(cfg.Tailnet, t.ExpectedTailnet)
+		})
+		if len(configs) == 0 {
+			return nil, fmt.Errorf("expected_tailnet %q is not one of the configured tailnets", t.ExpectedTailnet)
+		}
+	}
 
-	if err := json.Unmarshal(data, t.deviceCache); err != nil {
-		return fmt.Errorf("failed to unmarshal cache: %w", err)
+	if t.APIClient != nil {
+		for _, cfg := range configs {
+			cfg.client = t.APIClient
+		}
 	}
 
-	t.logger.Info("loaded device cache",
-		zap.Int("device_count", len(t.deviceCache.IPToDevice)),
-		zap.String("last_update", t.deviceCache.LastUpdate))
+	keyMaterial, err := appKeyMaterial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range configs {
+		cfg.keyMaterial = keyMaterial
+	}
 
-	return nil
+	return configs, nil
 }
 
-// saveDeviceCache saves the device cache to disk
-func (t *TailscaleAuth) saveDeviceCache() error {
-	cacheFile := t.getCacheFilePath()
-	cacheDir := filepath.Dir(cacheFile)
+// Validate implements caddy.Validator.
+func (t *TailscaleAuth) Validate() error {
+	if t.Node == "" {
+		if err := t.TailnetConfig.validate(); err != nil {
+			return err
+		}
+	}
 
-	t.logger.Info("attempting to save device cache",
-		zap.String("cache_file", cacheFile),
-		zap.String("cache_dir", cacheDir))
+	for _, p := range append([]*policy.Policy{&t.Policy}, t.policies...) {
+		if len(p.RequireRole) > 0 && !t.FetchUsers {
+			return fmt.Errorf("require_role needs fetch_users to look up user roles")
+		}
 
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create cache directory %s: %w", cacheDir, err)
+		if len(p.RequirePosture) > 0 && !t.FetchPosture {
+			return fmt.Errorf("require_posture needs fetch_posture to look up posture attributes")
+		}
 	}
-	t.logger.Debug("cache directory created/verified", zap.String("cache_dir", cacheDir))
 
-	// Note: We don't need to lock here because the caller (refreshDeviceCache) already holds the write lock
-	data, err := json.MarshalIndent(t.deviceCache, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal cache: %w", err)
+	switch t.DenyStatus {
+	case 0, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+	default:
+		return fmt.Errorf("deny_status must be 401, 403 or 404, got %d", t.DenyStatus)
 	}
 
-	t.logger.Debug("cache data marshaled", zap.Int("data_size", len(data)))
+	switch t.DenyFormat {
+	case "", "error", "negotiate":
+	default:
+		return fmt.Errorf("deny_format must be 'error' or 'negotiate', got %q", t.DenyFormat)
+	}
 
-	if err := os.WriteFile(cacheFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write cache file %s: %w", cacheFile, err)
+	if t.KeyExpiryThreshold < 0 {
+		return fmt.Errorf("key_expiry_threshold must not be negative")
 	}
 
-	t.logger.Info("device cache saved successfully",
-		zap.String("cache_file", cacheFile),
-		zap.Int("data_size", len(data)))
+	switch t.KeyExpiryAction {
+	case "", "warn", "deny":
+	default:
+		return fmt.Errorf("key_expiry_action must be 'warn' or 'deny', got %q", t.KeyExpiryAction)
+	}
 
-	return nil
-}
+	switch t.BlocksIncomingAction {
+	case "", "warn", "deny":
+	default:
+		return fmt.Errorf("blocks_incoming_action must be 'warn' or 'deny', got %q", t.BlocksIncomingAction)
+	}
 
-// getCacheFilePath returns the full path to the cache file
-func (t *TailscaleAuth) getCacheFilePath() string {
-	if filepath.IsAbs(t.CacheFile) {
-		return t.CacheFile
+	if t.MaxLastSeen < 0 {
+		return fmt.Errorf("max_last_seen must not be negative")
 	}
-	// If relative path, use current working directory
-	return t.CacheFile
-}
 
-// refreshDeviceCache fetches the latest device list from Tailscale API
-func (t *TailscaleAuth) refreshDeviceCache() error {
-	url := fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/devices", t.Tailnet)
+	switch t.StaleAction {
+	case "", "skip", "deny":
+	default:
+		return fmt.Errorf("stale_action must be 'skip' or 'deny', got %q", t.StaleAction)
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	if err := t.Policy.Validate(); err != nil {
+		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+t.APIKey)
-	req.Header.Set("User-Agent", "Caddy-Tailscale-Auth/1.0")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to make request: %w", err)
+	if t.AuthpTokenLifetime < 0 {
+		return fmt.Errorf("authp_token_lifetime must not be negative")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("API request failed with status %d", resp.StatusCode)
+	if t.SessionCookie < 0 {
+		return fmt.Errorf("session_cookie must not be negative")
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+	switch t.FailMode {
+	case "", "open", "closed":
+	default:
+		return fmt.Errorf("fail_mode must be 'open' or 'closed', got %q", t.FailMode)
+	}
+
+	switch t.EventFormat {
+	case "", "json", "cef", "leef":
+	default:
+		return fmt.Errorf("event_format must be 'json', 'cef' or 'leef', got %q", t.EventFormat)
+	}
+
+	if t.StatusPath != "" && !strings.HasPrefix(t.StatusPath, "/") {
+		return fmt.Errorf("status_path must start with '/', got %q", t.StatusPath)
+	}
+
+	switch t.Output {
+	case "", "headers", "vars_only":
+	default:
+		return fmt.Errorf("output must be 'headers' or 'vars_only', got %q", t.Output)
+	}
+
+	switch t.Detail {
+	case "", "minimal", "standard", "full":
+	default:
+		return fmt.Errorf("detail must be 'minimal', 'standard' or 'full', got %q", t.Detail)
+	}
+
+	if err := t.validateHeaderSanitize(); err != nil {
+		return err
+	}
+
+	switch t.MultiValue {
+	case "", "join", "repeat":
+	default:
+		return fmt.Errorf("multi_value must be 'join' or 'repeat', got %q", t.MultiValue)
+	}
+
+	if err := validateRedactLogs(t.RedactLogs); err != nil {
+		return err
 	}
 
-	var devicesResp DevicesResponse
-	if err := json.Unmarshal(body, &devicesResp); err != nil {
-		return fmt.Errorf("failed to unmarshal response: %w", err)
+	if t.TrustServeHeaders && (t.ExpectedTailnet != "" || t.DenyExternal || len(t.RequireRole) > 0 ||
+		len(t.RequirePosture) > 0 || len(t.AllowOS) > 0 || len(t.DenyOS) > 0 ||
+		len(t.AllowHostnames) > 0 || len(t.DenyHostnames) > 0 || t.KeyExpiryThreshold > 0 || t.MaxLastSeen > 0 ||
+		t.BlocksIncomingAction != "" || t.RequireUpdatedClient || t.RequireTailnetLockOK) {
+		return fmt.Errorf("trust_serve_headers only carries the user's login and name, so it cannot be combined with tailnet, role or device policies")
 	}
 
-	// Update cache with new device data
-	t.cacheMutex.Lock()
-	defer t.cacheMutex.Unlock()
+	authorization := 0
+	for _, set := range []bool{t.AuthpSecret != "", len(t.UpstreamTokens) > 0, len(t.UpstreamBasicAuth) > 0} {
+		if set {
+			authorization++
+		}
+	}
+	if authorization > 1 {
+		return fmt.Errorf("authp_secret, upstream_tokens and upstream_basic_auth all set the Authorization header, so only one of them can be used")
+	}
 
-	// Clear existing cache
-	t.deviceCache.IPToDevice = make(map[string]*Device)
+	if err := validateCompat(t.Compat); err != nil {
+		return err
+	}
 
-	// Populate cache with new devices
-	for i := range devicesResp.Devices {
-		device := &devicesResp.Devices[i]
-		for _, addr := range device.Addresses {
-			t.deviceCache.IPToDevice[addr] = device
+	switch t.FunnelAction {
+	case "", "deny":
+	case "skip", "tag":
+		if t.requiresIdentity() {
+			return fmt.Errorf("funnel_action %q lets unidentified requests through, which conflicts with identity policies", t.FunnelAction)
 		}
+	default:
+		return fmt.Errorf("funnel_action must be 'deny', 'skip' or 'tag', got %q", t.FunnelAction)
+	}
+
+	switch t.NonTailnetAction {
+	case "", "skip", "deny":
+	default:
+		return fmt.Errorf("non_tailnet_action must be 'skip' or 'deny', got %q", t.NonTailnetAction)
 	}
 
-	t.deviceCache.LastUpdate = resp.Header.Get("Date")
+	switch t.ClientIPSource {
+	case "", "headers", "connection":
+	default:
+		return fmt.Errorf("client_ip_source must be 'headers' or 'connection', got %q", t.ClientIPSource)
+	}
 
-	t.logger.Info("refreshed device cache",
-		zap.Int("device_count", len(devicesResp.Devices)),
-		zap.Int("ip_mappings", len(t.deviceCache.IPToDevice)))
+	if t.MaxCacheAge < 0 {
+		return fmt.Errorf("max_cache_age must not be negative")
+	}
+	if t.MaxCacheAge != 0 && t.MaxCacheAge <= t.ServeStale {
+		return fmt.Errorf("max_cache_age must be longer than serve_stale, or no stale identity is ever served")
+	}
 
-	// Save updated cache to disk
-	if err := t.saveDeviceCache(); err != nil {
-		t.logger.Error("failed to save device cache", zap.Error(err))
+	for _, cfg := range t.AdditionalTailnets {
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("additional tailnet %q: %w", cfg.Tailnet, err)
+		}
 	}
 
 	return nil
 }
 
-// getDeviceByIP returns the device for the given IP address, refreshing cache if needed
-func (t *TailscaleAuth) getDeviceByIP(clientIP string) (*Device, error) {
-	// First, check if device exists in cache
-	t.cacheMutex.RLock()
-	device, exists := t.deviceCache.IPToDevice[clientIP]
-	t.cacheMutex.RUnlock()
+// Cleanup implements caddy.CleanerUpper.
+func (t *TailscaleAuth) Cleanup() error {
+	liveHandlers.remove(t)
 
-	if exists && device != nil {
-		return device, nil
+	for _, key := range t.cacheKeys {
+		if _, err := cachePool.Delete(key); err != nil {
+			return err
+		}
 	}
+	t.cacheKeys = nil
 
-	// Device not found in cache, refresh and try again
-	t.logger.Info("unknown device IP, refreshing cache", zap.String("client_ip", clientIP))
+	if t.seenKey != "" {
+		if _, err := seenPool.Delete(t.seenKey); err != nil {
+			return err
+		}
+		t.seenKey = ""
+	}
 
-	if err := t.refreshDeviceCache(); err != nil {
-		return nil, fmt.Errorf("failed to refresh device cache: %w", err)
+	if t.syslog != nil {
+		t.syslog.close()
+		t.syslog = nil
 	}
 
-	// Check cache again after refresh
-	t.cacheMutex.RLock()
-	device, exists = t.deviceCache.IPToDevice[clientIP]
-	t.cacheMutex.RUnlock()
+	t.closeUpstreamTokens()
 
-	if !exists || device == nil {
-		return nil, fmt.Errorf("device not found for IP %s even after cache refresh", clientIP)
+	if t.decisionKey != "" {
+		if _, err := logWriterPool.Delete(t.decisionKey); err != nil {
+			return err
+		}
+		t.decisionKey = ""
 	}
 
-	return device, nil
+	if t.node != nil {
+		if _, err := nodePool.Delete(t.Node); err != nil {
+			return err
+		}
+		t.node = nil
+	}
+	return nil
 }
 
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the list
-		if idx := strings.Index(xff, ","); idx != -1 {
-			return strings.TrimSpace(xff[:idx])
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (t *TailscaleAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	t.stripIdentityHeaders(r)
+	t.stripCompatHeaders(r)
+	session := t.takeSessionCookie(r)
+
+	if t.StatusPath != "" && r.URL.Path == t.StatusPath {
+		next = caddyhttp.HandlerFunc(t.serveStatus)
+	}
+
+	skip, err := t.skipRequest(r)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if skip {
+		return next.ServeHTTP(w, r)
+	}
+
+	if t.FunnelAction != "" && isFunnelRequest(r) {
+		if t.FunnelAction == "deny" {
+			return t.deny(w, r, reasonFunnel, nil, fmt.Errorf("request came in through Tailscale Funnel"))
 		}
-		return strings.TrimSpace(xff)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.via", "funnel")
+		if t.FunnelAction == "tag" {
+			t.setHeader(r, "Via", "funnel")
+		}
+		return next.ServeHTTP(w, r)
 	}
 
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	// Get client IP
+	clientIP := t.clientIP(r)
+	if clientIP == "" {
+		t.logger.Warn("could not determine client IP")
+		if t.requiresIdentity() {
+			return t.deny(w, r, reasonUnidentified, nil, fmt.Errorf("could not determine client IP"))
+		}
+		t.reportUnidentified(r, reasonUnidentified, fmt.Errorf("could not determine client IP"))
+		return next.ServeHTTP(w, r)
 	}
 
-	// Fall back to RemoteAddr
-	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return host
+	if t.TrustServeHeaders {
+		if match, ok := serveIdentity(r); ok {
+			if reason, err := t.checkPolicies(r, match); err != nil {
+				return t.deny(w, r, reason, match.device, err)
+			}
+			t.addServeHeaders(r, match)
+			t.logDecision(r, "allow", "", match, nil)
+			return next.ServeHTTP(w, r)
+		}
 	}
 
-	return r.RemoteAddr
+	// Get device information from the session cookie or the cache (will refresh if not found)
+	match, fromSession := t.sessionMatch(session, clientIP)
+	if !fromSession {
+		match, err = t.getDevice(r.Context(), clientIP)
+	}
+	if errors.Is(err, errNotTailnetAddr) {
+		if t.NonTailnetAction == "deny" || t.requiresIdentity() {
+			return t.deny(w, r, reasonNonTailnet, nil, fmt.Errorf("client %s is not a Tailscale address", clientIP))
+		}
+		t.logger.Debug("skipping non-tailnet client", zap.String("client_ip", clientIP))
+		t.reportUnidentified(r, reasonNonTailnet, fmt.Errorf("client %s is not a Tailscale address", clientIP))
+		return next.ServeHTTP(w, r)
+	}
+	if err != nil {
+		t.logger.Error("failed to get device info",
+			zap.String("client_ip", clientIP),
+			zap.Error(err))
+		if t.FailMode == "closed" || t.requiresIdentity() {
+			return t.deny(w, r, reasonUnidentified, nil, fmt.Errorf("device for %s could not be identified", clientIP))
+		}
+		// Continue with the request even if device lookup fails
+		t.reportUnidentified(r, reasonUnidentified, fmt.Errorf("device for %s could not be identified", clientIP))
+		return next.ServeHTTP(w, r)
+	}
+	match, err = t.checkCacheAge(r.Context(), clientIP, match)
+	if err != nil {
+		t.logger.Warn("not attributing request to outdated identity",
+			zap.String("client_ip", clientIP),
+			zap.Error(err))
+		if t.FailMode == "closed" || t.requiresIdentity() {
+			return t.deny(w, r, reasonLockdown, nil, fmt.Errorf("device for %s could not be identified from a current cache", clientIP))
+		}
+		t.reportUnidentified(r, reasonLockdown, fmt.Errorf("device for %s could not be identified from a current cache", clientIP))
+		return next.ServeHTTP(w, r)
+	}
+
+	if match.stale {
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.cache", "stale")
+		if t.Output != "vars_only" {
+			w.Header().Set(t.HeaderPrefix+"Cache", "stale")
+		}
+	}
+
+	match, fresh := t.checkLastSeen(r.Context(), clientIP, match)
+	if !fresh {
+		if t.StaleAction == "deny" || t.requiresIdentity() {
+			return t.deny(w, r, reasonStale, nil, fmt.Errorf("device for %s was not seen within %s", clientIP, time.Duration(t.MaxLastSeen)))
+		}
+		t.logger.Warn("not attributing request to stale device", zap.String("client_ip", clientIP))
+		t.reportUnidentified(r, reasonStale, fmt.Errorf("device for %s was not seen within %s", clientIP, time.Duration(t.MaxLastSeen)))
+		return next.ServeHTTP(w, r)
+	}
+	match = t.refetchFlagged(r.Context(), clientIP, match)
+
+	device := match.device
+	if t.seen != nil {
+		t.notifyNewDevice(r, match)
+	}
+
+	if reason, err := t.checkPolicies(r, match); err != nil {
+		return t.deny(w, r, reason, device, err)
+	}
+
+	if device.BlocksIncomingConnections {
+		if t.BlocksIncomingAction == "deny" {
+			return t.deny(w, r, reasonShieldsUp, device, fmt.Errorf("device %s blocks incoming connections", device.Name))
+		}
+		if t.BlocksIncomingAction == "warn" {
+			t.logger.Warn("device blocks incoming connections", zap.String("device", device.Name))
+		}
+	}
+
+	keyExpiring := t.keyExpiring(device, time.Now())
+	if keyExpiring {
+		if t.KeyExpiryAction == "deny" {
+			return t.deny(w, r, reasonKeyExpiry, device, fmt.Errorf("key of device %s expires at %s", device.Name, device.Expires))
+		}
+		t.logger.Warn("device key expires soon",
+			zap.String("device", device.Name),
+			zap.String("expires", device.Expires))
+	}
+
+	// Add device information to headers
+	t.addDeviceHeaders(r, match)
+	if keyExpiring {
+		t.setHeader(r, "Key-Expiry-Warning", "true")
+	}
+
+	if t.sessionAEAD != nil && !fromSession {
+		t.setSessionCookie(w, r, clientIP, match)
+	}
+
+	t.logDecision(r, "allow", "", match, nil)
+	return next.ServeHTTP(w, r)
 }
 
-// parseCaddyfile unmarshals tokens from h into a new Middleware.
-func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var t TailscaleAuth
+// skipRequest reports whether the request is excluded by skip_paths or skip_methods
+func (t *TailscaleAuth) skipRequest(r *http.Request) (bool, error) {
+	if slices.Contains(t.SkipMethods, r.Method) {
+		return true, nil
+	}
 
-	for h.Next() {
-		for h.NextBlock(0) {
-			switch h.Val() {
-			case "api_key":
-				if !h.NextArg() {
-					return nil, h.ArgErr()
-				}
-				t.APIKey = h.Val()
+	if t.skipPaths != nil {
+		return t.skipPaths.MatchWithError(r)
+	}
 
-			case "tailnet":
-				if !h.NextArg() {
-					return nil, h.ArgErr()
-				}
-				t.Tailnet = h.Val()
+	return false, nil
+}
 
-			case "header_prefix":
-				if !h.NextArg() {
-					return nil, h.ArgErr()
-				}
-				t.HeaderPrefix = h.Val()
+// checkLastSeen enforces max_last_seen. A device that looks stale in the cache
+// is refetched once, since cached lastSeen values age between refreshes. It
+// returns the possibly updated match and whether it is fresh enough
+func (t *TailscaleAuth) checkLastSeen(ctx context.Context, clientIP string, match *deviceMatch) (*deviceMatch, bool) {
+	if t.MaxLastSeen == 0 || match.device.SeenWithin(time.Duration(t.MaxLastSeen), time.Now()) {
+		return match, true
+	}
 
-			case "cache_file":
-				if !h.NextArg() {
-					return nil, h.ArgErr()
-				}
-				t.CacheFile = h.Val()
+	// Devices identified through a tsnet node are already current
+	if match.cache == nil {
+		return match, false
+	}
 
-			default:
-				return nil, h.Errf("unrecognized subdirective: %s", h.Val())
-			}
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	if err := match.cache.refreshDevice(ctx, match.device.ID); err != nil {
+		t.logger.Warn("failed to refetch stale device",
+			zap.String("device", match.device.Name),
+			zap.Error(err))
+		return match, false
+	}
+
+	refetched, ok := match.cache.match(clientIP)
+	if !ok {
+		return match, false
+	}
+	return refetched, refetched.device.SeenWithin(time.Duration(t.MaxLastSeen), time.Now())
+}
+
+// keyExpiring reports whether the device's key expires within key_expiry_threshold
+func (t *TailscaleAuth) keyExpiring(device *Device, now time.Time) bool {
+	if t.KeyExpiryThreshold == 0 {
+		return false
+	}
+	expiresIn, ok := device.KeyExpiresIn(now)
+	return ok && expiresIn <= time.Duration(t.KeyExpiryThreshold)
+}
+
+// getDevice identifies the client IP through the embedded node or the resolver chain
+func (t *TailscaleAuth) getDevice(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	if t.node != nil {
+		match, err := t.node.whois(ctx, clientIP)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.checkExpectedTailnet(clientIP, match); err != nil {
+			return nil, err
 		}
+		return match, nil
 	}
+	return t.resolve(ctx, clientIP)
+}
+
+// checkExpectedTailnet rejects devices outside expected_tailnet, such as
+// devices shared in from other tailnets
+func (t *TailscaleAuth) checkExpectedTailnet(clientIP string, match *deviceMatch) error {
+	if t.ExpectedTailnet != "" && !strings.EqualFold(match.tailnet, t.ExpectedTailnet) {
+		return fmt.Errorf("%s is in tailnet %s", clientIP, match.tailnet)
+	}
+	return nil
+}
+
+// setAuthUser sets the authenticated user like Caddy's authentication handler,
+// so it shows up as user_id in access logs. Log redaction only covers this
+// module's logs, so it is left out then
+func (t *TailscaleAuth) setAuthUser(r *http.Request, loginName string) {
+	if t.RedactLogs != "" {
+		return
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.auth.user.id", t.localUsername(loginName))
+	}
+}
+
+// privacyHeaders are the headers still forwarded in privacy mode
+var privacyHeaders = map[string]bool{
+	"Device-User":    true,
+	"User-LoginName": true,
+	"Device-Name":    true,
+	"Decision-ID":    true,
+	"Permissions":    true,
+	"Via":            true,
+}
+
+// detailHeaders are the headers forwarded at each detail level below full
+var detailHeaders = map[string]map[string]bool{
+	"minimal": {
+		"Identity-Type":  true,
+		"Groups":         true,
+		"User-LoginName": true,
+		"Device-User":    true,
+		"Device-Name":    true,
+		"Decision-ID":    true,
+		"Permissions":    true,
+		"Via":            true,
+	},
+	"standard": {
+		"Identity-Type":       true,
+		"Groups":              true,
+		"User-LoginName":      true,
+		"Device-User":         true,
+		"Device-Name":         true,
+		"Decision-ID":         true,
+		"Permissions":         true,
+		"Tailnet":             true,
+		"Via":                 true,
+		"Via-Subnet-Router":   true,
+		"Via-Site-ID":         true,
+		"Via-Site-Address":    true,
+		"User-DisplayName":    true,
+		"User-ProfilePicURL":  true,
+		"User-Role":           true,
+		"User-Status":         true,
+		"Device-ID":           true,
+		"Device-ShortName":    true,
+		"Device-OS":           true,
+		"Device-Tags":         true,
+		"Device-Capabilities": true,
+		"Identity-URI":        true,
+		"Key-Expiry-Warning":  true,
+	},
+}
 
-	return &t, nil
+// stripIdentityHeaders removes every prefixed header sent by the client,
+// including the ones this handler leaves out because of privacy, detail,
+// vars_only or a skipped request, so upstreams only ever see values set by
+// this handler. The decision_id_header is kept, to propagate its ID
+func (t *TailscaleAuth) stripIdentityHeaders(r *http.Request) {
+	prefix := http.CanonicalHeaderKey(t.HeaderPrefix)
+	keep := http.CanonicalHeaderKey(t.DecisionIDHeader)
+	for name := range r.Header {
+		if name != keep && strings.HasPrefix(http.CanonicalHeaderKey(name), prefix) {
+			delete(r.Header, name)
+		}
+	}
+}
+
+// setHeader sets the prefixed request header name, unless privacy mode,
+// the detail level or vars_only output suppresses it
+func (t *TailscaleAuth) setHeader(r *http.Request, name, value string) {
+	if t.headerAllowed(name) {
+		t.setSanitizedHeader(r, t.HeaderPrefix+name, value)
+	}
+}
+
+// setListHeader is setHeader for list-valued fields, sent as multi_value selects
+func (t *TailscaleAuth) setListHeader(r *http.Request, name string, values []string) {
+	if t.headerAllowed(name) {
+		t.setSanitizedList(r, t.HeaderPrefix+name, values)
+	}
+}
+
+// headerAllowed reports whether privacy mode, the detail level and the
+// output let the prefixed header name through
+func (t *TailscaleAuth) headerAllowed(name string) bool {
+	if t.Output == "vars_only" || t.Privacy && !privacyHeaders[name] {
+		return false
+	}
+	allowed, ok := detailHeaders[t.Detail]
+	return !ok || allowed[name]
+}
+
+// addDeviceHeaders adds Tailscale device information to request headers
+func (t *TailscaleAuth) addDeviceHeaders(r *http.Request, match *deviceMatch) {
+	device := match.device
+
+	t.setHeader(r, "Tailnet", match.tailnet)
+	t.setHeader(r, "Identity-Type", device.IdentityType())
+	if match.viaSubnetRouter {
+		t.setHeader(r, "Via-Subnet-Router", "true")
+	}
+	if match.siteAddr.IsValid() {
+		t.setHeader(r, "Via-Site-ID", strconv.FormatUint(uint64(match.siteID), 10))
+		t.setHeader(r, "Via-Site-Address", match.siteAddr.String())
+	}
+
+	if groups := t.userGroups(match); len(groups) > 0 {
+		t.setListHeader(r, "Groups", groups)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.groups", strings.Join(groups, ","))
+	}
+
+	if user := match.user; user != nil && device.IdentityType() == "user" {
+		t.setHeader(r, "User-LoginName", t.localUsername(user.LoginName))
+		if t.pseudonymKey == nil {
+			t.setHeader(r, "User-DisplayName", user.DisplayName)
+		}
+		t.setHeader(r, "User-Role", user.Role)
+		t.setHeader(r, "User-Status", user.Status)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.user_role", user.Role)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.user_status", user.Status)
+	}
+
+	// Device information
+	t.setHeader(r, "Device-ID", device.ID)
+	t.setHeader(r, "Device-Name", device.Name)
+	t.setHeader(r, "Device-ShortName", shortName(device.Name))
+	t.setHeader(r, "Device-User", t.localUsername(device.User))
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.username", t.localUsername(device.User))
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.login_name", device.User)
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.device_id", device.ID)
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.device_name", device.Name)
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.device_short_name", shortName(device.Name))
+	t.setAuthUser(r, device.User)
+	displayName := ""
+	if match.user != nil {
+		displayName = match.user.DisplayName
+	}
+	t.addRemoteUserHeaders(r, match, device.User, displayName)
+	t.setHeader(r, "Device-Hostname", device.Hostname)
+	t.setHeader(r, "Device-OS", device.OS)
+	t.setHeader(r, "Device-Authorized", fmt.Sprintf("%t", device.Authorized))
+	t.setHeader(r, "Device-External", fmt.Sprintf("%t", device.IsExternal))
+	t.setHeader(r, "Device-Blocks-Incoming", fmt.Sprintf("%t", device.BlocksIncomingConnections))
+	t.setHeader(r, "Device-NodeID", device.NodeID)
+	identityURI := t.identityURI(match)
+	t.setHeader(r, "Identity-URI", identityURI)
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.identity_uri", identityURI)
+	t.setHeader(r, "Decision-ID", t.decisionID(r))
+
+	// Device addresses (join multiple addresses with comma)
+	if len(device.Addresses) > 0 {
+		t.setListHeader(r, "Device-Addresses", device.Addresses)
+	}
+
+	if len(device.Tags) > 0 {
+		t.setListHeader(r, "Device-Tags", device.Tags)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.tags", strings.Join(device.Tags, ","))
+	}
+
+	if len(device.PostureAttributes) > 0 {
+		keys := slices.Sorted(maps.Keys(device.PostureAttributes))
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			value := fmt.Sprint(device.PostureAttributes[key])
+			pairs = append(pairs, key+"="+value)
+			caddyhttp.SetVar(r.Context(), "tailscale_auth.posture."+key, value)
+		}
+		t.setListHeader(r, "Device-Posture", pairs)
+	}
+
+	if capabilities := t.capabilities(match); len(capabilities) > 0 {
+		t.setListHeader(r, "Device-Capabilities", capabilities)
+		caddyhttp.SetVar(r.Context(), "tailscale_auth.capabilities", strings.Join(capabilities, ","))
+	}
+	t.addPermissions(r, match)
+
+	if expiresIn, ok := device.KeyExpiresIn(time.Now()); ok {
+		t.setHeader(r, "Key-Expires-In", strconv.FormatInt(int64(expiresIn/time.Second), 10))
+	}
+
+	// Additional device metadata
+	t.setHeader(r, "Device-ClientVersion", device.ClientVersion)
+	t.setHeader(r, "Update-Available", fmt.Sprintf("%t", device.UpdateAvailable))
+	t.setHeader(r, "Device-TailnetLockKey", device.TailnetLockKey)
+	t.setHeader(r, "Device-TailnetLockError", device.TailnetLockError)
+	t.setHeader(r, "Device-LastSeen", device.LastSeen)
+	t.setHeader(r, "Device-Created", device.Created)
+
+	if t.authpKey != nil {
+		t.addAuthpToken(r, match)
+	}
+	if len(t.upstreamTokens) > 0 {
+		t.addUpstreamToken(r, match)
+	}
+	if len(t.upstreamPasswords) > 0 {
+		t.addUpstreamBasicAuth(r, match)
+	}
+}
+
+func (m *TailscaleAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			if ok, err := m.TailnetConfig.unmarshalCaddyfileOption(d); ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if ok, err := unmarshalPolicyOption(&m.Policy, d); ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			switch d.Val() {
+			case "use":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Use = d.Val()
+
+			case "node":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Node = d.Val()
+
+			case "fail_mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.FailMode = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Policies = append(m.Policies, d.Val())
+				m.Policies = append(m.Policies, d.RemainingArgs()...)
+
+			case "additional_tailnet":
+				cfg := new(TailnetConfig)
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cfg.Tailnet = d.Val()
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					ok, err := cfg.unmarshalCaddyfileOption(d)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return d.Errf("unrecognized subdirective: %s", d.Val())
+					}
+				}
+				m.AdditionalTailnets = append(m.AdditionalTailnets, cfg)
+
+			case "max_cache_age":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxAge, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_cache_age %q: %v", d.Val(), err)
+				}
+				m.MaxCacheAge = caddy.Duration(maxAge)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "serve_stale":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxAge, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid serve_stale %q: %v", d.Val(), err)
+				}
+				m.ServeStale = caddy.Duration(maxAge)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "cli_fallback":
+				m.CLIFallback = "tailscale"
+				if d.NextArg() {
+					m.CLIFallback = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "resolvers":
+				resolvers, err := unmarshalResolvers(d)
+				if err != nil {
+					return err
+				}
+				m.Resolvers = append(m.Resolvers, resolvers...)
+
+			case "expected_tailnet":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ExpectedTailnet = d.Val()
+
+			case "key_expiry_threshold":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				threshold, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid key_expiry_threshold %q: %v", d.Val(), err)
+				}
+				m.KeyExpiryThreshold = caddy.Duration(threshold)
+				if d.NextArg() {
+					m.KeyExpiryAction = d.Val()
+				}
+
+			case "max_last_seen":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxAge, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_last_seen %q: %v", d.Val(), err)
+				}
+				m.MaxLastSeen = caddy.Duration(maxAge)
+				if d.NextArg() {
+					m.StaleAction = d.Val()
+				}
+
+			case "groups":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Groups == nil {
+					m.Groups = make(map[string][]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					group := d.Val()
+					members := d.RemainingArgs()
+					if len(members) == 0 {
+						return d.ArgErr()
+					}
+					m.Groups[group] = append(m.Groups[group], members...)
+				}
+
+			case "groups_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.GroupsFile = d.Val()
+
+			case "permissions_app":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PermissionsApp = d.Val()
+				if d.NextArg() {
+					m.PermissionsField = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "grant_target":
+				targets := d.RemainingArgs()
+				if len(targets) == 0 {
+					return d.ArgErr()
+				}
+				m.GrantTarget = append(m.GrantTarget, targets...)
+
+			case "non_tailnet_action":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.NonTailnetAction = d.Val()
+
+			case "client_ip_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ClientIPSource = d.Val()
+
+			case "blocks_incoming_action":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.BlocksIncomingAction = d.Val()
+
+			case "funnel_action":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.FunnelAction = d.Val()
+
+			case "trust_serve_headers":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TrustServeHeaders = true
+
+			case "deny_status":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				status, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid deny_status %q: %v", d.Val(), err)
+				}
+				m.DenyStatus = status
+
+			case "deny_body":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DenyBody = d.Val()
+				if d.NextArg() {
+					m.DenyContentType = d.Val()
+				}
+
+			case "deny_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DenyFormat = d.Val()
+
+			case "login_redirect":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.LoginRedirect = d.Val()
+
+			case "skip_paths":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SkipPaths = append(m.SkipPaths, d.Val())
+				m.SkipPaths = append(m.SkipPaths, d.RemainingArgs()...)
+
+			case "skip_methods":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SkipMethods = append(m.SkipMethods, d.Val())
+				m.SkipMethods = append(m.SkipMethods, d.RemainingArgs()...)
+
+			case "map_users":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.MapUsers == nil {
+					m.MapUsers = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					args := append([]string{d.Val()}, d.RemainingArgs()...)
+					if len(args) == 3 && args[1] == "=>" {
+						args = []string{args[0], args[2]}
+					}
+					if len(args) != 2 {
+						return d.ArgErr()
+					}
+					m.MapUsers[args[0]] = args[1]
+				}
+
+			case "pseudonymize":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.PseudonymSalt = d.Val()
+
+			case "compat":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Compat = append(m.Compat, d.Val())
+				m.Compat = append(m.Compat, d.RemainingArgs()...)
+
+			case "privacy":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Privacy = true
+
+			case "redact_logs":
+				if err := unmarshalRedactLogs(d, &m.RedactLogs, &m.RedactSalt); err != nil {
+					return err
+				}
+
+			case "new_device_webhook":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.NewDeviceWebhook = d.Val()
+
+			case "seen_devices_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SeenDevicesFile = d.Val()
+
+			case "deny_webhook":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DenyWebhook = d.Val()
+
+			case "syslog":
+				m.Syslog = new(SyslogConfig)
+				if err := m.Syslog.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+
+			case "event_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.EventFormat = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "session_cookie":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid session_cookie %q: %v", d.Val(), err)
+				}
+				m.SessionCookie = caddy.Duration(ttl)
+
+			case "session_cookie_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SessionCookieName = d.Val()
+
+			case "session_secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.SessionSecret = d.Val()
+
+			case "upstream_tokens":
+				tokens, err := unmarshalUpstreamTokens(d)
+				if err != nil {
+					return err
+				}
+				m.UpstreamTokens = append(m.UpstreamTokens, tokens...)
+
+			case "upstream_basic_auth":
+				passwords, err := unmarshalUpstreamTokens(d)
+				if err != nil {
+					return err
+				}
+				m.UpstreamBasicAuth = append(m.UpstreamBasicAuth, passwords...)
+
+			case "authp_secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.AuthpSecret = d.Val()
+
+			case "authp_roles":
+				m.AuthpRoles = append(m.AuthpRoles, d.RemainingArgs()...)
+				if len(m.AuthpRoles) == 0 {
+					return d.ArgErr()
+				}
+
+			case "authp_token_lifetime":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid authp_token_lifetime %q: %v", d.Val(), err)
+				}
+				m.AuthpTokenLifetime = caddy.Duration(dur)
+
+			case "output":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Output = d.Val()
+
+			case "header_sanitize":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.HeaderSanitize = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "max_header_length":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				length, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_header_length %q: %v", d.Val(), err)
+				}
+				m.MaxHeaderLength = length
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "multi_value":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.MultiValue = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "detail":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Detail = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "decision_log":
+				m.DecisionLog = new(logging.FileWriter)
+				if err := m.DecisionLog.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+
+			case "decision_id_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.DecisionIDHeader = d.Val()
+
+			case "status_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.StatusPath = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+
+			case "header_prefix":
+				if !d.NextArg() {
+					m.HeaderPrefix = "X-Tailscale-"
+				} else {
+					m.HeaderPrefix = d.Val()
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// localUsername returns the name a login name is forwarded as: its pseudonym
+// in pseudonymous mode, otherwise its map_users name or the login name itself
+func (t *TailscaleAuth) localUsername(loginName string) string {
+	if t.pseudonymKey != nil {
+		return pseudonym(t.pseudonymKey, loginName)
+	}
+	if username, ok := t.userMap[strings.ToLower(loginName)]; ok {
+		return username
+	}
+	return loginName
+}
+
+// pseudonym returns a hex HMAC-SHA256 of the lowercased login name, truncated to 128 bits
+func pseudonym(key []byte, loginName string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(loginName)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// identityURI returns the SPIFFE-style URI of the identity,
+// spiffe://<tailnet>/user/<login>/node/<node ID>, without the user for tagged
+// devices. The login is lowercased, or its pseudonym in pseudonymous mode. It
+// is "" if the tailnet or node ID is unknown
+func (t *TailscaleAuth) identityURI(match *deviceMatch) string {
+	device := match.device
+	if match.tailnet == "" || device.NodeID == "" {
+		return ""
+	}
+
+	// Personal tailnets are named like logins, whose @ would read as userinfo
+	uri := "spiffe://" + url.QueryEscape(strings.ToLower(match.tailnet))
+	if device.IdentityType() == "user" && device.User != "" {
+		login := strings.ToLower(device.User)
+		if t.pseudonymKey != nil {
+			login = pseudonym(t.pseudonymKey, device.User)
+		}
+		uri += "/user/" + url.PathEscape(login)
+	}
+	return uri + "/node/" + url.PathEscape(device.NodeID)
+}
+
+// shortName returns the first label of a MagicDNS name, lowercased, e.g.
+// "laptop" for "Laptop.tail1234.ts.net."
+func shortName(name string) string {
+	short, _, _ := strings.Cut(strings.TrimSuffix(name, "."), ".")
+	return strings.ToLower(short)
+}
+
+// clientIP extracts the client IP from the request as client_ip_source
+// selects. Forwarding headers are never read directly: Caddy only honors them
+// for connections from trusted_proxies, so clients cannot choose the identity
+// they are looked up as
+func (t *TailscaleAuth) clientIP(r *http.Request) string {
+	if t.ClientIPSource == "headers" {
+		if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+			return ip
+		}
+	}
+	return connectionIP(r)
+}
+
+// connectionIP returns the source address of the connection. Behind Caddy's
+// proxy_protocol listener wrapper this is the address the PROXY header named
+func connectionIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// parseCaddyfile unmarshals tokens from h into a new Middleware.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var t TailscaleAuth
+	err := t.UnmarshalCaddyfile(h.Dispenser)
+	return &t, err
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*TailscaleAuth)(nil)
 	_ caddy.Validator             = (*TailscaleAuth)(nil)
+	_ caddy.CleanerUpper          = (*TailscaleAuth)(nil)
 	_ caddyhttp.MiddlewareHandler = (*TailscaleAuth)(nil)
 	_ caddyfile.Unmarshaler       = (*TailscaleAuth)(nil)
 )
@@ -0,0 +1,111 @@
+package caddyauth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		remoteAddr string
+		headers    map[string]string
+		caddyIP    string
+		want       string
+	}{
+		{
+			name:       "connection by default",
+			remoteAddr: "100.64.0.1:51234",
+			want:       "100.64.0.1",
+		},
+		{
+			name:       "forwarding headers ignored by default",
+			remoteAddr: "100.64.0.1:51234",
+			headers:    map[string]string{"X-Forwarded-For": "100.64.0.99", "X-Real-IP": "100.64.0.98"},
+			caddyIP:    "100.64.0.99",
+			want:       "100.64.0.1",
+		},
+		{
+			name:       "PROXY protocol source address",
+			source:     "connection",
+			remoteAddr: "[fd7a:115c:a1e0::5]:443",
+			headers:    map[string]string{"X-Forwarded-For": "100.64.0.99"},
+			want:       "fd7a:115c:a1e0::5",
+		},
+		{
+			name:       "headers from a trusted proxy",
+			source:     "headers",
+			remoteAddr: "10.0.0.1:51234",
+			headers:    map[string]string{"X-Forwarded-For": "100.64.0.7"},
+			caddyIP:    "100.64.0.7",
+			want:       "100.64.0.7",
+		},
+		{
+			name:       "headers from an untrusted client",
+			source:     "headers",
+			remoteAddr: "100.64.0.1:51234",
+			headers:    map[string]string{"X-Forwarded-For": "100.64.0.99"},
+			caddyIP:    "100.64.0.1",
+			want:       "100.64.0.1",
+		},
+		{
+			name:       "headers without a client IP from Caddy",
+			source:     "headers",
+			remoteAddr: "100.64.0.1:51234",
+			headers:    map[string]string{"X-Real-IP": "100.64.0.99"},
+			want:       "100.64.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			vars := map[string]any{}
+			if tt.caddyIP != "" {
+				vars[caddyhttp.ClientIPVarKey] = tt.caddyIP
+			}
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+
+			h := &TailscaleAuth{ClientIPSource: tt.source}
+			if got := h.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripIdentityHeaders(t *testing.T) {
+	ts := &TailscaleAuth{HeaderPrefix: "X-Tailscale-", DecisionIDHeader: "X-Tailscale-Request-ID"}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Tailscale-User-LoginName", "admin@example.com")
+	r.Header.Set("X-Tailscale-Groups", "group:admins")
+	r.Header.Set("x-tailscale-permissions", "write")
+	r.Header["x-tailscale-device-tags"] = []string{"tag:prod"}
+	r.Header.Set("X-Tailscale-Request-ID", "abc123")
+	r.Header.Set("X-Request-ID", "def456")
+
+	ts.stripIdentityHeaders(r)
+
+	for _, name := range []string{"X-Tailscale-User-LoginName", "X-Tailscale-Groups", "X-Tailscale-Permissions"} {
+		if value := r.Header.Get(name); value != "" {
+			t.Errorf("%s = %q, want it removed", name, value)
+		}
+	}
+	if _, ok := r.Header["x-tailscale-device-tags"]; ok {
+		t.Errorf("non-canonical x-tailscale-device-tags was not removed")
+	}
+	if got := r.Header.Get("X-Tailscale-Request-ID"); got != "abc123" {
+		t.Errorf("decision ID header = %q, want it kept", got)
+	}
+	if got := r.Header.Get("X-Request-ID"); got != "def456" {
+		t.Errorf("X-Request-ID = %q, want it kept", got)
+	}
+}
@@ -0,0 +1,384 @@
+// Package tailscaletest provides an in-memory Tailscale API for end-to-end
+// tests of the tailscale_auth handler and of configurations using it.
+//
+// A Server serves the devices, device, posture attributes, users and policy
+// file endpoints of the Tailscale API, the OAuth client credentials token
+// endpoint and the LocalAPI whois endpoint from fixtures that can be changed
+// while it runs. Point a handler at it with api_url:
+//
+//	srv := tailscaletest.NewServer("example.com", "tskey-api-test")
+//	defer srv.Close()
+//	srv.AddDevice(caddyauth.Device{ID: "1", Name: "laptop.example.ts.net", Addresses: []string{"100.64.0.1"}})
+//
+//	tailscale_auth {
+//	    api_key tskey-api-test
+//	    tailnet example.com
+//	    api_url <srv.URL>
+//	}
+package tailscaletest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	caddyauth "github.com/juridia-net/caddy-tailscale-auth"
+)
+
+// oauthClient is a registered OAuth client
+type oauthClient struct {
+	secret string
+	scopes []string
+}
+
+// Server is a mock Tailscale API for one tailnet
+type Server struct {
+	*httptest.Server
+
+	tailnet string
+	apiKey  string
+
+	mu       sync.Mutex
+	devices  []caddyauth.Device
+	users    []caddyauth.User
+	groups   map[string][]string
+	grants   []caddyauth.Grant
+	posture  map[string]map[string]any
+	clients  map[string]oauthClient
+	tokens   map[string]time.Time
+	failures map[string]int
+	requests map[string]int
+}
+
+// NewServer starts a mock API for tailnet that accepts apiKey and access
+// tokens issued to registered OAuth clients. Callers must Close it
+func NewServer(tailnet, apiKey string) *Server {
+	s := &Server{
+		tailnet:  tailnet,
+		apiKey:   apiKey,
+		posture:  make(map[string]map[string]any),
+		clients:  make(map[string]oauthClient),
+		tokens:   make(map[string]time.Time),
+		failures: make(map[string]int),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/devices", s.authorized(s.handleDevices))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/users", s.authorized(s.handleUsers))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/acl", s.authorized(s.handlePolicy))
+	mux.HandleFunc("GET /api/v2/device/{id}", s.authorized(s.handleDevice))
+	mux.HandleFunc("GET /api/v2/device/{id}/attributes", s.authorized(s.handleAttributes))
+	mux.HandleFunc("POST /api/v2/oauth/token", s.handleToken)
+	mux.HandleFunc("GET /localapi/v0/whois", s.handleWhoIs)
+
+	s.Server = httptest.NewServer(s.count(mux))
+	return s
+}
+
+// AddDevice adds device to the tailnet, replacing any device with the same ID
+func (s *Server) AddDevice(device caddyauth.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = slices.DeleteFunc(s.devices, func(d caddyauth.Device) bool { return d.ID == device.ID })
+	s.devices = append(s.devices, device)
+}
+
+// RemoveDevice removes the device with the given ID from the tailnet
+func (s *Server) RemoveDevice(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = slices.DeleteFunc(s.devices, func(d caddyauth.Device) bool { return d.ID == id })
+	delete(s.posture, id)
+}
+
+// AddUser adds user to the tailnet, replacing any user with the same login name
+func (s *Server) AddUser(user caddyauth.User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = slices.DeleteFunc(s.users, func(u caddyauth.User) bool { return u.LoginName == user.LoginName })
+	s.users = append(s.users, user)
+}
+
+// SetGroups replaces the groups section of the policy file
+func (s *Server) SetGroups(groups map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = groups
+}
+
+// SetGrants replaces the grants section of the policy file
+func (s *Server) SetGrants(grants []caddyauth.Grant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants = grants
+}
+
+// SetPostureAttributes replaces the posture attributes of the device with the given ID
+func (s *Server) SetPostureAttributes(id string, attributes map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posture[id] = attributes
+}
+
+// AddOAuthClient registers an OAuth client that can exchange its credentials
+// for access tokens with the given scopes. The API does not enforce them
+func (s *Server) AddOAuthClient(id, secret string, scopes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[id] = oauthClient{secret: secret, scopes: scopes}
+}
+
+// FailNext makes the next n requests to path fail with 500 Internal Server
+// Error, to test how the handler copes with API outages
+func (s *Server) FailNext(path string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = n
+}
+
+// Requests returns how many requests path has received, e.g.
+// "/api/v2/tailnet/example.com/devices", to test caching
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// count records every request and serves the failures set up with FailNext
+func (s *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		fail := s.failures[r.URL.Path] > 0
+		if fail {
+			s.failures[r.URL.Path]--
+		}
+		s.mu.Unlock()
+
+		if fail {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized rejects requests without the API key or a valid access token,
+// and requests for other tailnets
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			if _, password, basic := r.BasicAuth(); basic {
+				token, ok = password, true
+			}
+		}
+
+		s.mu.Lock()
+		expires, issued := s.tokens[token]
+		s.mu.Unlock()
+		if !ok || token != s.apiKey && (!issued || time.Now().After(expires)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if tailnet := r.PathValue("tailnet"); tailnet != "" && tailnet != "-" && tailnet != s.tailnet {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	resp := caddyauth.DevicesResponse{Devices: slices.Clone(s.devices)}
+	s.mu.Unlock()
+
+	if r.URL.Query().Get("fields") != "all" {
+		for i := range resp.Devices {
+			resp.Devices[i].AdvertisedRoutes = nil
+			resp.Devices[i].EnabledRoutes = nil
+		}
+	}
+	for i := range resp.Devices {
+		resp.Devices[i].PostureAttributes = nil
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	device, ok := s.device(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("fields") != "all" {
+		device.AdvertisedRoutes = nil
+		device.EnabledRoutes = nil
+	}
+	device.PostureAttributes = nil
+	writeJSON(w, device)
+}
+
+func (s *Server) handleAttributes(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.device(id); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	attributes := s.posture[id]
+	s.mu.Unlock()
+	if attributes == nil {
+		attributes = make(map[string]any)
+	}
+	writeJSON(w, caddyauth.AttributesResponse{Attributes: attributes})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, caddyauth.UsersResponse{Users: s.users})
+}
+
+func (s *Server) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, caddyauth.PolicyFile{Groups: s.groups, Grants: s.grants})
+}
+
+// handleToken implements the OAuth client credentials grant
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	s.mu.Lock()
+	known, exists := s.clients[id]
+	s.mu.Unlock()
+	if !exists || known.secret != secret || r.PostFormValue("grant_type") != "client_credentials" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// Tokens get the requested scopes, or all of the client's
+	scopes := strings.Fields(r.PostFormValue("scope"))
+	if len(scopes) == 0 {
+		scopes = known.scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(known.scopes, scope) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_scope"})
+			return
+		}
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := "tskey-test-" + hex.EncodeToString(buf)
+
+	const lifetime = time.Hour
+	s.mu.Lock()
+	s.tokens[token] = time.Now().Add(lifetime)
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]any{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(lifetime / time.Second),
+		"scope":        strings.Join(scopes, " "),
+	})
+}
+
+// handleWhoIs serves the LocalAPI's whois for addr, with or without a port
+func (s *Server) handleWhoIs(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			http.Error(w, "invalid 'addr' parameter", http.StatusBadRequest)
+			return
+		}
+		ip = addrPort.Addr()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.devices, func(d caddyauth.Device) bool {
+		return slices.Contains(d.Addresses, ip.String())
+	})
+	if i < 0 {
+		http.Error(w, "no match for IP:port", http.StatusNotFound)
+		return
+	}
+	device := s.devices[i]
+
+	var resp caddyauth.WhoIsResponse
+	resp.Node.ID = device.NodeID
+	resp.Node.Name = device.Name
+	resp.Node.User = device.User
+	resp.Node.Tailnet = s.tailnet
+	resp.Node.Hostname = device.Hostname
+	resp.Node.ClientVersion = device.ClientVersion
+	resp.Node.OS = device.OS
+	resp.Node.Created = device.Created
+	resp.Node.LastSeen = device.LastSeen
+	resp.Node.Online = device.ConnectedToControl
+	resp.Node.KeyExpiry = device.Expires
+	resp.Node.MachineKey = device.MachineKey
+	resp.Node.NodeKey = device.NodeKey
+	resp.Node.Addresses = device.Addresses
+	resp.Node.Tags = device.Tags
+	if expires, err := time.Parse(time.RFC3339, device.Expires); err == nil && !device.KeyExpiryDisabled {
+		resp.Node.Expired = time.Now().After(expires)
+	}
+
+	if j := slices.IndexFunc(s.users, func(u caddyauth.User) bool { return u.LoginName == device.User }); j >= 0 {
+		resp.UserProfile.ID = s.users[j].ID
+		resp.UserProfile.DisplayName = s.users[j].DisplayName
+	}
+	resp.UserProfile.LoginName = device.User
+
+	if len(device.Capabilities) > 0 {
+		resp.CapMap = make(map[string][]string, len(device.Capabilities))
+		for _, capability := range device.Capabilities {
+			resp.CapMap[capability] = nil
+		}
+	}
+
+	writeJSON(w, resp)
+}
+
+// device returns a copy of the device with the given ID
+func (s *Server) device(id string) (caddyauth.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.devices, func(d caddyauth.Device) bool { return d.ID == id })
+	if i < 0 {
+		return caddyauth.Device{}, false
+	}
+	return s.devices[i], true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,286 @@
+package caddyauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/juridia-net/caddy-tailscale-auth/client"
+	"go.uber.org/zap"
+	"tailscale.com/client/local"
+	"tailscale.com/tsnet"
+)
+
+func init() {
+	caddy.RegisterNetwork("tsnet", getTsnetListener)
+}
+
+// whoisTimeout bounds identity lookups through an embedded node
+const whoisTimeout = 5 * time.Second
+
+// NodeConfig configures an embedded Tailscale node that joins the tailnet
+// through tsnet, without a separate tailscaled
+type NodeConfig struct {
+	// AuthKey authenticates the node on first start. Placeholders such as
+	// {env.*} are expanded (default: $TS_AUTHKEY)
+	AuthKey string `json:"auth_key,omitempty"`
+
+	// Hostname is the node's name in the tailnet (default: the node's name in the config)
+	Hostname string `json:"hostname,omitempty"`
+
+	// StateDir holds the node's state, relative to Caddy's data directory (default: "tsnet/<name>")
+	StateDir string `json:"state_dir,omitempty"`
+
+	// Ephemeral removes the node from the tailnet once it goes offline
+	Ephemeral bool `json:"ephemeral,omitempty"`
+
+	// ControlURL is the coordination server, e.g. for Headscale (default: Tailscale's)
+	ControlURL string `json:"control_url,omitempty"`
+}
+
+// tsnetNodeConfigs holds the node configurations of the current tailscale_auth
+// app, for listeners, which are created outside any module
+var tsnetNodeConfigs = struct {
+	sync.Mutex
+	configs map[string]*NodeConfig
+}{}
+
+// setTsnetNodeConfigs replaces the known node configurations
+func setTsnetNodeConfigs(configs map[string]*NodeConfig) {
+	tsnetNodeConfigs.Lock()
+	defer tsnetNodeConfigs.Unlock()
+	tsnetNodeConfigs.configs = configs
+}
+
+// tsnetNodeConfig returns the configuration of the named node, or the
+// defaults if the app does not configure it
+func tsnetNodeConfig(name string) NodeConfig {
+	tsnetNodeConfigs.Lock()
+	defer tsnetNodeConfigs.Unlock()
+	if cfg := tsnetNodeConfigs.configs[name]; cfg != nil {
+		return *cfg
+	}
+	return NodeConfig{}
+}
+
+// nodePool shares running embedded nodes between listeners and handlers, and
+// across config reloads. A running node keeps its configuration until it is
+// no longer used
+var nodePool = caddy.NewUsagePool()
+
+// tsnetNode is a running embedded node
+type tsnetNode struct {
+	name   string
+	server *tsnet.Server
+	client *local.Client
+}
+
+// loadTsnetNode returns the running node with the given name, starting it on
+// first use. Callers must release it with nodePool.Delete(name)
+func loadTsnetNode(name string) (*tsnetNode, error) {
+	node, _, err := nodePool.LoadOrNew(name, func() (caddy.Destructor, error) {
+		return startTsnetNode(name, tsnetNodeConfig(name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node.(*tsnetNode), nil
+}
+
+// startTsnetNode starts an embedded node. It does not wait for the node to
+// connect; until it does, lookups fail and listeners accept no connections
+func startTsnetNode(name string, cfg NodeConfig) (*tsnetNode, error) {
+	logger := caddy.Log().Named("tailscale_auth.tsnet").With(zap.String("node", name))
+
+	if cfg.Hostname == "" {
+		cfg.Hostname = name
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = filepath.Join("tsnet", name)
+	}
+
+	server := &tsnet.Server{
+		Hostname:   cfg.Hostname,
+		AuthKey:    cfg.AuthKey,
+		Dir:        resolveDataPath(cfg.StateDir),
+		Ephemeral:  cfg.Ephemeral,
+		ControlURL: cfg.ControlURL,
+		Logf: func(format string, args ...any) {
+			logger.Debug(fmt.Sprintf(format, args...))
+		},
+		UserLogf: func(format string, args ...any) {
+			logger.Info(fmt.Sprintf(format, args...))
+		},
+	}
+
+	if err := server.Start(); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("failed to start tsnet node %s: %w", name, err)
+	}
+
+	client, err := server.LocalClient()
+	if err != nil {
+		server.Close()
+		return nil, fmt.Errorf("failed to get local client of tsnet node %s: %w", name, err)
+	}
+
+	logger.Info("tsnet node started", zap.String("hostname", cfg.Hostname))
+	return &tsnetNode{name: name, server: server, client: client}, nil
+}
+
+// Destruct implements caddy.Destructor. It runs once nothing uses the node anymore.
+func (n *tsnetNode) Destruct() error {
+	return n.server.Close()
+}
+
+// whois resolves the peer at clientIP into a device match using the node's
+// view of the tailnet, without the Tailscale API
+func (n *tsnetNode) whois(ctx context.Context, clientIP string) (*deviceMatch, error) {
+	ctx, cancel := context.WithTimeout(ctx, whoisTimeout)
+	defer cancel()
+
+	return localWhois(ctx, n.client, clientIP)
+}
+
+// localWhois resolves the peer at clientIP through the LocalAPI of lc
+func localWhois(ctx context.Context, lc *local.Client, clientIP string) (*deviceMatch, error) {
+	addr, ok := parseClientAddr(clientIP)
+	if !ok {
+		return nil, fmt.Errorf("invalid client IP %q", clientIP)
+	}
+	if !isTailnetAddr(addr) {
+		return nil, fmt.Errorf("%s: %w", addr, errNotTailnetAddr)
+	}
+
+	peer, err := client.WhoIs(ctx, lc, addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &deviceMatch{
+		device:  peer.Device,
+		tailnet: peer.Tailnet,
+		user:    peer.User,
+		groups:  peer.Groups,
+	}, nil
+}
+
+// tsnetListenerPool shares tsnet listeners between the servers of overlapping
+// configs during a reload
+var tsnetListenerPool = caddy.NewUsagePool()
+
+// getTsnetListener implements caddy.ListenerFunc for addresses of the form
+// tsnet/<node>:<port>, listening on the embedded node's tailnet interface
+func getTsnetListener(_ context.Context, _, host, portRange string, portOffset uint, _ net.ListenConfig) (any, error) {
+	start, _, _ := strings.Cut(portRange, "-")
+	port, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portRange, err)
+	}
+	addr := ":" + strconv.FormatUint(port+uint64(portOffset), 10)
+	key := host + addr
+
+	shared, _, err := tsnetListenerPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		node, err := loadTsnetNode(host)
+		if err != nil {
+			return nil, err
+		}
+		ln, err := node.server.Listen("tcp", addr)
+		if err != nil {
+			nodePool.Delete(host)
+			return nil, err
+		}
+		s := &sharedTsnetListener{Listener: ln, node: host, conns: make(chan net.Conn), done: make(chan struct{})}
+		go s.acceptLoop()
+		return s, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tsnetListener{shared: shared.(*sharedTsnetListener), key: key, closed: make(chan struct{})}, nil
+}
+
+// sharedTsnetListener accepts connections on the node and hands them to
+// whichever server's listener asks first. A connection nobody asks for
+// before the listener is destructed is closed
+type sharedTsnetListener struct {
+	net.Listener
+	node  string
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (s *sharedTsnetListener) acceptLoop() {
+	defer close(s.conns)
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case s.conns <- conn:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Destruct implements caddy.Destructor.
+func (s *sharedTsnetListener) Destruct() error {
+	close(s.done)
+	err := s.Listener.Close()
+	nodePool.Delete(s.node)
+	return err
+}
+
+// tsnetListener is one server's handle on a shared tsnet listener. Closing
+// it stops its Accept calls and releases the shared listener
+type tsnetListener struct {
+	shared *sharedTsnetListener
+	key    string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *tsnetListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn, ok := <-l.shared.conns:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tsnetListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.closed)
+		_, err = tsnetListenerPool.Delete(l.key)
+	})
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (l *tsnetListener) Addr() net.Addr {
+	return l.shared.Addr()
+}
@@ -0,0 +1,114 @@
+package caddyauth
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// handlerTransport serves LocalAPI requests with an http.Handler
+type handlerTransport struct {
+	http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+// newWhoisNode returns a node whose LocalAPI knows the peer name at every address
+func newWhoisNode(name string) *tsnetNode {
+	whois := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(apitype.WhoIsResponse{
+			Node:        &tailcfg.Node{ID: 1, Name: name + "."},
+			UserProfile: &tailcfg.UserProfile{ID: 2, LoginName: "alice@example.com"},
+		})
+	})
+	return &tsnetNode{name: "test", client: &local.Client{Transport: handlerTransport{whois}, OmitAuth: true}}
+}
+
+func TestNodeExpectedTailnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    string
+		wantErr bool
+	}{
+		{name: "own tailnet", peer: "laptop.example.ts.net"},
+		{name: "shared in", peer: "laptop.other.ts.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &TailscaleAuth{ExpectedTailnet: "example.ts.net", node: newWhoisNode(tt.peer)}
+			match, err := ts.getDevice(t.Context(), "100.64.0.1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getDevice() = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && match.user.LoginName != "alice@example.com" {
+				t.Errorf("user = %q, want alice@example.com", match.user.LoginName)
+			}
+		})
+	}
+}
+
+// pipeListener is a net.Listener that accepts the connections sent on conns
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestSharedTsnetListenerClosesUnacceptedConns(t *testing.T) {
+	ln := &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	s := &sharedTsnetListener{Listener: ln, node: "test", conns: make(chan net.Conn), done: make(chan struct{})}
+	go s.acceptLoop()
+
+	server, client := net.Pipe()
+	ln.conns <- server
+	if err := s.Destruct(); err != nil {
+		t.Fatalf("Destruct: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("unaccepted connection was not closed: %v", err)
+	}
+
+	select {
+	case _, ok := <-s.conns:
+		if ok {
+			t.Fatal("connection handed out after Destruct")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop did not stop after Destruct")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,179 @@
+package caddyauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// UpstreamToken is the secret requests of an identity carry to the upstream,
+// a bearer token or a Basic auth password
+type UpstreamToken struct {
+	// Identity is a login name, matched ignoring case, or a tag such as "tag:ci"
+	Identity string `json:"identity"`
+
+	// Token is the bearer token or password. Placeholders such as {env.*} are expanded
+	Token string `json:"token,omitempty"`
+
+	// TokenFile is a file holding the token, such as a secret mount, reread
+	// when it changes; replaces Token
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// upstreamToken is a provisioned UpstreamToken
+type upstreamToken struct {
+	identity string
+	token    string
+	file     *secretFile
+}
+
+// value returns the current token or password
+func (u *upstreamToken) value() string {
+	if u.file != nil {
+		return u.file.Key()
+	}
+	return u.token
+}
+
+// provisionUpstreamTokens sets up the bearer tokens of upstream_tokens and
+// the passwords of upstream_basic_auth
+func (t *TailscaleAuth) provisionUpstreamTokens() error {
+	var err error
+	if t.upstreamTokens, err = t.loadUpstreamTokens("upstream_tokens", t.UpstreamTokens); err != nil {
+		return err
+	}
+	for _, cfg := range t.UpstreamBasicAuth {
+		if cfg != nil && strings.HasPrefix(cfg.Identity, "tag:") {
+			return fmt.Errorf("upstream_basic_auth: %s is a tag, but Basic credentials are only synthesized for users", cfg.Identity)
+		}
+	}
+	t.upstreamPasswords, err = t.loadUpstreamTokens("upstream_basic_auth", t.UpstreamBasicAuth)
+	return err
+}
+
+// loadUpstreamTokens expands the placeholders of the secrets of option and
+// starts watching their files
+func (t *TailscaleAuth) loadUpstreamTokens(option string, configs []*UpstreamToken) ([]*upstreamToken, error) {
+	var tokens []*upstreamToken
+	for _, cfg := range configs {
+		if cfg == nil || cfg.Identity == "" {
+			return tokens, fmt.Errorf("%s: identity is empty", option)
+		}
+		if err := expandPlaceholders(
+			configField{option + " token", &cfg.Token},
+			configField{option + " token_file", &cfg.TokenFile},
+		); err != nil {
+			return tokens, err
+		}
+		if (cfg.Token == "") == (cfg.TokenFile == "") {
+			return tokens, fmt.Errorf("%s: %s needs either a token or a token_file", option, cfg.Identity)
+		}
+
+		token := &upstreamToken{identity: cfg.Identity, token: cfg.Token}
+		if cfg.TokenFile != "" {
+			file, err := newSecretFile(option+" token_file", cfg.TokenFile, t.logger)
+			if err != nil {
+				return tokens, err
+			}
+			token.file = file
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// closeUpstreamTokens stops watching the token and password files
+func (t *TailscaleAuth) closeUpstreamTokens() {
+	for _, token := range slices.Concat(t.upstreamTokens, t.upstreamPasswords) {
+		if token.file != nil {
+			token.file.Close()
+		}
+	}
+	t.upstreamTokens = nil
+	t.upstreamPasswords = nil
+}
+
+// matchUpstreamToken returns the first of tokens whose identity is the
+// device's user or one of its tags
+func matchUpstreamToken(tokens []*upstreamToken, device *Device) (*upstreamToken, bool) {
+	for _, token := range tokens {
+		if strings.HasPrefix(token.identity, "tag:") {
+			if slices.Contains(device.Tags, token.identity) {
+				return token, true
+			}
+		} else if len(device.Tags) == 0 && strings.EqualFold(token.identity, device.User) {
+			return token, true
+		}
+	}
+	return nil, false
+}
+
+// addUpstreamToken passes the identity's upstream token on as a bearer token,
+// replacing any Authorization header the client sent. With vars_only output
+// the token is only set as a var
+func (t *TailscaleAuth) addUpstreamToken(r *http.Request, match *deviceMatch) {
+	token, ok := matchUpstreamToken(t.upstreamTokens, match.device)
+	if !ok {
+		return
+	}
+	value := token.value()
+	if t.Output != "vars_only" {
+		r.Header.Set("Authorization", "Bearer "+value)
+	}
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.upstream_token", value)
+	t.logger.Debug("injected upstream token",
+		zap.String("device", match.device.Name),
+		zap.String("identity", token.identity))
+}
+
+// addUpstreamBasicAuth passes the user on as Basic credentials, made of the
+// username after map_users and pseudonymize and the user's password. With
+// vars_only output the header value is only set as a var
+func (t *TailscaleAuth) addUpstreamBasicAuth(r *http.Request, match *deviceMatch) {
+	password, ok := matchUpstreamToken(t.upstreamPasswords, match.device)
+	if !ok {
+		return
+	}
+	username := t.localUsername(match.device.User)
+	if strings.Contains(username, ":") {
+		t.logger.Warn("not synthesizing Basic credentials for a username with a colon",
+			zap.String("device", match.device.Name))
+		return
+	}
+
+	value := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password.value()))
+	if t.Output != "vars_only" {
+		r.Header.Set("Authorization", value)
+	}
+	caddyhttp.SetVar(r.Context(), "tailscale_auth.upstream_basic_auth", value)
+}
+
+// unmarshalUpstreamTokens parses an upstream_tokens or upstream_basic_auth
+// block of <identity> <token> and <identity> file <path> lines
+func unmarshalUpstreamTokens(d *caddyfile.Dispenser) ([]*UpstreamToken, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+
+	var tokens []*UpstreamToken
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		token := &UpstreamToken{Identity: d.Val()}
+		args := d.RemainingArgs()
+		switch {
+		case len(args) == 1:
+			token.Token = args[0]
+		case len(args) == 2 && args[0] == "file":
+			token.TokenFile = args[1]
+		default:
+			return nil, d.ArgErr()
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
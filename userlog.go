@@ -0,0 +1,245 @@
+package caddyauth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/logging"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule((*UserLog)(nil))
+	httpcaddyfile.RegisterHandlerDirective("tailscale_user_log", parseUserLogCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_user_log", httpcaddyfile.After, "basic_auth")
+}
+
+// userLogMarker stands in for the {user} placeholder of the file name until
+// a user's file is opened
+const userLogMarker = "\x00user\x00"
+
+// UserLog is a Caddy handler that logs the requests of each Tailscale user to
+// a stream of their own: a file per user, or a logger named after the user
+// that Caddy's log configuration can route. The user is the one resolved by
+// a preceding tailscale_auth handler; requests without one are not logged.
+type UserLog struct {
+	// File is the rolling log file of each user. Its name must contain the
+	// {user} placeholder. Without it, records go to the logger
+	// http.handlers.tailscale_user_log.<user>
+	File *logging.FileWriter `json:"file,omitempty"`
+
+	// RedactLogs replaces login names, hostnames, IP addresses and request
+	// URIs in the records, like the redact_logs of tailscale_auth
+	RedactLogs string `json:"redact_logs,omitempty"`
+
+	// RedactSalt keys the hashes of RedactLogs. Placeholders such as {env.*} are expanded
+	RedactSalt string `json:"redact_salt,omitempty"`
+
+	logger *zap.Logger
+	mu     sync.Mutex
+	users  map[string]*zap.Logger
+	keys   []string
+}
+
+// CaddyModule returns the Caddy module information.
+func (*UserLog) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_user_log",
+		New: func() caddy.Module { return new(UserLog) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (u *UserLog) Provision(ctx caddy.Context) error {
+	u.logger = u.redact(ctx.Logger(u))
+	u.users = make(map[string]*zap.Logger)
+
+	if u.File != nil {
+		repl := caddy.NewReplacer()
+		repl.Set("user", userLogMarker)
+		filename, err := repl.ReplaceOrErr(u.File.Filename, true, true)
+		if err != nil {
+			return fmt.Errorf("invalid filename for user log file: %v", err)
+		}
+		u.File.Filename = filename
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (u *UserLog) Validate() error {
+	if err := validateRedactLogs(u.RedactLogs); err != nil {
+		return err
+	}
+	if u.File != nil && !strings.Contains(u.File.Filename, userLogMarker) {
+		return fmt.Errorf("file name must contain the {user} placeholder, or every user would share one file")
+	}
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. It releases the users' log files.
+func (u *UserLog) Cleanup() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var errs []error
+	for _, key := range u.keys {
+		if _, err := logWriterPool.Delete(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	u.keys = nil
+	u.users = nil
+	return errors.Join(errs...)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (u *UserLog) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	username, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.username").(string)
+	if username == "" {
+		return next.ServeHTTP(w, r)
+	}
+
+	start := time.Now()
+	rec := caddyhttp.NewResponseRecorder(w, nil, nil)
+	err := next.ServeHTTP(rec, r)
+
+	logger, logErr := u.userLogger(username)
+	if logErr != nil {
+		u.logger.Error("failed to open user log", zap.String("user", username), zap.Error(logErr))
+		return err
+	}
+
+	status := rec.Status()
+	if handlerErr, ok := err.(caddyhttp.HandlerError); ok {
+		status = handlerErr.StatusCode
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+
+	fields := []zap.Field{
+		zap.String("user", username),
+		zap.String("host", r.Host),
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.Int("status", status),
+		zap.Int("size", rec.Size()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if device, _ := caddyhttp.GetVar(r.Context(), "tailscale_auth.device_name").(string); device != "" {
+		fields = append(fields, zap.String("device", device))
+	}
+	logger.Info("handled request", fields...)
+	return err
+}
+
+// userLogger returns the logger of username, opening their file on first use
+func (u *UserLog) userLogger(username string) (*zap.Logger, error) {
+	label := userLogLabel(username)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if logger, ok := u.users[label]; ok {
+		return logger, nil
+	}
+
+	if u.File == nil {
+		logger := u.logger.Named(label)
+		u.users[label] = logger
+		return logger, nil
+	}
+
+	fw := *u.File
+	fw.Filename = strings.ReplaceAll(fw.Filename, userLogMarker, label)
+	logger, key, err := openJSONLog(&fw)
+	if err != nil {
+		return nil, err
+	}
+	logger = u.redact(logger.Named("tailscale_user_log"))
+	u.users[label] = logger
+	u.keys = append(u.keys, key)
+	return logger, nil
+}
+
+// redact returns logger with redaction applied, if redact_logs is set
+func (u *UserLog) redact(logger *zap.Logger) *zap.Logger {
+	if u.RedactLogs == "" {
+		return logger
+	}
+	return newRedactingLogger(logger, u.RedactLogs, caddy.NewReplacer().ReplaceAll(u.RedactSalt, ""))
+}
+
+// userLogLabel turns a username into a logger name and file name part. It
+// is lowercased, since login names are case-insensitive, and every byte other
+// than a lowercase letter, a digit or a dash is escaped as _ and two hex
+// digits, so different users never share a label
+func userLogLabel(username string) string {
+	username = strings.ToLower(username)
+	var b strings.Builder
+	for i := 0; i < len(username); i++ {
+		c := username[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_user_log [<matcher>] {
+//	    file <filename with {user}> {
+//	        <file log options>
+//	    }
+//	    redact_logs [hash|mask] [<salt>]
+//	}
+func (u *UserLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "file":
+				u.File = new(logging.FileWriter)
+				if err := u.File.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+
+			case "redact_logs":
+				if err := unmarshalRedactLogs(d, &u.RedactLogs, &u.RedactSalt); err != nil {
+					return err
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseUserLogCaddyfile unmarshals tokens from h into a new UserLog handler.
+func parseUserLogCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var u UserLog
+	err := u.UnmarshalCaddyfile(h.Dispenser)
+	return &u, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*UserLog)(nil)
+	_ caddy.Validator             = (*UserLog)(nil)
+	_ caddy.CleanerUpper          = (*UserLog)(nil)
+	_ caddyhttp.MiddlewareHandler = (*UserLog)(nil)
+	_ caddyfile.Unmarshaler       = (*UserLog)(nil)
+)
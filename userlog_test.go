@@ -0,0 +1,20 @@
+package caddyauth
+
+import "testing"
+
+func TestUserLogLabel(t *testing.T) {
+	tests := map[string]string{
+		"alice@mycompany.net": "alice_40mycompany_2enet",
+		"Alice@MyCompany.net": "alice_40mycompany_2enet",
+		"a.b@c.com":           "a_2eb_40c_2ecom",
+		"a_b@c.com":           "a_5fb_40c_2ecom",
+		"bob-smith":           "bob-smith",
+		"jürgen":              "j_c3_bcrgen",
+		"../etc":              "_2e_2e_2fetc",
+	}
+	for username, want := range tests {
+		if got := userLogLabel(username); got != want {
+			t.Errorf("userLogLabel(%q) = %q, want %q", username, got, want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package caddyauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// vaultRequestTimeout bounds every request to Vault
+const vaultRequestTimeout = 10 * time.Second
+
+// vaultRenewRetry is how long to wait before retrying a failed token renewal
+const vaultRenewRetry = time.Minute
+
+// VaultConfig fetches the API key from a HashiCorp Vault secret instead of
+// the config or a file
+type VaultConfig struct {
+	// Address is the Vault server address (default: $VAULT_ADDR)
+	Address string `json:"address,omitempty"`
+
+	// Namespace is the Vault Enterprise namespace (default: $VAULT_NAMESPACE)
+	Namespace string `json:"namespace,omitempty"`
+
+	// Token authenticates with a Vault token, renewed while it is renewable.
+	// Used when KubernetesRole is empty (default: $VAULT_TOKEN)
+	Token string `json:"token,omitempty"`
+
+	// KubernetesRole authenticates through the Kubernetes auth method with
+	// this role and the pod's service account token
+	KubernetesRole string `json:"kubernetes_role,omitempty"`
+
+	// KubernetesMount is the mount path of the Kubernetes auth method (default: "kubernetes")
+	KubernetesMount string `json:"kubernetes_mount,omitempty"`
+
+	// KubernetesTokenFile is the service account token
+	// (default: "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	KubernetesTokenFile string `json:"kubernetes_token_file,omitempty"`
+
+	// Path is the API path of the secret, e.g. "secret/data/tailscale" for a
+	// KV version 2 engine mounted at secret/
+	Path string `json:"path,omitempty"`
+
+	// Field is the secret's field holding the API key (default: "api_key")
+	Field string `json:"field,omitempty"`
+
+	// RefreshInterval is how often the secret is read again to pick up a
+	// rotated key (default: 5m)
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+}
+
+// placeholderFields returns the options whose placeholders are expanded
+func (c *VaultConfig) placeholderFields() []configField {
+	return []configField{
+		{"vault address", &c.Address},
+		{"vault namespace", &c.Namespace},
+		{"vault token", &c.Token},
+		{"vault kubernetes_role", &c.KubernetesRole},
+		{"vault kubernetes_mount", &c.KubernetesMount},
+		{"vault kubernetes_token_file", &c.KubernetesTokenFile},
+		{"vault path", &c.Path},
+		{"vault field", &c.Field},
+	}
+}
+
+// validate checks that the configuration can fetch a secret
+func (c *VaultConfig) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("vault: path is required")
+	}
+	if c.Token != "" && c.KubernetesRole != "" {
+		return fmt.Errorf("vault: token and kubernetes_role cannot both be set")
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("vault: refresh_interval must not be negative")
+	}
+	return nil
+}
+
+// vaultSecret holds the API key read from Vault and reads it again
+// periodically, keeping its Vault token renewed
+type vaultSecret struct {
+	cfg    VaultConfig
+	logger *zap.Logger
+	client *http.Client
+	key    atomic.Pointer[string]
+	stop   chan struct{}
+	done   chan struct{}
+
+	// The token is only used by the refresh loop after the first read
+	token     string
+	renewable bool
+	ttl       time.Duration
+	obtained  time.Time
+}
+
+// newVaultSecret authenticates with Vault, reads the API key and starts
+// refreshing it
+func newVaultSecret(cfg VaultConfig, logger *zap.Logger) (*vaultSecret, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("vault: address is required when VAULT_ADDR is not set")
+	}
+	cfg.Address = strings.TrimSuffix(cfg.Address, "/")
+	if cfg.Namespace == "" {
+		cfg.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if cfg.KubernetesRole == "" && cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if cfg.KubernetesRole == "" && cfg.Token == "" {
+		return nil, fmt.Errorf("vault: token or kubernetes_role is required when VAULT_TOKEN is not set")
+	}
+	if cfg.KubernetesMount == "" {
+		cfg.KubernetesMount = "kubernetes"
+	}
+	if cfg.KubernetesTokenFile == "" {
+		cfg.KubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if cfg.Field == "" {
+		cfg.Field = "api_key"
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = caddy.Duration(5 * time.Minute)
+	}
+
+	s := &vaultSecret{
+		cfg:    cfg,
+		logger: logger,
+		client: &http.Client{Timeout: vaultRequestTimeout},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := s.authenticate(); err != nil {
+		return nil, err
+	}
+	key, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.key.Store(&key)
+
+	go s.refreshLoop()
+	return s, nil
+}
+
+// Key returns the current API key
+func (s *vaultSecret) Key() string {
+	return *s.key.Load()
+}
+
+// Close stops refreshing the secret
+func (s *vaultSecret) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// vaultAuth is the auth block of Vault login and renewal responses
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// authenticate obtains a token through the Kubernetes auth method, or
+// looks up the configured token's lease
+func (s *vaultSecret) authenticate() error {
+	if s.cfg.KubernetesRole == "" {
+		var resp struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := s.do("GET", "auth/token/lookup-self", s.cfg.Token, nil, &resp); err != nil {
+			return fmt.Errorf("vault: failed to look up token: %w", err)
+		}
+		s.setToken(s.cfg.Token, resp.Data.Renewable, resp.Data.TTL)
+		return nil
+	}
+
+	jwt, err := os.ReadFile(s.cfg.KubernetesTokenFile)
+	if err != nil {
+		return fmt.Errorf("vault: failed to read service account token: %w", err)
+	}
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	body := map[string]string{"role": s.cfg.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+	if err := s.do("POST", "auth/"+s.cfg.KubernetesMount+"/login", "", body, &resp); err != nil {
+		return fmt.Errorf("vault: kubernetes login failed: %w", err)
+	}
+	s.setToken(resp.Auth.ClientToken, resp.Auth.Renewable, resp.Auth.LeaseDuration)
+	return nil
+}
+
+// setToken replaces the token together with its lease
+func (s *vaultSecret) setToken(token string, renewable bool, ttl int) {
+	s.token = token
+	s.renewable = renewable
+	s.ttl = time.Duration(ttl) * time.Second
+	s.obtained = time.Now()
+}
+
+// renewAt returns when the token should be renewed, at half its lease, or
+// the zero time for tokens that do not expire
+func (s *vaultSecret) renewAt() time.Time {
+	if s.ttl <= 0 {
+		return time.Time{}
+	}
+	return s.obtained.Add(s.ttl / 2)
+}
+
+// renew extends the token's lease, logging in again when a Kubernetes token
+// cannot be renewed
+func (s *vaultSecret) renew() error {
+	if s.renewable {
+		var resp struct {
+			Auth vaultAuth `json:"auth"`
+		}
+		err := s.do("POST", "auth/token/renew-self", s.token, map[string]string{}, &resp)
+		if err == nil {
+			s.setToken(s.token, resp.Auth.Renewable, resp.Auth.LeaseDuration)
+			return nil
+		}
+		if s.cfg.KubernetesRole == "" {
+			return fmt.Errorf("vault: failed to renew token: %w", err)
+		}
+		s.logger.Warn("failed to renew Vault token, logging in again", zap.Error(err))
+	}
+	if s.cfg.KubernetesRole == "" {
+		return fmt.Errorf("vault: token is not renewable and expires soon")
+	}
+	return s.authenticate()
+}
+
+// read fetches the API key from the secret, of a KV version 1 or 2 engine
+func (s *vaultSecret) read() (string, error) {
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := s.do("GET", s.cfg.Path, s.token, nil, &resp); err != nil {
+		return "", fmt.Errorf("vault: failed to read %s: %w", s.cfg.Path, err)
+	}
+
+	data := resp.Data
+	// KV version 2 nests the secret's fields next to its metadata
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+	key, _ := data[s.cfg.Field].(string)
+	if key == "" {
+		return "", fmt.Errorf("vault: secret %s has no field %q", s.cfg.Path, s.cfg.Field)
+	}
+	return key, nil
+}
+
+// refreshLoop renews the token when half its lease has passed and reads the
+// secret every refresh interval, keeping the previous key on failure
+func (s *vaultSecret) refreshLoop() {
+	defer close(s.done)
+
+	interval := time.Duration(s.cfg.RefreshInterval)
+	nextRead := time.Now().Add(interval)
+	var retryAt time.Time
+	for {
+		wake := nextRead
+		if renewAt := s.renewAt(); !renewAt.IsZero() {
+			if renewAt.Before(retryAt) {
+				renewAt = retryAt
+			}
+			if renewAt.Before(wake) {
+				wake = renewAt
+			}
+		}
+
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		now := time.Now()
+		if renewAt := s.renewAt(); !renewAt.IsZero() && !now.Before(renewAt) && !now.Before(retryAt) {
+			if err := s.renew(); err != nil {
+				s.logger.Error("failed to renew Vault token", zap.Error(err))
+				retryAt = now.Add(vaultRenewRetry)
+			}
+		}
+
+		if time.Now().Before(nextRead) {
+			continue
+		}
+		nextRead = time.Now().Add(interval)
+
+		key, err := s.read()
+		if err != nil {
+			s.logger.Warn("failed to read API key from Vault, keeping the previous key", zap.Error(err))
+			continue
+		}
+		if key != s.Key() {
+			s.key.Store(&key)
+			s.logger.Info("reloaded rotated API key from Vault", zap.String("path", s.cfg.Path))
+		}
+	}
+}
+
+// do sends a request to the Vault API and decodes the response into v
+func (s *vaultSecret) do(method, path, token string, body, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, s.cfg.Address+"/v1/"+strings.TrimPrefix(path, "/"), reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if s.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.cfg.Namespace)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// unmarshalCaddyfile parses a vault { ... } block
+func (c *VaultConfig) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var field *string
+		switch d.Val() {
+		case "address":
+			field = &c.Address
+		case "namespace":
+			field = &c.Namespace
+		case "token":
+			field = &c.Token
+		case "kubernetes_role":
+			field = &c.KubernetesRole
+		case "kubernetes_mount":
+			field = &c.KubernetesMount
+		case "kubernetes_token_file":
+			field = &c.KubernetesTokenFile
+		case "path":
+			field = &c.Path
+		case "field":
+			field = &c.Field
+
+		case "refresh_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid vault refresh_interval %q: %v", d.Val(), err)
+			}
+			c.RefreshInterval = caddy.Duration(interval)
+			continue
+
+		default:
+			return d.Errf("unrecognized vault subdirective: %s", d.Val())
+		}
+
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		*field = d.Val()
+	}
+	return nil
+}
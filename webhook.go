@@ -0,0 +1,338 @@
+package caddyauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule((*Webhook)(nil))
+	httpcaddyfile.RegisterHandlerDirective("tailscale_auth_webhook", parseWebhookCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("tailscale_auth_webhook", httpcaddyfile.Before, "respond")
+}
+
+// webhookSignatureTolerance is how old a signed webhook may be before it is rejected as a replay
+const webhookSignatureTolerance = 5 * time.Minute
+
+// webhookMaxBodySize limits the size of accepted webhook payloads
+const webhookMaxBodySize = 1 << 20
+
+// WebhookEvent is a single event of a Tailscale webhook delivery
+type WebhookEvent struct {
+	Timestamp string          `json:"timestamp"`
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	Tailnet   string          `json:"tailnet"`
+	Message   string          `json:"message"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// webhookEventData holds the fields of an event's data the cache cares about
+type webhookEventData struct {
+	NodeID string `json:"nodeID"`
+}
+
+// cacheEvents are the event types that change which device an IP address belongs to
+var cacheEvents = map[string]bool{
+	"nodeCreated":    true,
+	"nodeDeleted":    true,
+	"nodeApproved":   true,
+	"nodeKeyExpired": true,
+	"userApproved":   true,
+	"userDeleted":    true,
+	"userSuspended":  true,
+	"userRestored":   true,
+}
+
+// Webhook is a Caddy handler that receives Tailscale webhook events and
+// refreshes the device cache of the tailnet they belong to, so changes take
+// effect immediately instead of on the next cache miss.
+type Webhook struct {
+	TailnetConfig
+
+	// Use names a tailnet configuration defined in the tailscale_auth app
+	Use string `json:"use,omitempty"`
+
+	// Secret is the webhook secret shown when the endpoint was created in the
+	// Tailscale admin console, used to verify Tailscale-Webhook-Signature.
+	// Placeholders such as {env.*} are expanded
+	Secret string `json:"secret,omitempty"`
+
+	// RedactLogs replaces login names, hostnames and IP addresses in the
+	// handler's log output, like the redact_logs of tailscale_auth
+	RedactLogs string `json:"redact_logs,omitempty"`
+
+	// RedactSalt keys the hashes of RedactLogs. Placeholders such as {env.*} are expanded
+	RedactSalt string `json:"redact_salt,omitempty"`
+
+	logger   *zap.Logger
+	cache    *tailnetCache
+	cacheKey string
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Webhook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.tailscale_auth_webhook",
+		New: func() caddy.Module { return new(Webhook) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (h *Webhook) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if h.RedactLogs != "" {
+		h.logger = newRedactingLogger(h.logger, h.RedactLogs, caddy.NewReplacer().ReplaceAll(h.RedactSalt, ""))
+	}
+
+	if err := expandPlaceholders(configField{"secret", &h.Secret}); err != nil {
+		return err
+	}
+	if err := h.TailnetConfig.expandPlaceholders(); err != nil {
+		return err
+	}
+	if err := resolveAppConfig(ctx, h.Use, &h.TailnetConfig); err != nil {
+		return err
+	}
+
+	h.TailnetConfig.setDefaults()
+
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	// The pool key includes key_material, so the webhook must set it like the
+	// handlers do to refresh the cache they read
+	keyMaterial, err := appKeyMaterial(ctx)
+	if err != nil {
+		return err
+	}
+	h.TailnetConfig.keyMaterial = keyMaterial
+
+	cache, key, err := h.TailnetConfig.loadCache(ctx, h.logger.With(zap.String("tailnet", h.Tailnet)))
+	if err != nil {
+		return err
+	}
+	h.cache = cache
+	h.cacheKey = key
+
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (h *Webhook) Validate() error {
+	if h.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	if err := validateRedactLogs(h.RedactLogs); err != nil {
+		return err
+	}
+	return h.TailnetConfig.validate()
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (h *Webhook) Cleanup() error {
+	if h.cacheKey == "" {
+		return nil
+	}
+	_, err := cachePool.Delete(h.cacheKey)
+	return err
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler. It answers the webhook itself.
+func (h *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("webhook only accepts POST"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("failed to read webhook body: %w", err))
+	}
+
+	if err := verifyWebhookSignature(h.Secret, r.Header.Get("Tailscale-Webhook-Signature"), body, time.Now()); err != nil {
+		h.logger.Warn("rejected webhook", zap.Error(err))
+		return caddyhttp.Error(http.StatusUnauthorized, err)
+	}
+
+	var events []WebhookEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("failed to unmarshal webhook events: %w", err))
+	}
+
+	if err := h.handleEvents(r.Context(), events); err != nil {
+		h.logger.Error("failed to apply webhook events", zap.Error(err))
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleEvents updates the affected devices in the cache. Events that name a
+// node only update that device; events without one, such as user events,
+// fall back to a single full refresh
+func (h *Webhook) handleEvents(ctx context.Context, events []WebhookEvent) error {
+	var nodeIDs []string
+	refresh := false
+	for _, event := range events {
+		h.logger.Info("received webhook event",
+			zap.String("type", event.Type),
+			zap.String("message", event.Message))
+
+		if !cacheEvents[event.Type] {
+			continue
+		}
+
+		var data webhookEventData
+		if len(event.Data) > 0 {
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				h.logger.Warn("failed to unmarshal webhook event data", zap.Error(err))
+			}
+		}
+
+		if data.NodeID == "" {
+			refresh = true
+		} else if !slices.Contains(nodeIDs, data.NodeID) {
+			nodeIDs = append(nodeIDs, data.NodeID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+
+	if refresh {
+		if err := h.cache.refreshOnce(ctx); err != nil {
+			return fmt.Errorf("failed to refresh device cache: %w", err)
+		}
+		return nil
+	}
+
+	for _, id := range nodeIDs {
+		if err := h.cache.refreshDevice(ctx, id); err != nil {
+			return fmt.Errorf("failed to update device %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// verifyWebhookSignature checks a Tailscale-Webhook-Signature header of the
+// form "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">"
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time) error {
+	if header == "" {
+		return errors.New("missing Tailscale-Webhook-Signature header")
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return errors.New("malformed Tailscale-Webhook-Signature header")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp %q: %w", timestamp, err)
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > webhookSignatureTolerance || age < -webhookSignatureTolerance {
+		return fmt.Errorf("webhook timestamp is outside the %s tolerance", webhookSignatureTolerance)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, signature := range signatures {
+		got, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return errors.New("webhook signature does not match")
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	tailscale_auth_webhook [<matcher>] {
+//	    secret <secret>
+//	    use <name> | api_key <key> tailnet <tailnet> ...
+//	    redact_logs [hash|mask] [<salt>]
+//	}
+func (h *Webhook) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			if ok, err := h.TailnetConfig.unmarshalCaddyfileOption(d); ok {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			switch d.Val() {
+			case "use":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Use = d.Val()
+
+			case "secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Secret = d.Val()
+
+			case "redact_logs":
+				if err := unmarshalRedactLogs(d, &h.RedactLogs, &h.RedactSalt); err != nil {
+					return err
+				}
+
+			default:
+				return d.Errf("unrecognized subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseWebhookCaddyfile unmarshals tokens from h into a new Webhook handler.
+func parseWebhookCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var w Webhook
+	err := w.UnmarshalCaddyfile(h.Dispenser)
+	return &w, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Webhook)(nil)
+	_ caddy.Validator             = (*Webhook)(nil)
+	_ caddy.CleanerUpper          = (*Webhook)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Webhook)(nil)
+	_ caddyfile.Unmarshaler       = (*Webhook)(nil)
+)
@@ -0,0 +1,84 @@
+package caddyauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWebhookSharesHandlerCache(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	config := `{"admin": {"disabled": true}, "apps": {"tailscale_auth": {"key_material": "hash"}}}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	t.Cleanup(func() { caddy.Stop() })
+	ctx := caddy.ActiveContext()
+
+	tailnet := TailnetConfig{
+		APIKey:    "tskey-api-test",
+		Tailnet:   "example.com",
+		CacheFile: filepath.Join(t.TempDir(), "devices.json"),
+	}
+	handler := &TailscaleAuth{TailnetConfig: tailnet}
+	if err := handler.Provision(ctx); err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	t.Cleanup(func() { handler.Cleanup() })
+	webhook := &Webhook{TailnetConfig: tailnet, Secret: "webhook-secret"}
+	if err := webhook.Provision(ctx); err != nil {
+		t.Fatalf("webhook: %v", err)
+	}
+	t.Cleanup(func() { webhook.Cleanup() })
+
+	if webhook.cacheKey != handler.cacheKeys[0] || webhook.cache != handler.caches[0] {
+		t.Errorf("webhook cache %s, handler cache %s, want one shared cache", webhook.cacheKey, handler.cacheKeys[0])
+	}
+	if webhook.cache.keyMaterial != "hash" {
+		t.Errorf("webhook cache key_material = %q, want hash", webhook.cache.keyMaterial)
+	}
+}
+
+func TestWebhookSecretPlaceholder(t *testing.T) {
+	t.Setenv("TS_WEBHOOK_SECRET", "webhook-secret")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	h := &Webhook{
+		TailnetConfig: TailnetConfig{
+			APIKey:    "tskey-api-test",
+			Tailnet:   "example.com",
+			CacheFile: filepath.Join(t.TempDir(), "devices.json"),
+		},
+		Secret: "{env.TS_WEBHOOK_SECRET}",
+	}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	defer h.Cleanup()
+
+	body := []byte("[]")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Tailscale-Webhook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, nil); err != nil {
+		t.Fatalf("ServeHTTP = %v, want the delivery signed with the expanded secret accepted", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", w.Code)
+	}
+}